@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+	"mongo-elastic-sync/syncer"
+)
+
+// dump indexes all documents of the configured collections once and exits. It returns an error if any collection
+// failed to dump. With --dry-run, the index creations, mapping changes and document operations of the dump are written
+// to --output instead of being performed; with --sample, only the first documents of each collection are dumped.
+func dump(args []string) error {
+	flags, configPtr := newFlagSet("dump")
+	dryRunPtr := flags.Bool("dry-run", false, "Write the operations that would be performed to --output instead of performing them")
+	outputPtr := flags.String("output", "-", "File the operations of a dry run are written to, or - for the standard output")
+	samplePtr := flags.Int("sample", 0, "Maximum number of documents dumped from each collection, or 0 for all documents")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := open(*configPtr)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+
+	var snk sink.Sink
+	opts := a.opts
+	if *dryRunPtr {
+		w := os.Stdout
+		if *outputPtr != "-" {
+			if w, err = os.Create(*outputPtr); err != nil {
+				return fmt.Errorf("creating dry run output: %w", err)
+			}
+			defer func() { _ = w.Close() }()
+		}
+		if snk, opts, err = a.dryRun(w); err != nil {
+			return err
+		}
+	} else {
+		if err = a.openSink(true); err != nil {
+			return err
+		}
+		snk = a.sink
+	}
+	if *samplePtr > 0 {
+		opts = append(opts, syncer.WithSample(*samplePtr))
+	}
+
+	s := syncer.New(mongo2.NewSource(a.mongo), snk, opts...)
+	return s.Dump(context.Background(), a.conf.SyncMapping)
+}
+
+// tail tails the change streams of the configured collections without dumping them. Each change stream resumes from
+// its checkpoint or, if it has none, starts at the startAt position of its collection or now. With --from, all change
+// streams replay the changes made since the given time or resume token instead. Checkpoints are saved as the change
+// streams are tailed.
+func tail(args []string) error {
+	flags, configPtr := newFlagSet("tail")
+	fromPtr := flags.String("from", "", "RFC 3339 time or resume token to replay changes from, ignoring checkpoints")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := open(*configPtr)
+	if err != nil {
+		return err
+	}
+	if err = a.openSink(true); err != nil {
+		return err
+	}
+	defer a.close()
+
+	opts := append(a.opts, syncer.WithCheckpoints(a.checkpoints()))
+	if *fromPtr != "" {
+		from, err := syncer.ParsePosition(*fromPtr)
+		if err != nil {
+			return fmt.Errorf("parsing --from: %w", err)
+		}
+		log.With("from", from).Info("Replaying changes")
+		opts = append(opts, syncer.WithReplay(from))
+	}
+
+	if a.conf.MetricsAddress != "" {
+		go serveMetrics(a.conf.MetricsAddress)
+	}
+
+	s := syncer.New(mongo2.NewSource(a.mongo), a.sink, opts...)
+	return s.Tail(context.Background(), a.conf.SyncMapping)
+}
+
+// backfill re-syncs the documents of a collection with the given ids, or matching the given filter, and deletes the
+// documents with the given ids that no longer exist in Mongo from the indexes.
+func backfill(args []string) error {
+	flags, configPtr := newFlagSet("backfill")
+	nsPtr := flags.String("namespace", "", "Collection to backfill, as <database>.<collection>")
+	idsPtr := flags.String("ids", "", `Extended JSON array of the _ids of the documents to backfill, e.g. [{"$oid": "..."}, "key", 42]`)
+	filterPtr := flags.String("filter", "", "Mongo filter, in extended JSON, selecting the documents to backfill")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(*nsPtr, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("--namespace [%s] must be <database>.<collection>", *nsPtr)
+	}
+	ns := syncer.Namespace{Database: parts[0], Collection: parts[1]}
+
+	if (*idsPtr == "") == (*filterPtr == "") {
+		return errors.New("exactly one of --ids and --filter is required")
+	}
+
+	// The ids are decoded as the value of a document, as extended JSON has no top-level arrays
+	var ids struct {
+		IDs []interface{} `bson:"ids"`
+	}
+	if *idsPtr != "" {
+		if err := bson.UnmarshalExtJSON([]byte(`{"ids": `+*idsPtr+`}`), false, &ids); err != nil {
+			return fmt.Errorf("parsing --ids: %w", err)
+		}
+		if len(ids.IDs) == 0 {
+			return errors.New("--ids must not be empty")
+		}
+	}
+
+	var filter bson.M
+	if *filterPtr != "" {
+		if err := bson.UnmarshalExtJSON([]byte(*filterPtr), false, &filter); err != nil {
+			return fmt.Errorf("parsing --filter: %w", err)
+		}
+	}
+
+	a, err := open(*configPtr)
+	if err != nil {
+		return err
+	}
+	if err = a.openSink(true); err != nil {
+		return err
+	}
+	defer a.close()
+
+	s := syncer.New(mongo2.NewSource(a.mongo), a.sink, a.opts...)
+	synced, deleted, err := s.Backfill(context.Background(), a.conf.SyncMapping, ns, ids.IDs, filter)
+	if err != nil {
+		return err
+	}
+
+	// Stdout is left to the sink
+	_, _ = fmt.Fprintf(os.Stderr, "Backfilled %d documents, deleted %d documents\n", synced, deleted)
+	return nil
+}
+
+// validate checks the configuration and the connections to Mongo and the sinks.
+func validate(args []string) error {
+	flags, configPtr := newFlagSet("validate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := open(*configPtr)
+	if err != nil {
+		return err
+	}
+	if err = a.openSink(false); err != nil {
+		return err
+	}
+	defer a.close()
+
+	s := syncer.New(mongo2.NewSource(a.mongo), a.sink, a.opts...)
+	if err = s.Validate(context.Background(), a.conf.SyncMapping); err != nil {
+		return err
+	}
+
+	fmt.Println("Configuration and connections are valid")
+	return nil
+}
+
+// status prints the checkpoint of each configured collection, and how far it lags behind the current time.
+func status(args []string) error {
+	flags, configPtr := newFlagSet("status")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := open(*configPtr)
+	if err != nil {
+		return err
+	}
+	if err = a.openSink(false); err != nil {
+		return err
+	}
+	defer a.close()
+
+	opts := append(a.opts, syncer.WithCheckpoints(a.checkpoints()))
+	s := syncer.New(mongo2.NewSource(a.mongo), a.sink, opts...)
+	statuses, err := s.Status(context.Background(), a.conf.SyncMapping)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "COLLECTION\tTARGET\tCHECKPOINT\tLAG\tSAVED")
+	now := time.Now()
+	for _, st := range statuses {
+		name := fmt.Sprintf("%s.%s", st.Namespace.Database, st.Namespace.Collection)
+		target := st.Target
+		if target == "" {
+			target = "-"
+		}
+
+		cp := st.Checkpoint
+		if cp.Token == "" {
+			_, _ = fmt.Fprintf(w, "%s\t%s\tnone\t-\t-\n", name, target)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, target,
+			cp.ClusterTime.Format(time.RFC3339), now.Sub(cp.ClusterTime).Round(time.Second), cp.UpdatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// verify compares the configured collections with their indexes, reports the differences and, with --repair, repairs
+// them. It returns an error if differences were found and not repaired.
+func verify(args []string) error {
+	flags, configPtr := newFlagSet("verify")
+	repairPtr := flags.Bool("repair", false, "Re-index missing and stale documents and delete extra documents")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := open(*configPtr)
+	if err != nil {
+		return err
+	}
+	// Only repairs write to the sink
+	if err = a.openSink(*repairPtr); err != nil {
+		return err
+	}
+	defer a.close()
+
+	s := syncer.New(mongo2.NewSource(a.mongo), a.sink, a.opts...)
+	drifts, err := s.Verify(context.Background(), a.conf.SyncMapping, *repairPtr)
+	if err != nil {
+		return err
+	}
+
+	drifted := 0
+	for _, d := range drifts {
+		printDrift(d)
+		if !d.InSync() && !d.Repaired {
+			drifted++
+		}
+	}
+	if drifted > 0 {
+		return fmt.Errorf("%d of %d collections have drifted, run verify with --repair to repair them", drifted, len(drifts))
+	}
+	return nil
+}
+
+// printDrift prints the verification result of a collection and the documents that differ.
+func printDrift(d syncer.Drift) {
+	name := fmt.Sprintf("%s.%s", d.Namespace.Database, d.Namespace.Collection)
+	if d.Target != "" {
+		name += " target " + d.Target
+	}
+
+	status := "in sync"
+	switch {
+	case d.Repaired:
+		status = "repaired"
+	case !d.InSync():
+		status = "drifted"
+	}
+
+	fmt.Printf("%s -> %s: %s, mongo=%d indexed=%d missing=%d extra=%d stale=%d\n",
+		name, d.Index, status, d.MongoCount, d.IndexCount, len(d.Missing), len(d.Extra), len(d.Stale))
+	for _, doc := range d.Missing {
+		fmt.Printf("  missing %s/%s\n", doc.Index, doc.ID)
+	}
+	for _, doc := range d.Extra {
+		fmt.Printf("  extra %s/%s\n", doc.Index, doc.ID)
+	}
+	for _, doc := range d.Stale {
+		fmt.Printf("  stale %s/%s\n", doc.Index, doc.ID)
+	}
+}
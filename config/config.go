@@ -2,40 +2,255 @@ package config
 
 import (
 	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 
 	"mongo-elastic-sync/fields"
 )
 
+// Sink types
+const (
+	SinkTypeElasticsearch = "elasticsearch"
+	SinkTypeNDJSON        = "ndjson"
+	SinkTypeStdout        = "stdout"
+)
+
+// Config is the configuration of the syncer.
+// String values may refer to environment variables as ${VAR}. MongoURL and ElasticURL, which usually contain
+// credentials, may instead be read from the files named by MongoURLFile and ElasticURLFile, e.g. mounted secrets.
+// The top-level string and boolean settings can be overridden by environment variables named MONGO_ELASTIC_SYNC_ and
+// the setting in upper snake case, e.g. MONGO_ELASTIC_SYNC_MONGO_URL; overriding a setting also overrides its file
+// variant.
 type Config struct {
-	MongoURL   string `yaml:"mongoURL"`
-	ElasticURL string `yaml:"elasticURL"`
-	// Embedded SyncMapping
-	Databases []DatabaseMapping `yaml:"databases"`
+	MongoURL       string `yaml:"mongoURL"`
+	MongoURLFile   string `yaml:"mongoURLFile"`
+	ElasticURL     string `yaml:"elasticURL"`
+	ElasticURLFile string `yaml:"elasticURLFile"`
+	// Connections are named Elasticsearch connections that collection targets can write to.
+	Connections map[string]Connection `yaml:"connections"`
+	Sink        SinkConfig            `yaml:"sink"`
+	State       StateConfig           `yaml:"state"`
+	// Transactions tails all collections in one change stream and applies the changes of each multi-document
+	// transaction in one bulk request, so that searches do not see half-applied transactions.
+	Transactions bool `yaml:"transactions"`
+	// MetricsAddress is the address, e.g. :9090, to serve metrics on at /debug/vars, if it is not empty.
+	MetricsAddress string `yaml:"metricsAddress"`
+	SyncMapping    `yaml:",inline"`
+}
+
+// StateConfig configures the state the syncer keeps in MongoDB, in Database, which defaults to mongo-elastic-sync
+// and is never synced.
+// If Resume is set, the resume token of each change stream is saved as it is tailed, and collections with a saved
+// token resume tailing after it instead of being dumped again when the syncer restarts. LeaderElection and Workers
+// imply Resume, and cannot both be set.
+type StateConfig struct {
+	Database       string          `yaml:"database"`
+	Resume         bool            `yaml:"resume"`
+	LeaderElection *LeaderElection `yaml:"leaderElection"`
+	Workers        *Workers        `yaml:"workers"`
+}
+
+// LeaderElection lets multiple instances run for high availability. Only the instance holding the lease called Lease
+// (default leader) syncs; the others wait on standby, and one of them takes over from the saved resume tokens when
+// the lease is not renewed. The lease expires TTL (default 30s) after it was last renewed and is renewed every TTL/3.
+// Instance identifies the instance and defaults to its hostname and process id.
+type LeaderElection struct {
+	Lease    string        `yaml:"lease"`
+	TTL      time.Duration `yaml:"ttl"`
+	Instance string        `yaml:"instance"`
+}
+
+// Workers shares the synced collections among the instances in the group called Group (default workers), so that
+// each collection is synced by one instance at a time. Collections are rebalanced as instances join or leave the
+// group, and the instance taking over a collection resumes from its saved resume token. Embedded and joined child
+// collections move with their parents.
+// Leases expire TTL (default 30s) after they were last renewed and are renewed every TTL/3. Instance identifies the
+// instance and defaults to its hostname and process id.
+type Workers struct {
+	Group    string        `yaml:"group"`
+	TTL      time.Duration `yaml:"ttl"`
+	Instance string        `yaml:"instance"`
 }
 
+// Connection is a named Elasticsearch connection. URL may instead be read from the file named by URLFile.
+type Connection struct {
+	URL     string `yaml:"url"`
+	URLFile string `yaml:"urlFile"`
+}
+
+// SinkConfig selects where synced documents are written. Type is elasticsearch (the default), ndjson or stdout.
+// The ndjson sink writes Elasticsearch bulk requests to the file at Path, and the stdout sink to the standard output.
+// If Typed is set, they write the document types that Elasticsearch 6.x requires.
+type SinkConfig struct {
+	Type  string `yaml:"type"`
+	Path  string `yaml:"path"`
+	Typed bool   `yaml:"typed"`
+}
+
+// SyncMapping configures the databases to sync.
+// Databases are synced if they are listed in Databases or match an Include pattern. If there are neither, all
+// databases except the system databases are synced. Databases matching an Exclude pattern are never synced.
 type SyncMapping struct {
 	Databases []DatabaseMapping `yaml:"databases"`
+	Include   []string          `yaml:"include"`
+	Exclude   []string          `yaml:"exclude"`
 }
 
+// DatabaseMapping configures the collections of a database to sync.
+// Collections are selected like databases in SyncMapping, by Collections and the Include and Exclude patterns.
+// System collections and views are never synced.
 type DatabaseMapping struct {
 	Name        string              `yaml:"name"`
 	Collections []CollectionMapping `yaml:"collections"`
+	Include     []string            `yaml:"include"`
+	Exclude     []string            `yaml:"exclude"`
 }
 
 type CollectionMapping struct {
-	Name   string     `yaml:"name"`
-	Fields []fields.M `yaml:"fields"`
+	Name string `yaml:"name"`
+	// Index is a text/template that selects the index of each document from its fields, e.g. orders-{{.tenantId}}.
+	// If it is empty, documents are indexed into the index named <database>.<collection>.
+	Index   string     `yaml:"index"`
+	Fields  []fields.M `yaml:"fields"`
+	Lookups []Lookup   `yaml:"lookups"`
+	Embed   *Embed     `yaml:"embed"`
+	Join    *Join      `yaml:"join"`
+	// Rollover routes documents to time-based indexes instead of a single index.
+	Rollover *Rollover `yaml:"rollover"`
+	// SoftDelete treats documents marked as deleted as if they were deleted.
+	SoftDelete *SoftDelete `yaml:"softDelete"`
+	// Targets are additional indexes the collection is synced into.
+	Targets []Target `yaml:"targets"`
+	// Reconcile periodically repairs drift between the collection and its indexes while it is tailed.
+	Reconcile *Reconcile `yaml:"reconcile"`
+	// StartAt is an RFC 3339 time or a resume token to start tailing the collection at, instead of dumping it, if it
+	// has no checkpoint. Transaction mode ignores it.
+	StartAt string `yaml:"startAt"`
 }
 
-// FromYamlFile decodes the yaml content at the given file path into config.
-// TODO: Add validation
+// Reconcile verifies a collection against its index and its targets' indexes every Interval (default 1h) while the
+// collection is tailed, and repairs the differences, like the verify command does with --repair.
+// Documents are read from Mongo and from the index at most Rate (default 100) per second, so that reconciling does not
+// compete with tailing or searches.
+// Changes tailed while a collection is being verified may be reported as drift, and are repaired with the version of
+// the document read during verification.
+type Reconcile struct {
+	Interval time.Duration `yaml:"interval"`
+	Rate     int           `yaml:"rate"`
+}
+
+// Target syncs a collection into another index, possibly on another Elasticsearch cluster, in addition to the
+// collection's own index.
+// Connection names one of the configured connections; if it is empty, the target is written to the default sink.
+// Index and Fields replace the collection's index and field selection when they are set; a target with an Index is
+// not rolled over. The collection's lookups and soft delete rules apply to all its targets. Embedded and joined
+// collections cannot have targets, and embedded children are only embedded into their parent's own index.
+// Name identifies the target in logs and errors.
+type Target struct {
+	Name       string     `yaml:"name"`
+	Connection string     `yaml:"connection"`
+	Index      string     `yaml:"index"`
+	Fields     []fields.M `yaml:"fields"`
+}
+
+// SoftDelete marks the documents of a collection as deleted when Field is set to a non-null value or, if Value is
+// set, when Field equals Value (e.g. deletedAt, or isDeleted: true).
+// Soft-deleted documents are skipped when dumping and deleted from the index when tailing, unless Flag is set, in
+// which case they are indexed with the boolean field Flag set to true. Soft delete rules are not applied to embedded
+// collections.
+type SoftDelete struct {
+	Field string      `yaml:"field"`
+	Value interface{} `yaml:"value"`
+	Flag  string      `yaml:"flag"`
+}
+
+// Rollover routes the documents of an append-heavy collection to indexes named <database>.<collection>-<period>
+// by the date in DateField, or the timestamp of the document's ObjectID if DateField is empty.
+// Period is either daily or monthly. An alias named <database>.<collection> covers all the indexes.
+// If Retention is greater than zero, indexes older than Retention periods are deleted.
+type Rollover struct {
+	Period    string `yaml:"period"`
+	DateField string `yaml:"dateField"`
+	Retention int    `yaml:"retention"`
+}
+
+// Embed configures a child collection whose documents are embedded as an array into the documents of a parent
+// collection in the same database, instead of being indexed into their own index.
+// ParentField is the field of the child documents that holds the _id of their parent document.
+type Embed struct {
+	Parent      string `yaml:"parent"`
+	ParentField string `yaml:"parentField"`
+	As          string `yaml:"as"`
+}
+
+// Join maps a parent collection and its child collections in the same database onto the parent's index, related by
+// an Elasticsearch join field.
+// Field is the name of the join field and Relation is the relation name of the collection's documents.
+// Child collections set Parent to the parent collection and ParentField to the field that holds the _id of their
+// parent document; child documents are routed to the shard of their parent.
+// If CascadeDelete is set on a parent collection, deleting a parent document also deletes its children.
+type Join struct {
+	Field         string `yaml:"field"`
+	Relation      string `yaml:"relation"`
+	Parent        string `yaml:"parent"`
+	ParentField   string `yaml:"parentField"`
+	CascadeDelete bool   `yaml:"cascadeDelete"`
+}
+
+// Lookup joins documents from another collection in the same database into each synced document,
+// like a $lookup aggregation stage. The matching documents are saved as an array in the As field.
+// Fields selects the fields of the joined documents; if it is empty, all fields are kept.
+type Lookup struct {
+	From         string     `yaml:"from"`
+	LocalField   string     `yaml:"localField"`
+	ForeignField string     `yaml:"foreignField"`
+	As           string     `yaml:"as"`
+	Fields       []fields.M `yaml:"fields"`
+}
+
+// FromYamlFile decodes the yaml content at the given file path into config and validates it.
+// Unknown keys are rejected. If the content is invalid, a *ValidationError listing all the problems found is returned.
 func FromYamlFile(filePath string, config *Config) error {
 	b, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return err
 	}
 
-	return yaml.Unmarshal(b, config)
+	return Parse(b, config)
+}
+
+// Parse decodes the yaml content b into config and validates it, like FromYamlFile. Environment variables are
+// interpolated and override settings, and secret files are read, before validation.
+func Parse(b []byte, config *Config) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return err
+	}
+
+	// Values are interpolated in the document, so that variables can set values of any type
+	problems := unknownKeys(&root, reflect.TypeOf(config))
+	problems = append(problems, interpolate(&root, os.LookupEnv)...)
+	if root.Kind != 0 {
+		if err := root.Decode(config); err != nil {
+			typeErr, ok := err.(*yaml.TypeError)
+			if !ok {
+				return err
+			}
+			// The values that could be decoded are still validated
+			problems = append(problems, typeErrorProblems(typeErr)...)
+		}
+	}
+
+	problems = append(problems, override(config, os.LookupEnv)...)
+	problems = append(problems, readSecretFiles(config, &root)...)
+	problems = append(problems, validate(*config, &root)...)
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+		return &ValidationError{Problems: problems}
+	}
+	return nil
 }
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables that override the top-level settings of the configuration.
+const EnvPrefix = "MONGO_ELASTIC_SYNC_"
+
+// variableRegexp matches a reference to an environment variable, e.g. ${MONGO_PASSWORD}
+var variableRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolate replaces the references to environment variables in the scalar values of node with their values, as
+// looked up by lookup. It returns a problem for each variable that is not set.
+func interpolate(node *yaml.Node, lookup func(string) (string, bool)) []Problem {
+	var problems []Problem
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, n := range node.Content {
+			problems = append(problems, interpolate(n, lookup)...)
+		}
+	case yaml.MappingNode:
+		// Keys are not interpolated
+		for i := 1; i < len(node.Content); i += 2 {
+			problems = append(problems, interpolate(node.Content[i], lookup)...)
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+
+		node.Value = variableRegexp.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := variableRegexp.FindStringSubmatch(ref)[1]
+			value, ok := lookup(name)
+			if !ok {
+				problems = append(problems, Problem{Line: node.Line, Message: fmt.Sprintf("environment variable [%s] is not set", name)})
+			}
+			return value
+		})
+		// Unquoted values are resolved again, so that e.g. ${TRANSACTIONS} can set a boolean
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	}
+	return problems
+}
+
+// override sets the top-level string and boolean settings of config that have an environment variable, as looked up
+// by lookup, to its value. Overriding a setting clears its file variant, and overriding a file variant clears the
+// setting, so that the environment replaces both.
+func override(config *Config, lookup func(string) (string, bool)) []Problem {
+	var problems []Problem
+
+	v := reflect.ValueOf(config).Elem()
+	fieldsByName := make(map[string]reflect.Value, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		if name := yamlName(v.Type().Field(i)); name != "" {
+			fieldsByName[name] = v.Field(i)
+		}
+	}
+
+	names := make([]string, 0, len(fieldsByName))
+	for name := range fieldsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := fieldsByName[name]
+		env := EnvPrefix + upperSnakeCase(name)
+		value, ok := lookup(env)
+		if !ok {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, Problem{Path: name, Message: fmt.Sprintf("environment variable [%s] is not a boolean", env)})
+				continue
+			}
+			field.SetBool(b)
+		default:
+			continue
+		}
+
+		variant := name + "File"
+		if strings.HasSuffix(name, "File") {
+			variant = strings.TrimSuffix(name, "File")
+		}
+		if f, ok := fieldsByName[variant]; ok && f.Kind() == reflect.String {
+			if _, overridden := lookup(EnvPrefix + upperSnakeCase(variant)); !overridden {
+				f.SetString("")
+			}
+		}
+	}
+	return problems
+}
+
+// yamlName returns the key of the struct field in yaml documents, or an empty string if it is not a single key.
+func yamlName(field reflect.StructField) string {
+	tag := strings.Split(field.Tag.Get("yaml"), ",")
+	if field.PkgPath != "" || tag[0] == "-" || (len(tag) > 1 && tag[1] == "inline") {
+		return ""
+	}
+	if tag[0] == "" {
+		return strings.ToLower(field.Name)
+	}
+	return tag[0]
+}
+
+// upperSnakeCase converts a camel case name, e.g. mongoURLFile, to upper snake case, e.g. MONGO_URL_FILE.
+func upperSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := !unicode.IsUpper(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// readSecretFiles sets the settings of config that have a file variant to the content of the file it names, without
+// surrounding whitespace. The files are named relative to the working directory.
+func readSecretFiles(config *Config, root *yaml.Node) []Problem {
+	v := &validator{root: root}
+	v.secret(&config.MongoURL, config.MongoURLFile, []interface{}{"mongoURL"})
+	v.secret(&config.ElasticURL, config.ElasticURLFile, []interface{}{"elasticURL"})
+
+	names := make([]string, 0, len(config.Connections))
+	for name := range config.Connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conn := config.Connections[name]
+		v.secret(&conn.URL, conn.URLFile, []interface{}{"connections", name, "url"})
+		config.Connections[name] = conn
+	}
+	return v.problems
+}
+
+// secret sets value, the setting at path, to the content of file, if file is not empty.
+func (v *validator) secret(value *string, file string, path []interface{}) {
+	if file == "" {
+		return
+	}
+
+	filePath := at(path[:len(path)-1], fmt.Sprintf("%sFile", path[len(path)-1]))
+	if *value != "" {
+		v.addf(filePath, "%s and its file variant cannot both be set", formatPath(path))
+		return
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		v.addf(filePath, "reading secret file: %v", err)
+		return
+	}
+	*value = strings.TrimSpace(string(b))
+}
@@ -0,0 +1,405 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"mongo-elastic-sync/fields"
+)
+
+// Problem is a problem found in a configuration file.
+type Problem struct {
+	// Line is the line of the configuration file the problem is at, or 0 if it is unknown
+	Line int
+	// Path is the path of the invalid setting, e.g. databases[0].collections[1].name, or empty if it is unknown
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	if p.Path != "" {
+		s = fmt.Sprintf("%s: %s", p.Path, s)
+	}
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", p.Line, s)
+	}
+	return s
+}
+
+// ValidationError is returned when a configuration file is invalid. It lists all the problems found, by line.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = "\n  " + p.String()
+	}
+	problems := "problems"
+	if len(e.Problems) == 1 {
+		problems = "problem"
+	}
+	return fmt.Sprintf("%d %s in configuration:%s", len(e.Problems), problems, strings.Join(lines, ""))
+}
+
+var (
+	// typeErrorRegexp matches the errors of a yaml.TypeError, e.g. line 3: cannot unmarshal !!str `yes` into int
+	typeErrorRegexp = regexp.MustCompile(`^line (\d+): (.*)$`)
+	// invalidIndexChars matches the characters that Elasticsearch does not allow in index names
+	invalidIndexChars = regexp.MustCompile(`[\\/*?"<>| ,#:]`)
+	// templateActions matches the actions of an index template
+	templateActions = regexp.MustCompile(`{{.*?}}`)
+)
+
+// typeErrorProblems returns the problems reported by a yaml.TypeError, such as values of the wrong type.
+func typeErrorProblems(err *yaml.TypeError) []Problem {
+	problems := make([]Problem, 0, len(err.Errors))
+	for _, e := range err.Errors {
+		m := typeErrorRegexp.FindStringSubmatch(e)
+		if m == nil {
+			problems = append(problems, Problem{Message: e})
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+		problems = append(problems, Problem{Line: line, Message: m[2]})
+	}
+	return problems
+}
+
+// unknownKeys returns a problem for each key of the mappings in node that is not a field of the type t they are
+// decoded into, like yaml.Decoder.KnownFields reports them.
+func unknownKeys(node *yaml.Node, t reflect.Type) []Problem {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var problems []Problem
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			problems = append(problems, unknownKeys(n, t)...)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, n := range node.Content {
+				problems = append(problems, unknownKeys(n, t.Elem())...)
+			}
+		}
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Map:
+			for i := 1; i < len(node.Content); i += 2 {
+				problems = append(problems, unknownKeys(node.Content[i], t.Elem())...)
+			}
+		case reflect.Struct:
+			fieldTypes := structFieldTypes(t)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i]
+				fieldType, ok := fieldTypes[key.Value]
+				if !ok {
+					problems = append(problems, Problem{Line: key.Line, Message: fmt.Sprintf("field %s not found in type %s", key.Value, t)})
+					continue
+				}
+				problems = append(problems, unknownKeys(node.Content[i+1], fieldType)...)
+			}
+		}
+	}
+	return problems
+}
+
+// structFieldTypes returns the types of the fields of the struct type t by their key, including the fields of inlined
+// structs.
+func structFieldTypes(t reflect.Type) map[string]reflect.Type {
+	types := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if strings.HasSuffix(field.Tag.Get("yaml"), ",inline") {
+			for name, fieldType := range structFieldTypes(field.Type) {
+				types[name] = fieldType
+			}
+			continue
+		}
+		if name := yamlName(field); name != "" {
+			types[name] = field.Type
+		}
+	}
+	return types
+}
+
+// validator collects the problems of a configuration, locating them in the document they were decoded from.
+type validator struct {
+	root     *yaml.Node
+	problems []Problem
+}
+
+// validate returns the problems of config, which was decoded from root.
+func validate(config Config, root *yaml.Node) []Problem {
+	v := &validator{root: root}
+
+	v.url(config.MongoURL, []string{"mongodb", "mongodb+srv"}, []interface{}{"mongoURL"})
+	switch config.Sink.Type {
+	case "", SinkTypeElasticsearch:
+		v.url(config.ElasticURL, []string{"http", "https"}, []interface{}{"elasticURL"})
+	case SinkTypeNDJSON:
+		if config.Sink.Path == "" {
+			v.addf([]interface{}{"sink"}, "the ndjson sink needs a path")
+		}
+	case SinkTypeStdout:
+	default:
+		v.addf([]interface{}{"sink", "type"}, "unknown sink type [%s], must be %s, %s or %s", config.Sink.Type,
+			SinkTypeElasticsearch, SinkTypeNDJSON, SinkTypeStdout)
+	}
+
+	names := make([]string, 0, len(config.Connections))
+	for name := range config.Connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v.url(config.Connections[name].URL, []string{"http", "https"}, []interface{}{"connections", name, "url"})
+	}
+
+	databases := make(map[string]bool, len(config.Databases))
+	for i, db := range config.Databases {
+		path := []interface{}{"databases", i}
+		if db.Name == "" {
+			v.addf(at(path, "name"), "database name is empty")
+		} else if databases[db.Name] {
+			v.addf(at(path, "name"), "database [%s] is listed more than once", db.Name)
+		}
+		databases[db.Name] = true
+
+		collections := make(map[string]bool, len(db.Collections))
+		for j, coll := range db.Collections {
+			v.collection(coll, at(path, "collections", j))
+			if coll.Name != "" && collections[coll.Name] {
+				v.addf(at(path, "collections", j, "name"), "collection [%s] is listed more than once in database [%s]", coll.Name, db.Name)
+			}
+			collections[coll.Name] = true
+		}
+	}
+
+	return v.problems
+}
+
+// collection validates the mapping of a collection at path.
+func (v *validator) collection(coll CollectionMapping, path []interface{}) {
+	if coll.Name == "" {
+		v.addf(at(path, "name"), "collection name is empty")
+	}
+	v.index(coll.Index, at(path, "index"))
+	v.fields(coll.Fields, at(path, "fields"))
+
+	for i, l := range coll.Lookups {
+		lookupPath := at(path, "lookups", i)
+		if l.From == "" {
+			v.addf(at(lookupPath, "from"), "lookup collection is empty")
+		}
+		v.dottedPath(l.LocalField, at(lookupPath, "localField"))
+		v.dottedPath(l.ForeignField, at(lookupPath, "foreignField"))
+		v.dottedPath(l.As, at(lookupPath, "as"))
+		v.fields(l.Fields, at(lookupPath, "fields"))
+	}
+
+	if e := coll.Embed; e != nil {
+		if e.Parent == "" {
+			v.addf(at(path, "embed", "parent"), "parent collection is empty")
+		}
+		v.dottedPath(e.ParentField, at(path, "embed", "parentField"))
+		v.dottedPath(e.As, at(path, "embed", "as"))
+	}
+
+	if j := coll.Join; j != nil {
+		v.dottedPath(j.Field, at(path, "join", "field"))
+		if j.Relation == "" {
+			v.addf(at(path, "join", "relation"), "join relation is empty")
+		}
+		if j.Parent != "" {
+			v.dottedPath(j.ParentField, at(path, "join", "parentField"))
+		}
+	}
+
+	if r := coll.Rollover; r != nil && r.DateField != "" {
+		v.dottedPath(r.DateField, at(path, "rollover", "dateField"))
+	}
+
+	if sd := coll.SoftDelete; sd != nil {
+		v.dottedPath(sd.Field, at(path, "softDelete", "field"))
+		if sd.Flag != "" {
+			v.dottedPath(sd.Flag, at(path, "softDelete", "flag"))
+		}
+	}
+
+	for i, t := range coll.Targets {
+		targetPath := at(path, "targets", i)
+		if t.Name == "" {
+			v.addf(at(targetPath, "name"), "target name is empty")
+		}
+		v.index(t.Index, at(targetPath, "index"))
+		v.fields(t.Fields, at(targetPath, "fields"))
+	}
+}
+
+// fields validates the field selection at path.
+func (v *validator) fields(ms []fields.M, path []interface{}) {
+	for i, m := range ms {
+		v.dottedPath(m.Name, at(path, i, "name"))
+	}
+}
+
+// dottedPath validates the field path p, e.g. author.name, at path.
+func (v *validator) dottedPath(p string, path []interface{}) {
+	switch {
+	case p == "":
+		v.addf(path, "field name is empty")
+	case strings.HasPrefix(p, "$"):
+		v.addf(path, "field name [%s] must not start with $", p)
+	default:
+		for _, segment := range strings.Split(p, ".") {
+			if segment == "" || strings.TrimSpace(segment) != segment {
+				v.addf(path, "field path [%s] is malformed, it must be field names without surrounding spaces separated by single dots", p)
+				return
+			}
+		}
+	}
+}
+
+// index validates the index name or index template, which may be empty, at path.
+func (v *validator) index(index string, path []interface{}) {
+	if index == "" {
+		return
+	}
+
+	// Index names are lowercased when syncing
+	name := strings.ToLower(index)
+	if strings.Contains(index, "{{") {
+		if _, err := template.New("index").Parse(index); err != nil {
+			v.addf(path, "index template [%s] is malformed: %v", index, err)
+			return
+		}
+		// Only the literal text of templates can be checked
+		name = templateActions.ReplaceAllString(name, "x")
+	}
+
+	switch {
+	case name == "." || name == "..":
+		v.addf(path, "index name [%s] is invalid", index)
+	case strings.IndexAny(name[:1], "-_+") == 0:
+		v.addf(path, "index name [%s] must not start with -, _ or +", index)
+	case invalidIndexChars.MatchString(name):
+		v.addf(path, "index name [%s] must not contain \\, /, *, ?, \", <, >, |, spaces, commas, # or :", index)
+	case len(name) > 255:
+		v.addf(path, "index name [%s] is longer than 255 bytes", index)
+	}
+}
+
+// url validates the URL rawURL, which must have one of schemes, at path.
+func (v *validator) url(rawURL string, schemes []string, path []interface{}) {
+	if rawURL == "" {
+		v.addf(path, "URL is empty")
+		return
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// The error of url.Parse quotes the URL, which may hold credentials
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		v.addf(path, "URL is malformed: %v", err)
+		return
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			if u.Host == "" {
+				v.addf(path, "URL has no host")
+			}
+			return
+		}
+	}
+	v.addf(path, "URL scheme [%s] must be %s", u.Scheme, strings.Join(schemes, " or "))
+}
+
+// addf adds a problem with the setting at path.
+func (v *validator) addf(path []interface{}, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Line:    locate(v.root, path),
+		Path:    formatPath(path),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// at returns a copy of path extended with elems, so that paths sharing a prefix do not share their backing array.
+func at(path []interface{}, elems ...interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(path)+len(elems)), path...), elems...)
+}
+
+// locate returns the line of the setting at path, a list of mapping keys and sequence indexes, in the document root.
+// Settings in mappings are located at their key. If the setting is not in the document, the line of the closest
+// setting that contains it is returned.
+func locate(root *yaml.Node, path []interface{}) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, elem := range path {
+		key, value := child(node, elem)
+		if value == nil {
+			break
+		}
+		line, node = key.Line, value
+	}
+	return line
+}
+
+// child returns the key and value of the key elem of a mapping node, or the element at the index elem of a sequence
+// node as both key and value, or nil if there is none.
+func child(node *yaml.Node, elem interface{}) (*yaml.Node, *yaml.Node) {
+	switch e := elem.(type) {
+	case string:
+		if node.Kind != yaml.MappingNode {
+			return nil, nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == e {
+				return node.Content[i], node.Content[i+1]
+			}
+		}
+	case int:
+		if node.Kind == yaml.SequenceNode && e < len(node.Content) {
+			return node.Content[e], node.Content[e]
+		}
+	}
+	return nil, nil
+}
+
+// formatPath formats path like databases[0].collections[1].name.
+func formatPath(path []interface{}) string {
+	var b strings.Builder
+	for _, elem := range path {
+		switch e := elem.(type) {
+		case int:
+			_, _ = fmt.Fprintf(&b, "[%d]", e)
+		default:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			_, _ = fmt.Fprint(&b, e)
+		}
+	}
+	return b.String()
+}
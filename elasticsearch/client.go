@@ -0,0 +1,493 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+
+	"mongo-elastic-sync/sink"
+)
+
+// DistributionOpenSearch is the distribution reported by OpenSearch clusters.
+const DistributionOpenSearch = "opensearch"
+
+// Version describes the version of an Elasticsearch or OpenSearch cluster.
+type Version struct {
+	Number       string `json:"number"`
+	Distribution string `json:"distribution"`
+}
+
+// Major returns the major version number.
+func (v Version) Major() int {
+	major, _ := strconv.Atoi(strings.SplitN(v.Number, ".", 2)[0])
+	return major
+}
+
+// Typed returns true if the cluster requires document types, which were removed in Elasticsearch 7.
+// OpenSearch was forked from Elasticsearch 7 and is always typeless.
+func (v Version) Typed() bool {
+	return v.Distribution != DistributionOpenSearch && v.Major() < 7
+}
+
+var (
+	_ sink.QuerySink = (*Client)(nil)
+	_ sink.Reader    = (*Client)(nil)
+)
+
+const (
+	// scanBatchSize is the number of documents fetched in each scroll request by Scan
+	scanBatchSize = 1000
+	// scanKeepAlive is how long the scroll context of Scan is kept between requests
+	scanKeepAlive = "1m"
+)
+
+// Client is a client for Elasticsearch 6.x, 7.x and 8.x and OpenSearch clusters.
+// It detects the version of the cluster when it is created and uses the typeless APIs on clusters that support them.
+// On Elasticsearch 6.x, the name of the index is used as the document type.
+type Client struct {
+	client  *elastic.Client
+	version Version
+}
+
+// NewClient connects to the cluster at url and detects its version.
+func NewClient(url string) (*Client, error) {
+	client, err := elastic.NewClient(elastic.SetURL(url), elastic.SetSniff(false))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{client: client}
+	if c.version, err = c.detectVersion(context.Background()); err != nil {
+		return nil, fmt.Errorf("detecting version: %w", err)
+	}
+	return c, nil
+}
+
+func (c *Client) detectVersion(ctx context.Context) (Version, error) {
+	res, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: http.MethodGet, Path: "/"})
+	if err != nil {
+		return Version{}, err
+	}
+
+	var info struct {
+		Version Version `json:"version"`
+	}
+	if err = json.Unmarshal(res.Body, &info); err != nil {
+		return Version{}, err
+	}
+	return info.Version, nil
+}
+
+// Version returns the version of the cluster.
+func (c *Client) Version() Version {
+	return c.version
+}
+
+// IndexExists returns true if the index or alias exists.
+func (c *Client) IndexExists(ctx context.Context, index string) (bool, error) {
+	res, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       http.MethodHead,
+		Path:         "/" + url.PathEscape(index),
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.StatusCode == http.StatusOK, nil
+}
+
+// EnsureIndex creates the index with the given create index request body, which may be nil, if it does not exist.
+// Mappings in the body must be typeless.
+func (c *Client) EnsureIndex(ctx context.Context, index string, body map[string]interface{}) error {
+	exists, err := c.IndexExists(ctx, index)
+	if err != nil || exists {
+		return err
+	}
+
+	if err = c.CreateIndex(ctx, index, body); err != nil && !isIndexAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// isIndexAlreadyExists returns true if err is the error returned when creating an index that was created concurrently.
+func isIndexAlreadyExists(err error) bool {
+	e, ok := err.(*elastic.Error)
+	return ok && e.Details != nil && e.Details.Type == "resource_already_exists_exception"
+}
+
+// CreateIndex creates the index with the given create index request body, which may be nil.
+// Mappings in the body must be typeless; they are nested under the document type on Elasticsearch 6.x.
+func (c *Client) CreateIndex(ctx context.Context, index string, body map[string]interface{}) error {
+	if mappings, ok := body["mappings"]; ok && c.version.Typed() {
+		typed := make(map[string]interface{}, len(body))
+		for k, v := range body {
+			typed[k] = v
+		}
+		typed["mappings"] = map[string]interface{}{index: mappings}
+		body = typed
+	}
+
+	opts := elastic.PerformRequestOptions{Method: http.MethodPut, Path: "/" + url.PathEscape(index)}
+	if body != nil {
+		opts.Body = body
+	}
+	_, err := c.client.PerformRequest(ctx, opts)
+	return err
+}
+
+// Mapping returns the typeless mappings of the index, e.g. {"properties": {...}}. On Elasticsearch 6.x, the mappings of
+// the document type named after the concrete index are returned.
+func (c *Client) Mapping(ctx context.Context, index string) (map[string]interface{}, error) {
+	res, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodGet,
+		Path:   "/" + url.PathEscape(index) + "/_mapping",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err = json.Unmarshal(res.Body, &indexes); err != nil {
+		return nil, err
+	}
+
+	// The response is keyed by the concrete index, which differs from index if it is an alias
+	for name, idx := range indexes {
+		if !c.version.Typed() {
+			return idx.Mappings, nil
+		}
+		mappings, _ := idx.Mappings[name].(map[string]interface{})
+		return mappings, nil
+	}
+	return nil, nil
+}
+
+// DeleteIndex deletes the given indexes.
+func (c *Client) DeleteIndex(ctx context.Context, indexes ...string) error {
+	_, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodDelete,
+		Path:   "/" + joinIndexes(indexes),
+	})
+	return err
+}
+
+// IndexNames returns the names of all indexes in the cluster.
+func (c *Client) IndexNames(ctx context.Context) ([]string, error) {
+	res, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodGet,
+		Path:   "/_cat/indices",
+		Params: url.Values{"format": {"json"}, "h": {"index"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Index string `json:"index"`
+	}
+	if err = json.Unmarshal(res.Body, &rows); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(rows))
+	for i, row := range rows {
+		names[i] = row.Index
+	}
+	return names, nil
+}
+
+// Index indexes doc with the given id into the index. If routing is not empty, the document is routed with it.
+func (c *Client) Index(ctx context.Context, index, id, routing string, doc interface{}) error {
+	_, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPut,
+		Path:   c.documentPath(index, id),
+		Params: routingParams(routing),
+		Body:   doc,
+	})
+	return err
+}
+
+// Get returns the source of the document with the given id in the index.
+func (c *Client) Get(ctx context.Context, index, id string) (json.RawMessage, error) {
+	res, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodGet,
+		Path:   c.documentPath(index, id),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Source json.RawMessage `json:"_source"`
+	}
+	if err = json.Unmarshal(res.Body, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Source, nil
+}
+
+// Delete deletes the document with the given id from the index. If routing is not empty, the document is looked up
+// with it. It is not an error if the document does not exist.
+func (c *Client) Delete(ctx context.Context, index, id, routing string) error {
+	_, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       http.MethodDelete,
+		Path:         c.documentPath(index, id),
+		Params:       routingParams(routing),
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	return err
+}
+
+// Bulk performs the operations in a single bulk request. It returns an error describing the first failed operation
+// if any operation fails. Deleting a document that does not exist is not a failure.
+func (c *Client) Bulk(ctx context.Context, ops []sink.Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	var body strings.Builder
+	if err := sink.EncodeBulk(&body, ops, c.version.Typed()); err != nil {
+		return err
+	}
+
+	res, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:      http.MethodPost,
+		Path:        "/_bulk",
+		Body:        body.String(),
+		ContentType: "application/x-ndjson",
+	})
+	if err != nil {
+		return err
+	}
+
+	var bulkRes struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID    string                `json:"_id"`
+			Error *elastic.ErrorDetails `json:"error"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(res.Body, &bulkRes); err != nil {
+		return err
+	}
+	if !bulkRes.Errors {
+		return nil
+	}
+
+	failed := 0
+	var first error
+	for _, item := range bulkRes.Items {
+		for action, result := range item {
+			if result.Error == nil {
+				continue
+			}
+			failed++
+			if first == nil {
+				first = fmt.Errorf("%s [%s]: %s: %s", action, result.ID, result.Error.Type, result.Error.Reason)
+			}
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d bulk operations failed, first: %w", failed, len(ops), first)
+}
+
+// Update updates the document with the given id in the index with a script.
+func (c *Client) Update(ctx context.Context, index, id string, script *elastic.Script) error {
+	src, err := script.Source()
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("/%s/_update/%s", url.PathEscape(index), url.PathEscape(id))
+	if c.version.Typed() {
+		path = c.documentPath(index, id) + "/_update"
+	}
+
+	_, err = c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   path,
+		Body:   map[string]interface{}{"script": src},
+	})
+	return err
+}
+
+// UpdateByQuery updates the documents matching query in the index with a script. Version conflicts are ignored.
+func (c *Client) UpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script) error {
+	q, err := query.Source()
+	if err != nil {
+		return err
+	}
+	src, err := script.Source()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   "/" + url.PathEscape(index) + "/_update_by_query",
+		Params: url.Values{"conflicts": {"proceed"}},
+		Body:   map[string]interface{}{"query": q, "script": src},
+	})
+	return err
+}
+
+// DeleteByQuery deletes the documents matching query in the index. Version conflicts are ignored.
+func (c *Client) DeleteByQuery(ctx context.Context, index string, query elastic.Query) error {
+	q, err := query.Source()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   "/" + url.PathEscape(index) + "/_delete_by_query",
+		Params: url.Values{"conflicts": {"proceed"}},
+		Body:   map[string]interface{}{"query": q},
+	})
+	return err
+}
+
+// Count returns the number of documents matching query, which may be nil to match all documents, in the index.
+// Missing indexes count as empty.
+func (c *Client) Count(ctx context.Context, index string, query elastic.Query) (int64, error) {
+	body, err := queryBody(query)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   "/" + url.PathEscape(index) + "/_count",
+		Params: url.Values{"ignore_unavailable": {"true"}},
+		Body:   body,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var countRes struct {
+		Count int64 `json:"count"`
+	}
+	if err = json.Unmarshal(res.Body, &countRes); err != nil {
+		return 0, err
+	}
+	return countRes.Count, nil
+}
+
+// Scan calls fn with each document matching query, which may be nil to match all documents, in the index.
+// Documents are read with the scroll API in index order. Missing indexes are treated as empty.
+func (c *Client) Scan(ctx context.Context, index string, query elastic.Query, fn func(sink.Hit) error) error {
+	body, err := queryBody(query)
+	if err != nil {
+		return err
+	}
+	body["size"] = scanBatchSize
+	body["sort"] = []string{"_doc"}
+
+	res, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   "/" + url.PathEscape(index) + "/_search",
+		Params: url.Values{"scroll": {scanKeepAlive}, "ignore_unavailable": {"true"}},
+		Body:   body,
+	})
+
+	for err == nil {
+		var scrollRes struct {
+			ScrollID string `json:"_scroll_id"`
+			Hits     struct {
+				Hits []struct {
+					Index   string          `json:"_index"`
+					ID      string          `json:"_id"`
+					Routing string          `json:"_routing"`
+					Source  json.RawMessage `json:"_source"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		if err = json.Unmarshal(res.Body, &scrollRes); err != nil {
+			return err
+		}
+
+		if len(scrollRes.Hits.Hits) == 0 {
+			return c.clearScroll(ctx, scrollRes.ScrollID)
+		}
+
+		for _, hit := range scrollRes.Hits.Hits {
+			if err = fn(sink.Hit{Index: hit.Index, ID: hit.ID, Routing: hit.Routing, Source: hit.Source}); err != nil {
+				_ = c.clearScroll(ctx, scrollRes.ScrollID)
+				return err
+			}
+		}
+
+		res, err = c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: http.MethodPost,
+			Path:   "/_search/scroll",
+			Body:   map[string]interface{}{"scroll": scanKeepAlive, "scroll_id": scrollRes.ScrollID},
+		})
+	}
+	return err
+}
+
+// clearScroll frees the scroll context with the given id, if any.
+func (c *Client) clearScroll(ctx context.Context, scrollID string) error {
+	if scrollID == "" {
+		return nil
+	}
+
+	_, err := c.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       http.MethodDelete,
+		Path:         "/_search/scroll",
+		Body:         map[string]interface{}{"scroll_id": []string{scrollID}},
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	return err
+}
+
+// queryBody returns a search request body with query, or an empty body if query is nil.
+func queryBody(query elastic.Query) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	if query == nil {
+		return body, nil
+	}
+
+	q, err := query.Source()
+	if err != nil {
+		return nil, err
+	}
+	body["query"] = q
+	return body, nil
+}
+
+// documentPath returns the path of the document with the given id in the index.
+func (c *Client) documentPath(index, id string) string {
+	typ := "_doc"
+	if c.version.Typed() {
+		typ = index
+	}
+	return fmt.Sprintf("/%s/%s/%s", url.PathEscape(index), url.PathEscape(typ), url.PathEscape(id))
+}
+
+func routingParams(routing string) url.Values {
+	if routing == "" {
+		return nil
+	}
+	return url.Values{"routing": {routing}}
+}
+
+func joinIndexes(indexes []string) string {
+	escaped := make([]string, len(indexes))
+	for i, index := range indexes {
+		escaped[i] = url.PathEscape(index)
+	}
+	return strings.Join(escaped, ",")
+}
@@ -0,0 +1,296 @@
+package elasticsearch_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic"
+
+	"mongo-elastic-sync/elasticsearch"
+	"mongo-elastic-sync/sink"
+)
+
+// cluster is an httptest stand-in for an Elasticsearch or OpenSearch cluster of a given version.
+// It records the requests it receives, except for health checks and version detection, and, like the real clusters, rejects typed document APIs on
+// Elasticsearch 8 and typeless document APIs on Elasticsearch 6.
+type cluster struct {
+	version elasticsearch.Version
+
+	mu       sync.Mutex
+	requests []string
+	bodies   []string
+}
+
+func (c *cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	c.mu.Lock()
+	if r.URL.Path != "/" {
+		c.requests = append(c.requests, r.Method+" "+r.URL.RequestURI())
+		c.bodies = append(c.bodies, string(body))
+	}
+	c.mu.Unlock()
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.URL.Path == "/":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"version": c.version})
+	case r.URL.Path == "/_cat/indices":
+		_, _ = fmt.Fprint(w, `[{"index":"db.coll1"},{"index":"db.coll2"}]`)
+	case r.Method == http.MethodHead && segments[0] == "missing":
+		w.WriteHeader(http.StatusNotFound)
+	case len(segments) == 3 && !strings.HasPrefix(segments[1], "_") && !c.version.Typed():
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprint(w, `{"error":{"type":"illegal_argument_exception","reason":"types are not supported"},"status":400}`)
+	case len(segments) == 3 && segments[1] == "_doc" && c.version.Typed():
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprint(w, `{"error":{"type":"invalid_type_name_exception","reason":"_doc is not a valid type"},"status":400}`)
+	case len(segments) == 2 && segments[1] == "_search":
+		_, _ = fmt.Fprint(w, `{"_scroll_id":"s1","hits":{"hits":[{"_index":"db.coll1","_id":"1","_routing":"p1","_source":{"a":"1"}},{"_index":"db.coll1","_id":"2","_source":{"a":"2"}}]}}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/_search/scroll":
+		_, _ = fmt.Fprint(w, `{"_scroll_id":"s1","hits":{"hits":[]}}`)
+	case len(segments) == 2 && segments[1] == "_mapping" && c.version.Typed():
+		_, _ = fmt.Fprint(w, `{"db.coll1_v1":{"mappings":{"db.coll1_v1":{"properties":{"a":{"type":"keyword"}}}}}}`)
+	case len(segments) == 2 && segments[1] == "_mapping":
+		_, _ = fmt.Fprint(w, `{"db.coll1_v1":{"mappings":{"properties":{"a":{"type":"keyword"}}}}}`)
+	case len(segments) == 2 && segments[1] == "_count":
+		_, _ = fmt.Fprint(w, `{"count":2}`)
+	case r.Method == http.MethodGet && len(segments) == 3:
+		_, _ = fmt.Fprint(w, `{"_id":"1","found":true,"_source":{"a":"1"}}`)
+	default:
+		_, _ = fmt.Fprint(w, `{}`)
+	}
+}
+
+func TestClient(t *testing.T) {
+	versions := []struct {
+		name    string
+		version elasticsearch.Version
+		typed   bool
+		want    []string
+	}{
+		{
+			name:    "elasticsearch 6",
+			version: elasticsearch.Version{Number: "6.8.8"},
+			typed:   true,
+			want: []string{
+				"PUT /db.coll1/db.coll1/1?routing=p1",
+				"GET /db.coll1/db.coll1/1",
+				"DELETE /db.coll1/db.coll1/1",
+				"POST /db.coll1/db.coll1/1/_update",
+			},
+		},
+		{
+			name:    "elasticsearch 7",
+			version: elasticsearch.Version{Number: "7.10.2"},
+			want: []string{
+				"PUT /db.coll1/_doc/1?routing=p1",
+				"GET /db.coll1/_doc/1",
+				"DELETE /db.coll1/_doc/1",
+				"POST /db.coll1/_update/1",
+			},
+		},
+		{
+			name:    "elasticsearch 8",
+			version: elasticsearch.Version{Number: "8.5.0"},
+			want: []string{
+				"PUT /db.coll1/_doc/1?routing=p1",
+				"GET /db.coll1/_doc/1",
+				"DELETE /db.coll1/_doc/1",
+				"POST /db.coll1/_update/1",
+			},
+		},
+		{
+			name:    "opensearch 2",
+			version: elasticsearch.Version{Number: "2.11.0", Distribution: elasticsearch.DistributionOpenSearch},
+			want: []string{
+				"PUT /db.coll1/_doc/1?routing=p1",
+				"GET /db.coll1/_doc/1",
+				"DELETE /db.coll1/_doc/1",
+				"POST /db.coll1/_update/1",
+			},
+		},
+	}
+
+	for _, tt := range versions {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &cluster{version: tt.version}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			ctx := context.Background()
+			client, err := elasticsearch.NewClient(server.URL)
+			fatalIfErr(t, err)
+
+			if got := client.Version(); got != tt.version {
+				t.Errorf("Version() got = %+v, want %+v", got, tt.version)
+			}
+			if got := client.Version().Typed(); got != tt.typed {
+				t.Errorf("Typed() got = %v, want %v", got, tt.typed)
+			}
+
+			fatalIfErr(t, client.Index(ctx, "db.coll1", "1", "p1", map[string]interface{}{"a": "1"}))
+
+			src, err := client.Get(ctx, "db.coll1", "1")
+			fatalIfErr(t, err)
+			if string(src) != `{"a":"1"}` {
+				t.Errorf("Get() got = %s, want %s", src, `{"a":"1"}`)
+			}
+
+			fatalIfErr(t, client.Delete(ctx, "db.coll1", "1", ""))
+			fatalIfErr(t, client.Update(ctx, "db.coll1", "1", elastic.NewScript("ctx._source.a = 2")))
+
+			if !reflect.DeepEqual(stub.requests, tt.want) {
+				t.Errorf("requests got = %v, want %v", stub.requests, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCreateIndex(t *testing.T) {
+	body := map[string]interface{}{
+		"mappings": map[string]interface{}{"properties": map[string]interface{}{"a": map[string]interface{}{"type": "keyword"}}},
+	}
+
+	tests := []struct {
+		name    string
+		version elasticsearch.Version
+		want    string
+	}{
+		{
+			name:    "typed mappings on elasticsearch 6",
+			version: elasticsearch.Version{Number: "6.8.8"},
+			want:    `{"mappings":{"db.coll1":{"properties":{"a":{"type":"keyword"}}}}}`,
+		},
+		{
+			name:    "typeless mappings on elasticsearch 7",
+			version: elasticsearch.Version{Number: "7.10.2"},
+			want:    `{"mappings":{"properties":{"a":{"type":"keyword"}}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &cluster{version: tt.version}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			ctx := context.Background()
+			client, err := elasticsearch.NewClient(server.URL)
+			fatalIfErr(t, err)
+
+			fatalIfErr(t, client.CreateIndex(ctx, "db.coll1", body))
+
+			if got := stub.bodies[0]; got != tt.want {
+				t.Errorf("CreateIndex() body got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIndexes(t *testing.T) {
+	server := httptest.NewServer(&cluster{version: elasticsearch.Version{Number: "7.10.2"}})
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := elasticsearch.NewClient(server.URL)
+	fatalIfErr(t, err)
+
+	exists, err := client.IndexExists(ctx, "db.coll1")
+	fatalIfErr(t, err)
+	if !exists {
+		t.Error("IndexExists() got = false, want true")
+	}
+
+	exists, err = client.IndexExists(ctx, "missing")
+	fatalIfErr(t, err)
+	if exists {
+		t.Error("IndexExists() got = true, want false")
+	}
+
+	names, err := client.IndexNames(ctx)
+	fatalIfErr(t, err)
+	if want := []string{"db.coll1", "db.coll2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("IndexNames() got = %v, want %v", names, want)
+	}
+}
+
+func TestClientMapping(t *testing.T) {
+	want := map[string]interface{}{"properties": map[string]interface{}{"a": map[string]interface{}{"type": "keyword"}}}
+
+	for _, version := range []elasticsearch.Version{{Number: "6.8.8"}, {Number: "7.10.2"}} {
+		t.Run(version.Number, func(t *testing.T) {
+			server := httptest.NewServer(&cluster{version: version})
+			defer server.Close()
+
+			client, err := elasticsearch.NewClient(server.URL)
+			fatalIfErr(t, err)
+
+			// db.coll1 is an alias of db.coll1_v1
+			got, err := client.Mapping(context.Background(), "db.coll1")
+			fatalIfErr(t, err)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Mapping() got = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func fatalIfErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	stub := &cluster{version: elasticsearch.Version{Number: "7.10.2"}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := elasticsearch.NewClient(server.URL)
+	fatalIfErr(t, err)
+
+	count, err := client.Count(ctx, "db.coll1", elastic.NewTermQuery("rel", "q"))
+	fatalIfErr(t, err)
+	if count != 2 {
+		t.Errorf("Count() got = %d, want 2", count)
+	}
+
+	var hits []sink.Hit
+	fatalIfErr(t, client.Scan(ctx, "db.coll1", nil, func(hit sink.Hit) error {
+		hits = append(hits, hit)
+		return nil
+	}))
+
+	want := []sink.Hit{
+		{Index: "db.coll1", ID: "1", Routing: "p1", Source: json.RawMessage(`{"a":"1"}`)},
+		{Index: "db.coll1", ID: "2", Source: json.RawMessage(`{"a":"2"}`)},
+	}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("Scan() got = %+v, want %+v", hits, want)
+	}
+
+	wantRequests := []string{
+		"POST /db.coll1/_count?ignore_unavailable=true",
+		"POST /db.coll1/_search?ignore_unavailable=true&scroll=1m",
+		"POST /_search/scroll",
+		"DELETE /_search/scroll",
+	}
+	if !reflect.DeepEqual(stub.requests, wantRequests) {
+		t.Errorf("requests got = %v, want %v", stub.requests, wantRequests)
+	}
+	if want := `{"query":{"term":{"rel":"q"}}}`; stub.bodies[0] != want {
+		t.Errorf("Count() body got = %s, want %s", stub.bodies[0], want)
+	}
+}
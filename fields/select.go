@@ -11,12 +11,17 @@ type M struct {
 }
 
 // Select returns a new doc transformed with the given fields mappings.
-// If mappings is empty, all the fields in doc are returned. Else, only the fields in mappings are returned.
+// If mappings is empty, all the fields in doc are returned in a shallow copy. Else, only the fields in mappings are
+// returned.
 // Nested fields may be accessed using dot syntax (e.g. foo.bar.hello).
 // If the nested field cannot be accessed (e.g. mapping foo.bar.hello, where bar is a boolean), an error is returned.
 func Select(doc map[string]interface{}, mappings []M) (map[string]interface{}, error) {
 	if len(mappings) == 0 {
-		return doc, nil
+		newDoc := make(map[string]interface{}, len(doc))
+		for k, v := range doc {
+			newDoc[k] = v
+		}
+		return newDoc, nil
 	}
 
 	// include only given fields
@@ -67,3 +72,18 @@ func Select(doc map[string]interface{}, mappings []M) (map[string]interface{}, e
 
 	return newDoc, nil
 }
+
+// Get returns the value at the given dot-separated path in doc, and whether the value exists.
+func Get(doc map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, field := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[field]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -99,3 +99,47 @@ func TestSelect(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectCopies(t *testing.T) {
+	doc := map[string]interface{}{"field1": "hello"}
+	got, err := fields.Select(doc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the selected document, e.g. to rename _id before indexing it, leaves doc alone
+	got["field2"] = "world"
+	if want := map[string]interface{}{"field1": "hello"}; !reflect.DeepEqual(doc, want) {
+		t.Errorf("Select() doc = %v after changing the result, want %v", doc, want)
+	}
+}
+
+func TestGet(t *testing.T) {
+	doc := map[string]interface{}{"field1": "hello", "field2": map[string]interface{}{"nested1": "foo"}}
+
+	tests := []struct {
+		name   string
+		path   string
+		want   interface{}
+		wantOK bool
+	}{
+		{name: "get field", path: "field1", want: "hello", wantOK: true},
+		{name: "get nested field", path: "field2.nested1", want: "foo", wantOK: true},
+		{name: "get map field", path: "field2", want: map[string]interface{}{"nested1": "foo"}, wantOK: true},
+		{name: "get missing field", path: "field3", want: nil, wantOK: false},
+		{name: "get missing nested field", path: "field2.nested2", want: nil, wantOK: false},
+		{name: "get field in non-map", path: "field1.nested1", want: nil, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := fields.Get(doc, tt.path)
+			if ok != tt.wantOK {
+				t.Errorf("Get() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Get() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package lease
+
+import (
+	"context"
+	"hash/fnv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Group shares work among the workers that run in it. Every worker keeps a membership lease, and each key of work is
+// owned by the one worker holding the key's lease.
+// Keys are assigned to the live workers by rendezvous hashing, so that when a worker joins or leaves the group, only
+// the keys assigned to or from it move. A worker gives up the keys that are no longer assigned to it, and takes over
+// the keys assigned to it once their previous owner has released them or its lease has expired.
+type Group struct {
+	Store Store
+	// Name prefixes the names of the group's leases.
+	Name string
+	// Worker identifies this worker.
+	Worker string
+	// TTL is how long leases last after they are renewed. They are renewed every TTL/3.
+	TTL time.Duration
+}
+
+// task is a key of work run by this worker.
+type task struct {
+	cancel  context.CancelFunc
+	done    chan error
+	renewed time.Time
+	// stopped is set once fn has returned
+	stopped bool
+}
+
+// finished returns true if fn has returned, logging its error.
+func (t *task) finished(log *zap.SugaredLogger) bool {
+	select {
+	case err := <-t.done:
+		t.stopped = true
+		if err != nil {
+			log.Errorf("Key failed: %+v", err)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// Run runs fn for each of keys while this worker owns it, until ctx is done. The context of fn is canceled when the
+// key is assigned to another worker or its lease cannot be renewed. If fn returns an error, the key is released and
+// the worker may take it again later.
+func (g Group) Run(ctx context.Context, keys []string, fn func(ctx context.Context, key string) error) error {
+	log := log.With("group", g.Name, "worker", g.Worker)
+	interval := g.TTL / 3
+
+	tasks := make(map[string]*task)
+	defer func() {
+		for key, t := range tasks {
+			g.stop(key, t)
+		}
+		releaseCtx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		if err := g.Store.Release(releaseCtx, g.memberLease(), g.Worker); err != nil {
+			log.Errorf("Leaving group: %+v", err)
+		}
+	}()
+
+	log.Info("Joining group")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		g.balance(ctx, keys, tasks, fn)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// balance renews the leases of this worker, and starts and stops tasks so that it runs the keys assigned to it.
+func (g Group) balance(ctx context.Context, keys []string, tasks map[string]*task, fn func(ctx context.Context, key string) error) {
+	log := log.With("group", g.Name, "worker", g.Worker)
+
+	if _, err := g.Store.Acquire(ctx, g.memberLease(), g.Worker, g.TTL); err != nil {
+		log.Errorf("Renewing membership: %+v", err)
+	}
+
+	holders, err := g.Store.Holders(ctx, g.Name+"/workers/")
+	if err != nil {
+		log.Errorf("Listing workers: %+v", err)
+	}
+	workers := make([]string, 0, len(holders))
+	for _, w := range holders {
+		workers = append(workers, w)
+	}
+
+	for _, key := range keys {
+		t, running := tasks[key]
+
+		// Keep the current assignment while the workers are unknown
+		assigned := running
+		if err == nil {
+			assigned = assign(key, workers) == g.Worker
+		}
+
+		switch {
+		case running && t.finished(log.With("key", key)):
+			g.stop(key, t)
+			delete(tasks, key)
+		case running && !assigned:
+			log.With("key", key).Info("Handing over key")
+			g.stop(key, t)
+			delete(tasks, key)
+		case running:
+			acquired, err := g.Store.Acquire(ctx, g.keyLease(key), g.Worker, g.TTL)
+			if err != nil {
+				log.With("key", key).Errorf("Renewing key: %+v", err)
+			}
+			if acquired {
+				t.renewed = time.Now()
+			} else if err == nil || time.Since(t.renewed)+g.TTL/3 >= g.TTL {
+				// Stop before the lease expires and another worker may take over
+				log.With("key", key).Info("Lost key")
+				g.stop(key, t)
+				delete(tasks, key)
+			}
+		case assigned:
+			acquired, err := g.Store.Acquire(ctx, g.keyLease(key), g.Worker, g.TTL)
+			if err != nil {
+				log.With("key", key).Errorf("Acquiring key: %+v", err)
+			}
+			if !acquired {
+				continue
+			}
+
+			log.With("key", key).Info("Took over key")
+			taskCtx, cancel := context.WithCancel(ctx)
+			t := &task{cancel: cancel, done: make(chan error, 1), renewed: time.Now()}
+			go func(key string) { t.done <- fn(taskCtx, key) }(key)
+			tasks[key] = t
+		}
+	}
+}
+
+// stop cancels the task of key, waits for it to return and releases the key.
+func (g Group) stop(key string, t *task) {
+	t.cancel()
+	if !t.stopped {
+		<-t.done
+		t.stopped = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.TTL/3)
+	defer cancel()
+	if err := g.Store.Release(ctx, g.keyLease(key), g.Worker); err != nil {
+		log.With("group", g.Name, "worker", g.Worker, "key", key).Errorf("Releasing key: %+v", err)
+	}
+}
+
+func (g Group) memberLease() string {
+	return g.Name + "/workers/" + g.Worker
+}
+
+func (g Group) keyLease(key string) string {
+	return g.Name + "/keys/" + key
+}
+
+// assign returns the worker that key is assigned to: the worker with the highest hash of itself and key.
+func assign(key string, workers []string) string {
+	var assigned string
+	var max uint64
+	for _, w := range workers {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(w + "/" + key))
+		if sum := h.Sum64(); assigned == "" || sum > max || (sum == max && w < assigned) {
+			assigned, max = w, sum
+		}
+	}
+	return assigned
+}
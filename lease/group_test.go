@@ -0,0 +1,123 @@
+package lease_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"mongo-elastic-sync/lease"
+)
+
+// owners records the keys each worker is running.
+type owners struct {
+	mu    sync.Mutex
+	byKey map[string][]string
+}
+
+func (o *owners) run(worker string) func(ctx context.Context, key string) error {
+	return func(ctx context.Context, key string) error {
+		o.mu.Lock()
+		o.byKey[key] = append(o.byKey[key], worker)
+		o.mu.Unlock()
+
+		<-ctx.Done()
+
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		for i, w := range o.byKey[key] {
+			if w == worker {
+				o.byKey[key] = append(o.byKey[key][:i], o.byKey[key][i+1:]...)
+				break
+			}
+		}
+		return nil
+	}
+}
+
+// snapshot returns the workers running each key and the number of keys each worker runs.
+func (o *owners) snapshot() (map[string][]string, map[string]int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	byKey := make(map[string][]string)
+	counts := make(map[string]int)
+	for key, workers := range o.byKey {
+		byKey[key] = append([]string{}, workers...)
+		for _, w := range workers {
+			counts[w]++
+		}
+	}
+	return byKey, counts
+}
+
+// waitFor polls until every key is run by exactly one worker and the set of workers running keys is want.
+func (o *owners) waitFor(t *testing.T, keys []string, want []string) map[string]int {
+	t.Helper()
+	deadline := time.Now().Add(50 * ttl)
+	for {
+		byKey, counts := o.snapshot()
+
+		ok := true
+		for _, key := range keys {
+			if len(byKey[key]) != 1 {
+				ok = false
+			}
+		}
+		var workers []string
+		for w := range counts {
+			workers = append(workers, w)
+		}
+		sort.Strings(workers)
+		if ok && fmt.Sprint(workers) == fmt.Sprint(want) {
+			return counts
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("keys not balanced onto %v: %v", want, byKey)
+		}
+		time.Sleep(ttl / 3)
+	}
+}
+
+func TestGroupRebalances(t *testing.T) {
+	store := lease.NewMemoryStore()
+	o := &owners{byKey: make(map[string][]string)}
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("db1.coll%d", i))
+	}
+
+	start := func(worker string) (context.CancelFunc, chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		group := lease.Group{Store: store, Name: "workers", Worker: worker, TTL: ttl}
+		go func() { done <- group.Run(ctx, keys, o.run(worker)) }()
+		return cancel, done
+	}
+
+	cancelA, doneA := start("a")
+	if counts := o.waitFor(t, keys, []string{"a"}); counts["a"] != len(keys) {
+		t.Errorf("a runs %d keys, want %d", counts["a"], len(keys))
+	}
+
+	// b joins and takes over its share of the keys
+	cancelB, doneB := start("b")
+	counts := o.waitFor(t, keys, []string{"a", "b"})
+	if counts["a"]+counts["b"] != len(keys) {
+		t.Errorf("a and b run %v, want %d keys in total", counts, len(keys))
+	}
+
+	// a leaves and b takes over all keys
+	cancelA()
+	<-doneA
+	if counts := o.waitFor(t, keys, []string{"b"}); counts["b"] != len(keys) {
+		t.Errorf("b runs %d keys, want %d", counts["b"], len(keys))
+	}
+
+	cancelB()
+	<-doneB
+}
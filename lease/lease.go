@@ -0,0 +1,98 @@
+package lease
+
+import (
+	"context"
+	"time"
+
+	"mongo-elastic-sync/logger"
+)
+
+var log = logger.Log
+
+// Store keeps leases, each of which is held by at most one holder until it expires.
+type Store interface {
+	// Acquire takes the lease called name for holder until ttl from now, if the lease is free, has expired or is
+	// already held by holder. It returns false if another holder has the lease.
+	Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	// Release gives up the lease called name if holder has it.
+	Release(ctx context.Context, name, holder string) error
+	// Holders returns the holders of the unexpired leases whose names start with prefix, by lease name.
+	Holders(ctx context.Context, prefix string) (map[string]string, error)
+}
+
+// RunAsLeader waits until holder acquires the lease called name and then runs fn, renewing the lease every ttl/3.
+// If the lease cannot be renewed before it expires, the context of fn is canceled and, once fn returns, RunAsLeader
+// waits for the lease again. If fn returns an error, the lease is released and the error is returned.
+// RunAsLeader returns when ctx is done.
+func RunAsLeader(ctx context.Context, store Store, name, holder string, ttl time.Duration, fn func(ctx context.Context) error) error {
+	log := log.With("lease", name, "holder", holder)
+	interval := ttl / 3
+
+	log.Info("Waiting for leadership")
+	for {
+		acquired, err := store.Acquire(ctx, name, holder, ttl)
+		if err != nil {
+			log.Errorf("Acquiring lease: %+v", err)
+		}
+		if acquired {
+			log.Info("Acquired leadership")
+			if err = lead(ctx, store, name, holder, ttl, fn); err != nil {
+				return err
+			}
+			log.Info("Lost leadership, waiting on standby")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// lead runs fn while holder renews the lease. It returns nil if the lease is lost.
+func lead(ctx context.Context, store Store, name, holder string, ttl time.Duration, fn func(ctx context.Context) error) error {
+	log := log.With("lease", name, "holder", holder)
+	interval := ttl / 3
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- fn(leaderCtx) }()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case err := <-done:
+			// Release with a fresh context, as ctx may be done
+			releaseCtx, cancelRelease := context.WithTimeout(context.Background(), interval)
+			if releaseErr := store.Release(releaseCtx, name, holder); releaseErr != nil {
+				log.Errorf("Releasing lease: %+v", releaseErr)
+			}
+			cancelRelease()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		case <-ticker.C:
+			acquired, err := store.Acquire(ctx, name, holder, ttl)
+			if err != nil {
+				log.Errorf("Renewing lease: %+v", err)
+			}
+			if acquired {
+				renewed = time.Now()
+				continue
+			}
+			// Stop before the lease expires and another holder may take over
+			if err == nil || time.Since(renewed)+interval >= ttl {
+				cancel()
+				<-done
+				return nil
+			}
+		}
+	}
+}
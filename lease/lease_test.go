@@ -0,0 +1,81 @@
+package lease_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"mongo-elastic-sync/lease"
+)
+
+const ttl = 30 * time.Millisecond
+
+func TestRunAsLeaderFailover(t *testing.T) {
+	store := lease.NewMemoryStore()
+	leading := make(chan string)
+
+	run := func(ctx context.Context, holder string) chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- lease.RunAsLeader(ctx, store, "leader", holder, ttl, func(ctx context.Context) error {
+				leading <- holder
+				<-ctx.Done()
+				return ctx.Err()
+			})
+		}()
+		return done
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := run(ctxA, "a")
+	if got := <-leading; got != "a" {
+		t.Fatalf("leader = %s, want a", got)
+	}
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	doneB := run(ctxB, "b")
+
+	// b stays on standby while a renews the lease
+	select {
+	case got := <-leading:
+		t.Fatalf("leader = %s while a holds the lease", got)
+	case <-time.After(3 * ttl):
+	}
+
+	cancelA()
+	if err := <-doneA; !errors.Is(err, context.Canceled) {
+		t.Errorf("RunAsLeader() error = %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case got := <-leading:
+		if got != "b" {
+			t.Fatalf("leader = %s, want b", got)
+		}
+	case <-time.After(10 * ttl):
+		t.Fatal("b did not take over")
+	}
+	if got := store.Holder("leader"); got != "b" {
+		t.Errorf("Holder() = %s, want b", got)
+	}
+
+	cancelB()
+	<-doneB
+}
+
+func TestRunAsLeaderError(t *testing.T) {
+	store := lease.NewMemoryStore()
+	errSync := errors.New("sync failed")
+
+	err := lease.RunAsLeader(context.Background(), store, "leader", "a", ttl, func(ctx context.Context) error {
+		return errSync
+	})
+	if !errors.Is(err, errSync) {
+		t.Errorf("RunAsLeader() error = %v, want %v", err, errSync)
+	}
+	if got := store.Holder("leader"); got != "" {
+		t.Errorf("Holder() = %s, want the lease released", got)
+	}
+}
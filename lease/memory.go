@@ -0,0 +1,73 @@
+package lease
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory Store for tests.
+type MemoryStore struct {
+	mu     sync.Mutex
+	leases map[string]memoryLease
+}
+
+type memoryLease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{leases: make(map[string]memoryLease)}
+}
+
+func (m *MemoryStore) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if l, ok := m.leases[name]; ok && l.holder != holder && l.expiresAt.After(now) {
+		return false, nil
+	}
+	m.leases[name] = memoryLease{holder: holder, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryStore) Release(ctx context.Context, name, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.leases[name]; ok && l.holder == holder {
+		delete(m.leases, name)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Holders(ctx context.Context, prefix string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	holders := make(map[string]string)
+	now := time.Now()
+	for name, l := range m.leases {
+		if strings.HasPrefix(name, prefix) && l.expiresAt.After(now) {
+			holders[name] = l.holder
+		}
+	}
+	return holders, nil
+}
+
+// Holder returns the holder of the lease called name, or an empty string if it is free or has expired.
+func (m *MemoryStore) Holder(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.leases[name]; ok && l.expiresAt.After(time.Now()) {
+		return l.holder
+	}
+	return ""
+}
@@ -2,60 +2,343 @@ package main
 
 import (
 	"context"
+	"errors"
+	_ "expvar"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"time"
 
-	"github.com/olivere/elastic"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/elasticsearch"
+	"mongo-elastic-sync/lease"
 	"mongo-elastic-sync/logger"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
 	"mongo-elastic-sync/syncer"
 )
 
 var log = logger.Log
 
+const (
+	// defaultStateDatabase is the database the syncer keeps its state in, if none is configured
+	defaultStateDatabase = "mongo-elastic-sync"
+	// defaultLeaseTTL is how long leases last after they are renewed, if no TTL is configured
+	defaultLeaseTTL = 30 * time.Second
+)
+
+// commands are the subcommands of the binary, by name. Without a subcommand, the binary runs like the run subcommand.
+var commands = map[string]func(args []string) error{
+	"run":      run,
+	"dump":     dump,
+	"tail":     tail,
+	"validate": validate,
+	"status":   status,
+	"verify":   verify,
+	"backfill": backfill,
+}
+
 func main() {
-	if err := run(); err != nil {
+	var err error
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		err = commands[os.Args[1]](os.Args[2:])
+	} else {
+		configPtr := flag.String("config", "config.yml", "Configuration file")
+		flag.Parse()
+		err = runConfig(*configPtr)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run() error {
-	configPtr := flag.String("config", "config.yml", "Configuration file")
-	flag.Parse()
+// run dumps and then tails the configured collections.
+func run(args []string) error {
+	flags, configPtr := newFlagSet("run")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return runConfig(*configPtr)
+}
 
-	conf := config.Config{}
-	if err := config.FromYamlFile(*configPtr, &conf); err != nil {
-		return fmt.Errorf("parsing config file: %w", err)
+// runConfig dumps and then tails the collections configured in the configuration file at configPath, with leader
+// election or in a group of workers if they are configured. Unless workers are configured, the sync mapping is
+// reloaded when the configuration file changes or the process receives SIGHUP.
+func runConfig(configPath string) error {
+	a, err := open(configPath)
+	if err != nil {
+		return err
+	}
+	if err = a.openSink(true); err != nil {
+		return err
+	}
+	defer a.close()
+
+	if a.conf.MetricsAddress != "" {
+		go serveMetrics(a.conf.MetricsAddress)
+	}
+
+	state := a.state
+	opts := a.opts
+	if state.Resume || state.LeaderElection != nil || state.Workers != nil {
+		opts = append(opts, syncer.WithCheckpoints(a.checkpoints()))
+	}
+
+	ctx := context.Background()
+	s := syncer.New(mongo2.NewSource(a.mongo), a.sink, opts...)
+
+	// The collections of workers are fixed when they join the group
+	watcher := newConfigWatcher(configPath, a.conf)
+	if state.Workers == nil {
+		go watcher.watch(ctx)
+	}
+
+	if state.LeaderElection == nil && state.Workers == nil {
+		return s.SyncReloading(ctx, a.conf.SyncMapping, watcher.reloads)
+	}
+
+	leases, err := mongo2.NewLeaseStore(ctx, a.stateDB().Collection("leases"))
+	if err != nil {
+		return fmt.Errorf("creating lease store: %w", err)
+	}
+
+	if workers := state.Workers; workers != nil {
+		group := lease.Group{Store: leases, Name: workers.Group, Worker: workers.Instance, TTL: workers.TTL}
+		if group.Name == "" {
+			group.Name = "workers"
+		}
+		if group.TTL <= 0 {
+			group.TTL = defaultLeaseTTL
+		}
+		if group.Worker == "" {
+			group.Worker = instanceName()
+		}
+		return s.SyncGroup(ctx, a.conf.SyncMapping, group)
+	}
+
+	election := *state.LeaderElection
+	if election.Lease == "" {
+		election.Lease = "leader"
+	}
+	if election.TTL <= 0 {
+		election.TTL = defaultLeaseTTL
+	}
+	if election.Instance == "" {
+		election.Instance = instanceName()
+	}
+
+	return lease.RunAsLeader(ctx, leases, election.Lease, election.Instance, election.TTL, func(ctx context.Context) error {
+		// A new leader syncs the last sync mapping loaded
+		return s.SyncReloading(ctx, watcher.Mapping(), watcher.reloads)
+	})
+}
+
+// app holds the configuration and connections that the subcommands share.
+type app struct {
+	conf config.Config
+	// state is the state configuration with defaults applied
+	state config.StateConfig
+	mongo *mongo.Client
+	// sink is the configured sink, once it is opened by openSink
+	sink sink.Sink
+	// connections are the clients of the named connections that collection targets write to
+	connections map[string]*elasticsearch.Client
+	// opts are the syncer options that add the named connections and, if configured, transaction mode
+	opts      []syncer.Option
+	closeSink func()
+}
+
+// open loads the configuration file at configPath and connects to Mongo and the named connections. The sink is opened
+// separately by the subcommands that need it, as opening an ndjson sink truncates its file.
+func open(configPath string) (*app, error) {
+	conf, state, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
 	}
 
 	mongoClient, err := connectMongo(conf.MongoURL)
 	if err != nil {
-		return fmt.Errorf("connecting to mongo: %w", err)
+		return nil, fmt.Errorf("connecting to mongo: %w", err)
 	}
 
-	log.Info("Connected to MongoDB successfully")
+	sharded, err := checkDeployment(mongoClient)
+	if err != nil {
+		return nil, err
+	}
 
-	elasticClient, err := connectElastic(conf.ElasticURL)
+	log.With("sharded", sharded).Info("Connected to MongoDB successfully")
+
+	connections, err := connectTargets(conf)
 	if err != nil {
-		return fmt.Errorf("connecting to elastic: %w", err)
+		return nil, err
 	}
 
-	log.Info("Connected to Elasticsearch successfully")
+	opts := make([]syncer.Option, 0, len(connections)+1)
+	for name, conn := range connections {
+		opts = append(opts, syncer.WithConnection(name, conn))
+	}
+	if conf.Transactions {
+		opts = append(opts, syncer.WithTransactions())
+	}
 
-	ctx := context.Background()
-	syncMapping := config.SyncMapping{Databases: conf.Databases}
-	return syncer.New(mongoClient, elasticClient).Sync(ctx, syncMapping)
+	return &app{conf: conf, state: state, mongo: mongoClient, connections: connections, opts: opts}, nil
+}
+
+// openSink opens the configured sink. Unless write is set, the sink is only used to validate the configuration or read
+// indexes, and an ndjson sink discards its output instead of creating its file.
+func (a *app) openSink(write bool) error {
+	snk, closeSink, err := openSink(a.conf, write)
+	if err != nil {
+		return err
+	}
+	a.sink, a.closeSink = snk, closeSink
+	return nil
+}
+
+// close closes the sink, if it was opened.
+func (a *app) close() {
+	if a.closeSink != nil {
+		a.closeSink()
+	}
+}
+
+// dryRun returns a sink and syncer options that report the writes to the sink and the named connections to w instead
+// of performing them. Existing indexes are read from the Elasticsearch clusters. The sink is not written to.
+func (a *app) dryRun(w io.Writer) (sink.Sink, []syncer.Option, error) {
+	if err := a.openSink(false); err != nil {
+		return nil, nil, err
+	}
+
+	var snk sink.Sink = sink.NewDryRun(w, a.conf.Sink.Typed, nil)
+	if client, ok := a.sink.(*elasticsearch.Client); ok {
+		snk = sink.NewDryRun(w, client.Version().Typed(), client)
+	}
+
+	// Connections added later replace the real ones
+	opts := append([]syncer.Option{}, a.opts...)
+	for name, conn := range a.connections {
+		opts = append(opts, syncer.WithConnection(name, sink.NewDryRun(w, conn.Version().Typed(), conn)))
+	}
+	return snk, opts, nil
+}
+
+// loadConfig loads the configuration file at configPath. It returns the configuration, which excludes the state
+// database from syncing, and the state configuration with defaults applied.
+func loadConfig(configPath string) (config.Config, config.StateConfig, error) {
+	conf := config.Config{}
+	if err := config.FromYamlFile(configPath, &conf); err != nil {
+		return conf, config.StateConfig{}, fmt.Errorf("parsing config file: %w", err)
+	}
+
+	state := conf.State
+	if state.Database == "" {
+		state.Database = defaultStateDatabase
+	}
+	if state.LeaderElection != nil && state.Workers != nil {
+		return conf, state, errors.New("leader election and workers cannot both be configured")
+	}
+	// The state database is never synced
+	conf.Exclude = append(conf.Exclude, state.Database)
+	return conf, state, nil
+}
+
+// stateDB returns the database the syncer keeps its state in.
+func (a *app) stateDB() *mongo.Database {
+	return a.mongo.Database(a.state.Database)
+}
+
+// checkpoints returns the checkpoint store in the state database.
+func (a *app) checkpoints() mongo2.Checkpoints {
+	return mongo2.NewCheckpoints(a.stateDB().Collection("checkpoints"))
+}
+
+// newFlagSet returns the flag set of a subcommand, with the config flag that all subcommands have.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	return flags, flags.String("config", "config.yml", "Configuration file")
+}
+
+// serveMetrics serves the metrics published with expvar at /debug/vars on addr.
+func serveMetrics(addr string) {
+	log.With("address", addr).Info("Serving metrics")
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Errorf("Serving metrics: %+v", err)
+	}
+}
+
+// instanceName returns a name identifying this instance of the syncer.
+func instanceName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// connectTargets connects to the named Elasticsearch connections that collection targets write to.
+func connectTargets(conf config.Config) (map[string]*elasticsearch.Client, error) {
+	connections := make(map[string]*elasticsearch.Client, len(conf.Connections))
+	for name, conn := range conf.Connections {
+		elasticClient, err := connectElastic(conn.URL)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to elastic [%s]: %w", name, err)
+		}
+
+		log.With("connection", name, "version", elasticClient.Version().Number, "distribution", elasticClient.Version().Distribution).
+			Info("Connected to Elasticsearch successfully")
+		connections[name] = elasticClient
+	}
+	return connections, nil
+}
+
+// openSink returns the configured sink and a function that closes it. Unless write is set, an ndjson sink discards its
+// output instead of creating its file.
+func openSink(conf config.Config, write bool) (sink.Sink, func(), error) {
+	switch conf.Sink.Type {
+	case "", config.SinkTypeElasticsearch:
+		elasticClient, err := connectElastic(conf.ElasticURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("connecting to elastic: %w", err)
+		}
+
+		log.With("version", elasticClient.Version().Number, "distribution", elasticClient.Version().Distribution).
+			Info("Connected to Elasticsearch successfully")
+		return elasticClient, func() {}, nil
+	case config.SinkTypeNDJSON:
+		if !write {
+			return sink.NewNDJSON(ioutil.Discard, conf.Sink.Typed), func() {}, nil
+		}
+		f, err := os.Create(conf.Sink.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating ndjson sink: %w", err)
+		}
+		return sink.NewNDJSON(f, conf.Sink.Typed), func() { _ = f.Close() }, nil
+	case config.SinkTypeStdout:
+		return sink.NewStdout(conf.Sink.Typed), func() {}, nil
+	}
+	return nil, nil, fmt.Errorf("unknown sink type [%s]", conf.Sink.Type)
+}
+
+func connectElastic(url string) (*elasticsearch.Client, error) {
+	return elasticsearch.NewClient(url)
 }
 
-func connectElastic(url string) (*elastic.Client, error) {
-	return elastic.NewClient(elastic.SetURL(url), elastic.SetSniff(false))
+// checkDeployment returns whether the Mongo client is connected to a sharded cluster, or an error if the deployment
+// cannot be synced.
+func checkDeployment(mongoClient *mongo.Client) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return mongo2.CheckDeployment(ctx, mongoClient)
 }
 
 func connectMongo(url string) (*mongo.Client, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	return mongo.Connect(ctx, options.Client().ApplyURI(url))
 }
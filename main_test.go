@@ -10,12 +10,16 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/olivere/elastic"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/elasticsearch"
+	mongo2 "mongo-elastic-sync/mongo"
 	"mongo-elastic-sync/syncer"
 )
 
@@ -109,29 +113,29 @@ elasticURL: %s
 			r, w, err := os.Pipe()
 			fatalIfErr(t, err)
 
-			oldStdout := os.Stdout
-			os.Stdout = w
+			// The syncer prints its progress to stderr, as sinks may write to stdout
+			oldStderr := os.Stderr
+			os.Stderr = w
 
 			go main()
 
 			s := bufio.NewScanner(r)
 			for s.Scan() {
 				text := s.Text()
-				// Write to original stdout
-				_, _ = fmt.Fprintln(oldStdout, text)
+				// Write to original stderr
+				_, _ = fmt.Fprintln(oldStderr, text)
 				if strings.Contains(text, syncer.MsgDumpingCompleted) {
 					break
 				}
 			}
 
-			os.Stdout = oldStdout
+			os.Stderr = oldStderr
 
 			for idxName, docs := range tc.result {
 				for _, doc := range docs {
-					resp, err := elasticClient.Get().Index(idxName).Id(doc._id).Do(ctx)
+					b, err := elasticClient.Get(ctx, idxName, doc._id)
 					fatalIfErr(t, err)
 
-					b, _ := resp.Source.MarshalJSON()
 					var src map[string]interface{}
 					fatalIfErr(t, json.Unmarshal(b, &src))
 
@@ -144,7 +148,106 @@ elasticURL: %s
 	}
 }
 
-func reset(ctx context.Context, t *testing.T, mongoClient *mongo.Client, elasticClient *elastic.Client) {
+// TestRunSharded syncs a sharded collection through mongos, across a chunk migration. It needs the sharded cluster
+// started by test-mongo-sharded-setup.sh, as in CI, and is skipped unless MONGOS_URL is set.
+func TestRunSharded(t *testing.T) {
+	mongosURL := os.Getenv("MONGOS_URL")
+	if mongosURL == "" {
+		t.Skip("MONGOS_URL is not set")
+	}
+
+	mongoClient, err := connectMongo(mongosURL)
+	fatalIfErr(t, err)
+
+	sharded, err := checkDeployment(mongoClient)
+	fatalIfErr(t, err)
+	if !sharded {
+		t.Fatalf("Expected %s to be a sharded cluster", mongosURL)
+	}
+
+	elasticClient, err := connectElastic(elasticSearchURL)
+	fatalIfErr(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reset(ctx, t, mongoClient, elasticClient)
+	defer reset(context.Background(), t, mongoClient, elasticClient)
+
+	admin := mongoClient.Database("admin")
+	fatalIfErr(t, admin.RunCommand(ctx, bson.D{{Key: "enableSharding", Value: "shop"}}).Err())
+	fatalIfErr(t, admin.RunCommand(ctx, bson.D{
+		{Key: "shardCollection", Value: "shop.orders"},
+		{Key: "key", Value: bson.D{{Key: "tenant", Value: 1}, {Key: "_id", Value: 1}}},
+	}).Err())
+
+	seed(ctx, t, dbSeed{"shop": {"orders": {
+		d{"_id": oid("5eb6bd2d0b6bdf6514bb837c"), "tenant": "a"},
+		d{"_id": oid("5eb6bd440b6bdf6514bb8440"), "tenant": "b"},
+	}}}, mongoClient)
+
+	go func() {
+		_ = syncer.New(mongo2.NewSource(mongoClient), elasticClient).Sync(ctx, config.SyncMapping{
+			Databases: []config.DatabaseMapping{{
+				Name:        "shop",
+				Collections: []config.CollectionMapping{{Name: "orders", Index: "orders-{{.tenant}}"}},
+			}},
+		})
+	}()
+
+	eventually(t, func() bool {
+		_, errA := elasticClient.Get(ctx, "orders-a", "5eb6bd2d0b6bdf6514bb837c")
+		_, errB := elasticClient.Get(ctx, "orders-b", "5eb6bd440b6bdf6514bb8440")
+		return errA == nil && errB == nil
+	})
+
+	// Chunk migrations copy documents to another shard and delete them from the donor shard. Through mongos, neither
+	// is in the change stream, so the migrated document stays indexed and its later changes are synced.
+	var chunk struct {
+		Shard string `bson:"shard"`
+	}
+	fatalIfErr(t, mongoClient.Database("config").Collection("chunks").FindOne(ctx, bson.M{"ns": "shop.orders"}).Decode(&chunk))
+	to := "sh1"
+	if chunk.Shard == to {
+		to = "sh2"
+	}
+	fatalIfErr(t, admin.RunCommand(ctx, bson.D{
+		{Key: "moveChunk", Value: "shop.orders"},
+		{Key: "find", Value: bson.D{{Key: "tenant", Value: "a"}, {Key: "_id", Value: oid("5eb6bd2d0b6bdf6514bb837c")}}},
+		{Key: "to", Value: to},
+		{Key: "_waitForDelete", Value: true},
+	}).Err())
+
+	_, err = mongoClient.Database("shop").Collection("orders").UpdateOne(ctx, bson.M{"_id": oid("5eb6bd2d0b6bdf6514bb837c")}, bson.M{"$set": bson.M{"status": "shipped"}})
+	fatalIfErr(t, err)
+
+	eventually(t, func() bool {
+		src, err := elasticClient.Get(ctx, "orders-a", "5eb6bd2d0b6bdf6514bb837c")
+		return err == nil && strings.Contains(string(src), "shipped")
+	})
+	if _, err = elasticClient.Get(ctx, "orders-b", "5eb6bd440b6bdf6514bb8440"); err != nil {
+		t.Fatalf("Expected the document of tenant b to stay indexed, got %v", err)
+	}
+
+	_, err = mongoClient.Database("shop").Collection("orders").DeleteOne(ctx, bson.M{"_id": oid("5eb6bd2d0b6bdf6514bb837c")})
+	fatalIfErr(t, err)
+
+	eventually(t, func() bool {
+		_, err := elasticClient.Get(ctx, "orders-a", "5eb6bd2d0b6bdf6514bb837c")
+		return elastic.IsNotFound(err)
+	})
+}
+
+// eventually fails the test if cond does not become true within 30 seconds.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(30 * time.Second); !cond(); time.Sleep(500 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+	}
+}
+
+func reset(ctx context.Context, t *testing.T, mongoClient *mongo.Client, elasticClient *elasticsearch.Client) {
 	dbs, err := mongoClient.ListDatabases(ctx, bson.D{})
 	fatalIfErr(t, err)
 	for _, db := range dbs.Databases {
@@ -153,11 +256,35 @@ func reset(ctx context.Context, t *testing.T, mongoClient *mongo.Client, elastic
 		}
 	}
 
-	indices, err := elasticClient.CatIndices().Do(ctx)
+	indices, err := elasticClient.IndexNames(ctx)
 	fatalIfErr(t, err)
 	for _, index := range indices {
-		_, err = elasticClient.DeleteIndex(index.Index).Do(ctx)
-		fatalIfErr(t, err)
+		fatalIfErr(t, elasticClient.DeleteIndex(ctx, index))
+	}
+}
+
+func TestOpenSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	fatalIfErr(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := dir + "/out.ndjson"
+	fatalIfErr(t, ioutil.WriteFile(path, []byte("previous output\n"), 0644))
+	conf := config.Config{Sink: config.SinkConfig{Type: config.SinkTypeNDJSON, Path: path}}
+
+	// Subcommands that do not write, such as validate, status and dry runs, leave the output file alone
+	_, closeSink, err := openSink(conf, false)
+	fatalIfErr(t, err)
+	closeSink()
+	if b, _ := ioutil.ReadFile(path); string(b) != "previous output\n" {
+		t.Errorf("openSink() without write changed the output file to %q", b)
+	}
+
+	_, closeSink, err = openSink(conf, true)
+	fatalIfErr(t, err)
+	closeSink()
+	if b, _ := ioutil.ReadFile(path); len(b) != 0 {
+		t.Errorf("openSink() with write left %q in the output file, want it truncated", b)
 	}
 }
 
@@ -1,6 +1,8 @@
 package mongo
 
 import (
+	"bytes"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -26,14 +28,100 @@ type ChangeStreamEvent struct {
 	ID struct {
 		Data string `bson:"_data"`
 	} `bson:"_id"`
-	ClusterTime time.Time `bson:"clusterTime"`
-	DocumentKey struct {
-		ID primitive.ObjectID `bson:"_id"`
-	} `bson:"documentKey"`
+	ClusterTime  time.Time              `bson:"clusterTime"`
+	DocumentKey  DocumentKey            `bson:"documentKey"`
 	FullDocument map[string]interface{} `bson:"fullDocument"`
 	Namespace    struct {
 		Collection string `bson:"coll"`
 		Database   string `bson:"db"`
 	} `bson:"ns"`
 	OperationType changeStreamEventOperationType `bson:"operationType"`
+	// UpdateDescription holds the fields changed by update events.
+	UpdateDescription *UpdateDescription `bson:"updateDescription,omitempty"`
+	// TxnNumber and LSID identify the transaction of events that are part of a multi-document transaction.
+	TxnNumber *int64     `bson:"txnNumber,omitempty"`
+	LSID      *SessionID `bson:"lsid,omitempty"`
+}
+
+// SessionID identifies the logical session of a transaction.
+type SessionID struct {
+	ID  primitive.Binary `bson:"id"`
+	UID primitive.Binary `bson:"uid"`
+}
+
+// InTransaction returns true if the event is part of a multi-document transaction.
+func (e ChangeStreamEvent) InTransaction() bool {
+	return e.TxnNumber != nil && e.LSID != nil
+}
+
+// SameTransaction returns true if e and other are part of the same multi-document transaction.
+func (e ChangeStreamEvent) SameTransaction(other ChangeStreamEvent) bool {
+	if !e.InTransaction() || !other.InTransaction() {
+		return false
+	}
+	return *e.TxnNumber == *other.TxnNumber &&
+		e.LSID.ID.Subtype == other.LSID.ID.Subtype && bytes.Equal(e.LSID.ID.Data, other.LSID.ID.Data) &&
+		e.LSID.UID.Subtype == other.LSID.UID.Subtype && bytes.Equal(e.LSID.UID.Data, other.LSID.UID.Data)
+}
+
+// UpdateDescription describes the fields an update event changed, by their dotted path.
+type UpdateDescription struct {
+	UpdatedFields map[string]interface{} `bson:"updatedFields"`
+	RemovedFields []string               `bson:"removedFields"`
+}
+
+// Changes returns true if the event may have changed the field at path. Only update events with an update description
+// can leave a field unchanged.
+func (e ChangeStreamEvent) Changes(path string) bool {
+	if e.OperationType != ChangeStreamEventOperationTypeUpdate || e.UpdateDescription == nil {
+		return true
+	}
+
+	touches := func(changed string) bool {
+		return changed == path || strings.HasPrefix(changed, path+".") || strings.HasPrefix(path, changed+".")
+	}
+	for changed := range e.UpdateDescription.UpdatedFields {
+		if touches(changed) {
+			return true
+		}
+	}
+	for _, changed := range e.UpdateDescription.RemovedFields {
+		if touches(changed) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventNamespace returns the namespace of the collection the event happened in.
+func (e ChangeStreamEvent) EventNamespace() Namespace {
+	return Namespace{Database: e.Namespace.Database, Collection: e.Namespace.Collection}
+}
+
+// DocumentKey identifies the document of a change stream event.
+// ID is the _id of the document, of any type. In sharded collections, the key also holds the shard key fields of the
+// document.
+type DocumentKey struct {
+	ID       interface{}            `bson:"_id"`
+	ShardKey map[string]interface{} `bson:",inline"`
+}
+
+// Document returns the document key as a document with the _id and shard key fields.
+// Shard key fields of embedded documents, which may be named by their dotted path, are nested in the document.
+func (k DocumentKey) Document() map[string]interface{} {
+	doc := map[string]interface{}{"_id": k.ID}
+	for path, v := range k.ShardKey {
+		parent := doc
+		names := strings.Split(path, ".")
+		for _, name := range names[:len(names)-1] {
+			child, ok := parent[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[name] = child
+			}
+			parent = child
+		}
+		parent[names[len(names)-1]] = v
+	}
+	return doc
 }
@@ -0,0 +1,80 @@
+package mongo_test
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/mongo"
+)
+
+func TestDocumentKey(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+
+	tests := []struct {
+		name string
+		key  bson.M
+		want map[string]interface{}
+	}{
+		{name: "replica set", key: bson.M{"_id": oid}, want: map[string]interface{}{"_id": oid}},
+		{name: "string id", key: bson.M{"_id": "transactions"}, want: map[string]interface{}{"_id": "transactions"}},
+		{name: "int id", key: bson.M{"_id": int32(1)}, want: map[string]interface{}{"_id": int32(1)}},
+		{name: "shard key", key: bson.M{"tenant": "a", "_id": oid}, want: map[string]interface{}{"_id": oid, "tenant": "a"}},
+		{
+			name: "dotted shard key",
+			key:  bson.M{"customer.region": "eu", "customer.id": int32(1), "_id": oid},
+			want: map[string]interface{}{"_id": oid, "customer": map[string]interface{}{"region": "eu", "id": int32(1)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := bson.Marshal(bson.M{"documentKey": tt.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var evt mongo.ChangeStreamEvent
+			if err = bson.Unmarshal(b, &evt); err != nil {
+				t.Fatal(err)
+			}
+
+			if evt.DocumentKey.ID != tt.key["_id"] {
+				t.Errorf("DocumentKey.ID = %v, want %v", evt.DocumentKey.ID, tt.key["_id"])
+			}
+			if got := evt.DocumentKey.Document(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Document() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChanges(t *testing.T) {
+	update := &mongo.UpdateDescription{UpdatedFields: map[string]interface{}{"author.name": "a", "tags.0": "b"}, RemovedFields: []string{"post"}}
+
+	tests := []struct {
+		name string
+		evt  mongo.ChangeStreamEvent
+		path string
+		want bool
+	}{
+		{name: "updated field", evt: mongo.ChangeStreamEvent{OperationType: mongo.ChangeStreamEventOperationTypeUpdate, UpdateDescription: update}, path: "author.name", want: true},
+		{name: "updated child", evt: mongo.ChangeStreamEvent{OperationType: mongo.ChangeStreamEventOperationTypeUpdate, UpdateDescription: update}, path: "tags", want: true},
+		{name: "updated parent", evt: mongo.ChangeStreamEvent{OperationType: mongo.ChangeStreamEventOperationTypeUpdate, UpdateDescription: update}, path: "tags.0.name", want: true},
+		{name: "removed field", evt: mongo.ChangeStreamEvent{OperationType: mongo.ChangeStreamEventOperationTypeUpdate, UpdateDescription: update}, path: "post", want: true},
+		{name: "unchanged field", evt: mongo.ChangeStreamEvent{OperationType: mongo.ChangeStreamEventOperationTypeUpdate, UpdateDescription: update}, path: "author.email", want: false},
+		{name: "unchanged prefix", evt: mongo.ChangeStreamEvent{OperationType: mongo.ChangeStreamEventOperationTypeUpdate, UpdateDescription: update}, path: "posted", want: false},
+		{name: "update without description", evt: mongo.ChangeStreamEvent{OperationType: mongo.ChangeStreamEventOperationTypeUpdate}, path: "post", want: true},
+		{name: "replace", evt: mongo.ChangeStreamEvent{OperationType: mongo.ChangeStreamEventOperationTypeReplace}, path: "post", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.evt.Changes(tt.path); got != tt.want {
+				t.Errorf("Changes(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	driver "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Checkpoint is the resume token of a change stream, saved under Key.
+type Checkpoint struct {
+	Key   string `bson:"_id"`
+	Token string `bson:"token"`
+	// ClusterTime is the time of the event the token resumes after
+	ClusterTime time.Time `bson:"clusterTime"`
+	// UpdatedAt is when the checkpoint was saved
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+// Checkpoints persists the resume tokens of change streams, so that tailing can resume where it stopped.
+type Checkpoints interface {
+	// Load returns the checkpoint saved under key. Its token is empty if there is none.
+	Load(ctx context.Context, key string) (Checkpoint, error)
+	// Save saves the resume token of the event that happened at clusterTime under key.
+	Save(ctx context.Context, key, token string, clusterTime time.Time) error
+}
+
+// NewCheckpoints returns Checkpoints that keep one document per key in coll.
+func NewCheckpoints(coll *driver.Collection) Checkpoints {
+	return collectionCheckpoints{coll: coll}
+}
+
+type collectionCheckpoints struct {
+	coll *driver.Collection
+}
+
+func (c collectionCheckpoints) Load(ctx context.Context, key string) (Checkpoint, error) {
+	var cp Checkpoint
+	err := c.coll.FindOne(ctx, bson.M{"_id": key}).Decode(&cp)
+	if errors.Is(err, driver.ErrNoDocuments) {
+		return Checkpoint{Key: key}, nil
+	}
+	return cp, err
+}
+
+func (c collectionCheckpoints) Save(ctx context.Context, key, token string, clusterTime time.Time) error {
+	_, err := c.coll.ReplaceOne(ctx, bson.M{"_id": key},
+		Checkpoint{Key: key, Token: token, ClusterTime: clusterTime.UTC(), UpdatedAt: time.Now().UTC()},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// MemoryCheckpoints are in-memory Checkpoints for tests.
+type MemoryCheckpoints struct {
+	mu          sync.Mutex
+	checkpoints map[string]Checkpoint
+}
+
+var _ Checkpoints = (*MemoryCheckpoints)(nil)
+
+// NewMemoryCheckpoints returns empty MemoryCheckpoints.
+func NewMemoryCheckpoints() *MemoryCheckpoints {
+	return &MemoryCheckpoints{checkpoints: make(map[string]Checkpoint)}
+}
+
+func (m *MemoryCheckpoints) Load(ctx context.Context, key string) (Checkpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cp, ok := m.checkpoints[key]; ok {
+		return cp, nil
+	}
+	return Checkpoint{Key: key}, nil
+}
+
+func (m *MemoryCheckpoints) Save(ctx context.Context, key, token string, clusterTime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoints[key] = Checkpoint{Key: key, Token: token, ClusterTime: clusterTime, UpdatedAt: time.Now()}
+	return nil
+}
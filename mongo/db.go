@@ -1,8 +1,11 @@
 package mongo
 
+import "strings"
+
 var systemDBNames = []string{"admin", "config", "local"}
 
 // IsSystemDB returns true if s is the name of a MongoDB system database.
+// This includes config, which holds the metadata of sharded clusters and is listed by mongos.
 // https://docs.mongodb.com/manual/reference/system-collections/
 func IsSystemDB(s string) bool {
 	for _, name := range systemDBNames {
@@ -13,4 +16,8 @@ func IsSystemDB(s string) bool {
 	return false
 }
 
-// TODO: IsSystemCollection?
+// IsSystemCollection returns true if s is the name of a MongoDB system collection.
+// https://docs.mongodb.com/manual/reference/system-collections/
+func IsSystemCollection(s string) bool {
+	return strings.HasPrefix(s, "system.")
+}
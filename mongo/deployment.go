@@ -0,0 +1,49 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	driver "go.mongodb.org/mongo-driver/mongo"
+)
+
+// mongosMsg is the msg field of the isMaster response of a mongos router
+const mongosMsg = "isdbgrid"
+
+var (
+	// ErrStandalone is returned by CheckDeployment for standalone servers, which have no change streams.
+	ErrStandalone = errors.New("change streams require a replica set or a sharded cluster")
+	// ErrShardMember is returned by CheckDeployment for members of a shard of a sharded cluster.
+	ErrShardMember = errors.New("connected directly to a shard of a sharded cluster, which only holds some of its documents; connect through mongos instead")
+)
+
+// CheckDeployment returns whether client is connected to a sharded cluster through mongos, or a replica set.
+// It returns an error if the deployment cannot be synced: a standalone server, or a shard of a sharded cluster.
+// Through mongos, chunk migrations between shards are neither listed in change streams nor read as duplicate
+// documents, as they are when reading from the shards directly.
+func CheckDeployment(ctx context.Context, client *driver.Client) (bool, error) {
+	var isMaster struct {
+		Msg     string `bson:"msg"`
+		SetName string `bson:"setName"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.M{"isMaster": 1}).Decode(&isMaster); err != nil {
+		return false, err
+	}
+
+	switch {
+	case isMaster.Msg == mongosMsg:
+		return true, nil
+	case isMaster.SetName == "":
+		return false, ErrStandalone
+	}
+
+	// The sharding state of a replica set cannot be read without the clusterManager role. Assume it is not a shard.
+	var shardingState struct {
+		Enabled bool `bson:"enabled"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.M{"shardingState": 1}).Decode(&shardingState); err == nil && shardingState.Enabled {
+		return false, ErrShardMember
+	}
+	return false, nil
+}
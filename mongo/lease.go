@@ -0,0 +1,93 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	driver "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// duplicateKeyCode is the code of the error returned when a write violates a unique index
+const duplicateKeyCode = 11000
+
+// LeaseStore keeps leases in a collection, one document per lease.
+// Whether a lease has expired is decided by the clock of the instance acquiring it, so the clocks of the instances
+// sharing a lease must be synchronized.
+type LeaseStore struct {
+	coll *driver.Collection
+}
+
+// NewLeaseStore returns a LeaseStore keeping leases in coll.
+// It creates a TTL index that removes the documents of expired leases.
+func NewLeaseStore(ctx context.Context, coll *driver.Collection) (LeaseStore, error) {
+	_, err := coll.Indexes().CreateOne(ctx, driver.IndexModel{
+		Keys:    bson.M{"expiresAt": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return LeaseStore{coll: coll}, err
+}
+
+// Acquire takes the lease called name for holder until ttl from now, if the lease is free, has expired or is already
+// held by holder. It returns false if another holder has the lease.
+func (s LeaseStore) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	_, err := s.coll.UpdateOne(ctx,
+		bson.M{"_id": name, "$or": []bson.M{{"holder": holder}, {"expiresAt": bson.M{"$lte": now}}}},
+		bson.M{"$set": bson.M{"holder": holder, "expiresAt": now.Add(ttl)}},
+		options.Update().SetUpsert(true),
+	)
+	if isDuplicateKeyError(err) {
+		// The lease exists and is held by someone else, so the upsert tried to insert it again
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release gives up the lease called name if holder has it.
+func (s LeaseStore) Release(ctx context.Context, name, holder string) error {
+	_, err := s.coll.DeleteOne(ctx, bson.M{"_id": name, "holder": holder})
+	return err
+}
+
+// Holders returns the holders of the unexpired leases whose names start with prefix, by lease name.
+func (s LeaseStore) Holders(ctx context.Context, prefix string) (map[string]string, error) {
+	cursor, err := s.coll.Find(ctx, bson.M{
+		"_id":       primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)},
+		"expiresAt": bson.M{"$gt": time.Now().UTC()},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []struct {
+		Name   string `bson:"_id"`
+		Holder string `bson:"holder"`
+	}
+	if err = cursor.All(ctx, &leases); err != nil {
+		return nil, err
+	}
+
+	holders := make(map[string]string, len(leases))
+	for _, l := range leases {
+		holders[l.Name] = l.Holder
+	}
+	return holders, nil
+}
+
+func isDuplicateKeyError(err error) bool {
+	var we driver.WriteException
+	if errors.As(err, &we) {
+		for _, e := range we.WriteErrors {
+			if e.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	}
+	var ce driver.CommandError
+	return errors.As(err, &ce) && ce.Code == duplicateKeyCode
+}
@@ -0,0 +1,340 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/fields"
+)
+
+// MemorySource is an in-memory Source for tests.
+// Documents are inserted with Insert, and each change stream replays the events scripted with AddEvents for its
+// collection, then ends with the error set with SetStreamError, if any. The change stream of the deployment replays
+// the events of the watched collections in the order they were added, and ends with the error set for the zero
+// Namespace.
+// Find supports equality and $in filters, and Aggregate supports pipelines of $lookup stages.
+type MemorySource struct {
+	mu         sync.Mutex
+	docs       map[Namespace][]bson.Raw
+	events     map[Namespace][]ChangeStreamEvent
+	allEvents  []ChangeStreamEvent
+	streamErrs map[Namespace]error
+}
+
+var _ Source = (*MemorySource)(nil)
+
+// NewMemorySource returns an empty MemorySource.
+func NewMemorySource() *MemorySource {
+	return &MemorySource{
+		docs:       make(map[Namespace][]bson.Raw),
+		events:     make(map[Namespace][]ChangeStreamEvent),
+		streamErrs: make(map[Namespace]error),
+	}
+}
+
+// Insert inserts docs into the collection, creating it if it does not exist.
+func (m *MemorySource) Insert(ns Namespace, docs ...interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.docs[ns]; !ok {
+		m.docs[ns] = []bson.Raw{}
+	}
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		m.docs[ns] = append(m.docs[ns], raw)
+	}
+	return nil
+}
+
+// AddEvents adds events to the change stream script of the collection. The namespace of the events is set to ns.
+func (m *MemorySource) AddEvents(ns Namespace, events ...ChangeStreamEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, evt := range events {
+		evt.Namespace.Database, evt.Namespace.Collection = ns.Database, ns.Collection
+		m.events[ns] = append(m.events[ns], evt)
+		m.allEvents = append(m.allEvents, evt)
+	}
+}
+
+// SetStreamError sets the error that change streams of the collection end with.
+func (m *MemorySource) SetStreamError(ns Namespace, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streamErrs[ns] = err
+}
+
+// ListDatabases returns the names of the databases in lexical order.
+func (m *MemorySource) ListDatabases(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for ns := range m.docs {
+		if !seen[ns.Database] {
+			seen[ns.Database] = true
+			names = append(names, ns.Database)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListCollections returns the names of the collections in the database in lexical order.
+func (m *MemorySource) ListCollections(ctx context.Context, db string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for ns := range m.docs {
+		if ns.Database == db {
+			names = append(names, ns.Collection)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Find returns the documents of the collection matching filter, in insertion order.
+func (m *MemorySource) Find(ctx context.Context, ns Namespace, filter interface{}) (Cursor, error) {
+	docs, err := m.find(ns, filter)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryCursor(docs, nil)
+}
+
+// Count returns the number of documents of the collection matching filter.
+func (m *MemorySource) Count(ctx context.Context, ns Namespace, filter interface{}) (int64, error) {
+	docs, err := m.find(ns, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(docs)), nil
+}
+
+// Aggregate runs a pipeline of $lookup stages on the collection.
+func (m *MemorySource) Aggregate(ctx context.Context, ns Namespace, pipeline interface{}) (Cursor, error) {
+	stages, ok := pipeline.([]bson.M)
+	if !ok {
+		return nil, fmt.Errorf("unsupported pipeline type %T", pipeline)
+	}
+
+	docs, err := m.find(ns, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range stages {
+		lookup, ok := stage["$lookup"].(bson.M)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("unsupported pipeline stage %v", stage)
+		}
+
+		for _, doc := range docs {
+			local, _ := fields.Get(doc, lookup["localField"].(string))
+			joined, err := m.find(Namespace{Database: ns.Database, Collection: lookup["from"].(string)}, bson.M{lookup["foreignField"].(string): local})
+			if err != nil {
+				return nil, err
+			}
+
+			as := make(primitive.A, len(joined))
+			for i, j := range joined {
+				as[i] = j
+			}
+			doc[lookup["as"].(string)] = as
+		}
+	}
+
+	return newMemoryCursor(docs, nil)
+}
+
+// Watch replays the scripted events of the collection that follow the resume token of opts or, if it is empty,
+// that happened at or after the start time of opts.
+func (m *MemorySource) Watch(ctx context.Context, ns Namespace, opts WatchOptions) (Cursor, error) {
+	m.mu.Lock()
+	events := m.events[ns]
+	streamErr := m.streamErrs[ns]
+	m.mu.Unlock()
+
+	return replay(events, streamErr, opts)
+}
+
+// WatchAll replays the scripted events of the collections in namespaces like Watch.
+func (m *MemorySource) WatchAll(ctx context.Context, namespaces []Namespace, opts WatchOptions) (ChangeStream, error) {
+	watched := make(map[Namespace]bool, len(namespaces))
+	for _, ns := range namespaces {
+		watched[ns] = true
+	}
+
+	m.mu.Lock()
+	var events []ChangeStreamEvent
+	for _, evt := range m.allEvents {
+		if watched[evt.EventNamespace()] {
+			events = append(events, evt)
+		}
+	}
+	streamErr := m.streamErrs[Namespace{}]
+	m.mu.Unlock()
+
+	return replay(events, streamErr, opts)
+}
+
+// replay returns a cursor over the events that follow the resume token of opts or, if it is empty, that happened at
+// or after the start time of opts.
+func replay(events []ChangeStreamEvent, streamErr error, opts WatchOptions) (ChangeStream, error) {
+	if opts.ResumeAfter != "" {
+		resumed := false
+		for i, evt := range events {
+			if evt.ID.Data == opts.ResumeAfter {
+				events, resumed = events[i+1:], true
+				break
+			}
+		}
+		if !resumed {
+			return nil, fmt.Errorf("resume token [%s] not found: %w", opts.ResumeAfter, ErrHistoryLost)
+		}
+	}
+
+	docs := make([]interface{}, 0, len(events))
+	for _, evt := range events {
+		if start := opts.StartAtOperationTime; start != nil && opts.ResumeAfter == "" && !evt.ClusterTime.IsZero() && evt.ClusterTime.Unix() < int64(start.T) {
+			continue
+		}
+		docs = append(docs, evt)
+	}
+	return newMemoryCursor(docs, streamErr)
+}
+
+func (m *MemorySource) find(ns Namespace, filter interface{}) ([]map[string]interface{}, error) {
+	m.mu.Lock()
+	raws := m.docs[ns]
+	m.mu.Unlock()
+
+	var f bson.M
+	b, err := bson.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = bson.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	var docs []map[string]interface{}
+	for _, raw := range raws {
+		var doc map[string]interface{}
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		if matches(doc, f) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+// matches returns true if doc matches the equality and $in conditions of filter.
+func matches(doc map[string]interface{}, filter bson.M) bool {
+	for path, cond := range filter {
+		v, _ := fields.Get(doc, path)
+
+		candidates := []interface{}{cond}
+		if c, ok := cond.(bson.M); ok {
+			if in, ok := c["$in"].(primitive.A); ok {
+				candidates = in
+			}
+		}
+
+		matched := false
+		for _, c := range candidates {
+			if valueMatches(v, c) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// valueMatches returns true if v equals c, or v is an array containing c, as in Mongo queries.
+func valueMatches(v, c interface{}) bool {
+	if reflect.DeepEqual(v, c) {
+		return true
+	}
+	if arr, ok := v.(primitive.A); ok {
+		for _, e := range arr {
+			if reflect.DeepEqual(e, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// memoryCursor iterates over documents marshalled to BSON, so that they are decoded like documents from Mongo.
+type memoryCursor struct {
+	docs    []bson.Raw
+	current bson.Raw
+	err     error
+	endErr  error
+}
+
+func newMemoryCursor(docs interface{}, endErr error) (*memoryCursor, error) {
+	c := &memoryCursor{endErr: endErr}
+
+	v := reflect.ValueOf(docs)
+	for i := 0; i < v.Len(); i++ {
+		raw, err := bson.Marshal(v.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		c.docs = append(c.docs, raw)
+	}
+	return c, nil
+}
+
+func (c *memoryCursor) Next(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		c.err = ctx.Err()
+		return false
+	}
+	if len(c.docs) == 0 {
+		c.err = c.endErr
+		return false
+	}
+	c.current, c.docs = c.docs[0], c.docs[1:]
+	return true
+}
+
+func (c *memoryCursor) TryNext(ctx context.Context) bool {
+	if len(c.docs) == 0 {
+		return false
+	}
+	return c.Next(ctx)
+}
+
+func (c *memoryCursor) Decode(v interface{}) error {
+	return bson.Unmarshal(c.current, v)
+}
+
+func (c *memoryCursor) Err() error {
+	return c.err
+}
+
+func (c *memoryCursor) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package mongo_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/mongo"
+)
+
+func TestMemorySourceFind(t *testing.T) {
+	ns := mongo.Namespace{Database: "db1", Collection: "coll1"}
+	source := mongo.NewMemorySource()
+	if err := source.Insert(ns,
+		bson.M{"_id": 1, "tags": bson.A{"a", "b"}},
+		bson.M{"_id": 2, "tags": bson.A{"c"}, "nested": bson.M{"n": 1}},
+		bson.M{"_id": 3},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter interface{}
+		want   []int32
+	}{
+		{name: "empty", filter: bson.D{}, want: []int32{1, 2, 3}},
+		{name: "equality", filter: bson.M{"_id": 2}, want: []int32{2}},
+		{name: "nested field", filter: bson.M{"nested.n": 1}, want: []int32{2}},
+		{name: "array contains", filter: bson.M{"tags": "b"}, want: []int32{1}},
+		{name: "in", filter: bson.M{"_id": bson.M{"$in": primitive.A{1, 3}}}, want: []int32{1, 3}},
+		{name: "no match", filter: bson.M{"_id": 4}, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := source.Find(context.Background(), ns, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int32
+			for cursor.Next(context.Background()) {
+				var doc struct {
+					ID int32 `bson:"_id"`
+				}
+				if err := cursor.Decode(&doc); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, doc.ID)
+			}
+			if err := cursor.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Find() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package mongo
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// NameFilter selects database or collection names with include and exclude patterns.
+// A pattern is a glob, in which * matches any sequence of characters and ? matches any single character, or a
+// regular expression if it is enclosed in slashes (e.g. /^orders_\d+$/).
+type NameFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewNameFilter returns a NameFilter with the given include and exclude patterns.
+func NewNameFilter(include, exclude []string) (NameFilter, error) {
+	var f NameFilter
+	var err error
+	if f.include, err = compilePatterns(include); err != nil {
+		return f, err
+	}
+	if f.exclude, err = compilePatterns(exclude); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// HasIncludes returns true if the filter has include patterns.
+func (f NameFilter) HasIncludes() bool {
+	return len(f.include) > 0
+}
+
+// Included returns true if name matches an include pattern.
+func (f NameFilter) Included(name string) bool {
+	return matchesAny(f.include, name)
+}
+
+// Excluded returns true if name matches an exclude pattern.
+func (f NameFilter) Excluded(name string) bool {
+	return matchesAny(f.exclude, name)
+}
+
+func matchesAny(patterns []*regexp.Regexp, name string) bool {
+	for _, p := range patterns {
+		if p.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := compilePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern [%s]: %w", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		return regexp.Compile(p[1 : len(p)-1])
+	}
+
+	glob := regexp.QuoteMeta(p)
+	glob = strings.Replace(glob, `\*`, ".*", -1)
+	glob = strings.Replace(glob, `\?`, ".", -1)
+	return regexp.Compile("^" + glob + "$")
+}
@@ -0,0 +1,49 @@
+package mongo_test
+
+import (
+	"testing"
+
+	"mongo-elastic-sync/mongo"
+)
+
+func TestNameFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		include      []string
+		exclude      []string
+		in           string
+		wantIncluded bool
+		wantExcluded bool
+	}{
+		{name: "glob include", include: []string{"orders_*"}, in: "orders_2020", wantIncluded: true},
+		{name: "glob include no match", include: []string{"orders_*"}, in: "users", wantIncluded: false},
+		{name: "glob is anchored", include: []string{"orders"}, in: "old_orders", wantIncluded: false},
+		{name: "glob single character", include: []string{"shard?"}, in: "shard1", wantIncluded: true},
+		{name: "glob dots are literal", include: []string{"a.b"}, in: "axb", wantIncluded: false},
+		{name: "regex include", include: []string{`/^orders_\d+$/`}, in: "orders_2020", wantIncluded: true},
+		{name: "regex is not anchored", include: []string{`/tmp/`}, in: "my_tmp_coll", wantIncluded: true},
+		{name: "exclude", exclude: []string{"tmp_*"}, in: "tmp_import", wantExcluded: true},
+		{name: "include and exclude", include: []string{"*"}, exclude: []string{"/^tmp/"}, in: "tmp_import", wantIncluded: true, wantExcluded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := mongo.NewNameFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Included(tt.in); got != tt.wantIncluded {
+				t.Errorf("Included(%q) got = %v, want %v", tt.in, got, tt.wantIncluded)
+			}
+			if got := f.Excluded(tt.in); got != tt.wantExcluded {
+				t.Errorf("Excluded(%q) got = %v, want %v", tt.in, got, tt.wantExcluded)
+			}
+		})
+	}
+}
+
+func TestNewNameFilterInvalidRegex(t *testing.T) {
+	if _, err := mongo.NewNameFilter([]string{"/(/"}, nil); err == nil {
+		t.Error("NewNameFilter() expected error for invalid regular expression")
+	}
+}
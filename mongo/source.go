@@ -0,0 +1,177 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	driver "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrHistoryLost is returned by change streams that cannot start at their position because the oplog no longer covers
+// it. The collections must be dumped again, or tailed from a later position.
+var ErrHistoryLost = errors.New("the oplog no longer covers the start position of the change stream")
+
+// Error codes of change streams whose start position is no longer in the oplog
+const (
+	codeChangeStreamFatalError  = 280
+	codeChangeStreamHistoryLost = 286
+)
+
+// Namespace identifies a Mongo collection.
+type Namespace struct {
+	Database   string
+	Collection string
+}
+
+// Cursor iterates over documents or change stream events.
+// It is implemented by the driver's cursors and change streams.
+type Cursor interface {
+	Next(ctx context.Context) bool
+	Decode(v interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// ChangeStream iterates over change stream events.
+type ChangeStream interface {
+	Cursor
+	// TryNext is like Next, but returns false instead of waiting if no event is available yet.
+	TryNext(ctx context.Context) bool
+}
+
+// WatchOptions configures a change stream.
+type WatchOptions struct {
+	// StartAtOperationTime starts the change stream at the given cluster time.
+	StartAtOperationTime *primitive.Timestamp
+	// ResumeAfter starts the change stream after the event with the given resume token, if it is not empty.
+	// It takes precedence over StartAtOperationTime.
+	ResumeAfter string
+}
+
+// String describes where the change stream starts.
+func (o WatchOptions) String() string {
+	switch {
+	case o.ResumeAfter != "":
+		return fmt.Sprintf("after resume token [%s]", o.ResumeAfter)
+	case o.StartAtOperationTime != nil:
+		return fmt.Sprintf("at [%s]", time.Unix(int64(o.StartAtOperationTime.T), 0).UTC().Format(time.RFC3339))
+	}
+	return "now"
+}
+
+// Source is the Mongo deployment documents are synced from.
+type Source interface {
+	// ListDatabases returns the names of the databases.
+	ListDatabases(ctx context.Context) ([]string, error)
+	// ListCollections returns the names of the collections in the database. Views are not included.
+	ListCollections(ctx context.Context, db string) ([]string, error)
+	// Find returns a cursor over the documents in the collection matching filter.
+	Find(ctx context.Context, ns Namespace, filter interface{}) (Cursor, error)
+	// Count returns the number of documents in the collection matching filter.
+	Count(ctx context.Context, ns Namespace, filter interface{}) (int64, error)
+	// Aggregate returns a cursor over the results of running pipeline on the collection.
+	Aggregate(ctx context.Context, ns Namespace, pipeline interface{}) (Cursor, error)
+	// Watch returns a cursor over the change stream events of the collection.
+	// Update events include the current version of the full document.
+	Watch(ctx context.Context, ns Namespace, opts WatchOptions) (Cursor, error)
+	// WatchAll returns the change stream of the collections in namespaces across the whole deployment, in which the
+	// events of a multi-document transaction follow each other.
+	WatchAll(ctx context.Context, namespaces []Namespace, opts WatchOptions) (ChangeStream, error)
+}
+
+// NewSource returns a Source reading from client.
+func NewSource(client *driver.Client) Source {
+	return clientSource{client: client}
+}
+
+type clientSource struct {
+	client *driver.Client
+}
+
+func (s clientSource) ListDatabases(ctx context.Context) ([]string, error) {
+	return s.client.ListDatabaseNames(ctx, bson.D{})
+}
+
+func (s clientSource) ListCollections(ctx context.Context, db string) ([]string, error) {
+	return s.client.Database(db).ListCollectionNames(ctx, bson.M{"type": "collection"})
+}
+
+func (s clientSource) Find(ctx context.Context, ns Namespace, filter interface{}) (Cursor, error) {
+	return s.collection(ns).Find(ctx, filter)
+}
+
+func (s clientSource) Count(ctx context.Context, ns Namespace, filter interface{}) (int64, error) {
+	return s.collection(ns).CountDocuments(ctx, filter)
+}
+
+func (s clientSource) Aggregate(ctx context.Context, ns Namespace, pipeline interface{}) (Cursor, error) {
+	return s.collection(ns).Aggregate(ctx, pipeline)
+}
+
+func (s clientSource) Watch(ctx context.Context, ns Namespace, opts WatchOptions) (Cursor, error) {
+	stream, err := s.collection(ns).Watch(ctx, []bson.M{}, changeStreamOptions(opts))
+	if err != nil {
+		return nil, historyLostError(err)
+	}
+	return changeStream{stream}, nil
+}
+
+func (s clientSource) WatchAll(ctx context.Context, namespaces []Namespace, opts WatchOptions) (ChangeStream, error) {
+	stream, err := s.client.Watch(ctx, []bson.M{{"$match": namespacesFilter(namespaces)}}, changeStreamOptions(opts))
+	if err != nil {
+		return nil, historyLostError(err)
+	}
+	return changeStream{stream}, nil
+}
+
+// changeStream is a driver change stream whose errors wrap ErrHistoryLost if its start position is no longer in the
+// oplog.
+type changeStream struct {
+	*driver.ChangeStream
+}
+
+func (s changeStream) Err() error {
+	return historyLostError(s.ChangeStream.Err())
+}
+
+// historyLostError wraps err with ErrHistoryLost if it is the error of a change stream whose start position is no
+// longer in the oplog.
+func historyLostError(err error) error {
+	var cmdErr driver.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == codeChangeStreamHistoryLost || cmdErr.Code == codeChangeStreamFatalError) {
+		return fmt.Errorf("%w: %v", ErrHistoryLost, err)
+	}
+	return err
+}
+
+// namespacesFilter returns a filter matching the change stream events of the collections in namespaces.
+func namespacesFilter(namespaces []Namespace) bson.M {
+	or := make([]bson.M, 0, len(namespaces))
+	for _, ns := range namespaces {
+		or = append(or, bson.M{"ns.db": ns.Database, "ns.coll": ns.Collection})
+	}
+	if len(or) == 0 {
+		// $or needs at least one expression, and no namespace matches an empty $in
+		return bson.M{"ns.coll": bson.M{"$in": bson.A{}}}
+	}
+	return bson.M{"$or": or}
+}
+
+func changeStreamOptions(opts WatchOptions) *options.ChangeStreamOptions {
+	csOpts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if opts.ResumeAfter != "" {
+		csOpts.SetResumeAfter(bson.M{"_data": opts.ResumeAfter})
+	} else if opts.StartAtOperationTime != nil {
+		csOpts.SetStartAtOperationTime(opts.StartAtOperationTime)
+	}
+	return csOpts
+}
+
+func (s clientSource) collection(ns Namespace) *driver.Collection {
+	return s.client.Database(ns.Database).Collection(ns.Collection)
+}
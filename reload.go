@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"mongo-elastic-sync/config"
+)
+
+// configPollInterval is how often the configuration file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// configWatcher reloads the configuration file when it changes or the process receives SIGHUP, and sends the sync
+// mappings that changed to reloads. Only the latest sync mapping is kept until it is received.
+// Other settings are not reloaded; changing them requires a restart.
+type configWatcher struct {
+	path string
+	// reloads receives the sync mappings that changed
+	reloads chan config.SyncMapping
+
+	mu sync.Mutex
+	// conf is the last configuration loaded
+	conf config.Config
+}
+
+// newConfigWatcher returns a watcher of the configuration file at path, which was loaded into conf.
+func newConfigWatcher(path string, conf config.Config) *configWatcher {
+	return &configWatcher{path: path, conf: conf, reloads: make(chan config.SyncMapping, 1)}
+}
+
+// Mapping returns the last sync mapping loaded.
+func (w *configWatcher) Mapping() config.SyncMapping {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conf.SyncMapping
+}
+
+// watch reloads the configuration file when it changes or the process receives SIGHUP, until ctx is done.
+func (w *configWatcher) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modTime := w.modTime()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info("Received SIGHUP, reloading config")
+			w.reload()
+		case <-ticker.C:
+			if t := w.modTime(); !t.Equal(modTime) {
+				modTime = t
+				log.Info("Config file changed, reloading config")
+				w.reload()
+			}
+		}
+	}
+}
+
+// modTime returns the modification time of the configuration file, or the zero time if it cannot be read.
+func (w *configWatcher) modTime() time.Time {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reload loads the configuration file and sends its sync mapping to reloads if it changed. An invalid configuration
+// is logged and ignored.
+func (w *configWatcher) reload() {
+	conf, _, err := loadConfig(w.path)
+	if err != nil {
+		log.Errorf("Reloading config failed, keeping the current sync mapping: %+v", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	previous := w.conf
+	w.conf = conf
+
+	// Each change to the other settings is only warned about once
+	settings, next := previous, conf
+	settings.SyncMapping, next.SyncMapping = config.SyncMapping{}, config.SyncMapping{}
+	if !reflect.DeepEqual(settings, next) {
+		log.Warn("Only the sync mapping is reloaded, restart to apply the other changed settings")
+	}
+
+	if reflect.DeepEqual(conf.SyncMapping, previous.SyncMapping) {
+		log.Info("Sync mapping unchanged")
+		return
+	}
+
+	// Replace the sync mapping that was not received yet, if any
+	select {
+	case <-w.reloads:
+	default:
+	}
+	w.reloads <- conf.SyncMapping
+	log.Info("Reloaded sync mapping")
+}
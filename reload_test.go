@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	fatalIfErr(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "config.yml")
+	write := func(collection string) {
+		t.Helper()
+		fatalIfErr(t, ioutil.WriteFile(path, []byte(`mongoURL: mongodb://localhost:27017
+elasticURL: http://localhost:9200
+databases:
+  - name: db1
+    collections:
+      - name: `+collection+`
+`), 0600))
+	}
+
+	write("coll1")
+	conf, _, err := loadConfig(path)
+	fatalIfErr(t, err)
+	w := newConfigWatcher(path, conf)
+
+	// Unchanged and invalid sync mappings are not sent
+	w.reload()
+	write("")
+	w.reload()
+	select {
+	case m := <-w.reloads:
+		t.Fatalf("reload() sent %+v, want nothing", m)
+	default:
+	}
+
+	// Only the latest sync mapping is kept
+	write("coll2")
+	w.reload()
+	write("coll3")
+	w.reload()
+	select {
+	case m := <-w.reloads:
+		if got := m.Databases[0].Collections[0].Name; got != "coll3" {
+			t.Errorf("reload() sent collection %s, want coll3", got)
+		}
+		if got := m.Exclude; len(got) != 1 || got[0] != defaultStateDatabase {
+			t.Errorf("reload() sent exclude %v, want the state database", got)
+		}
+	default:
+		t.Fatal("reload() sent nothing, want the sync mapping")
+	}
+	if got := w.Mapping().Databases[0].Collections[0].Name; got != "coll3" {
+		t.Errorf("Mapping() collection = %s, want coll3", got)
+	}
+
+	// Changes to the other settings are kept, so that they are compared with the next reload
+	fatalIfErr(t, ioutil.WriteFile(path, []byte(`mongoURL: mongodb://localhost:27017
+elasticURL: http://localhost:9200
+metricsAddress: ":9090"
+databases:
+  - name: db1
+    collections:
+      - name: coll3
+`), 0600))
+	w.reload()
+	if got := w.conf.MetricsAddress; got != ":9090" {
+		t.Errorf("reload() kept metrics address %q, want :9090", got)
+	}
+	select {
+	case m := <-w.reloads:
+		t.Errorf("reload() sent %+v, want nothing", m)
+	default:
+	}
+}
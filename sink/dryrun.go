@@ -0,0 +1,204 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/olivere/elastic"
+)
+
+// Inspector reads the indexes of a cluster without changing them.
+type Inspector interface {
+	// IndexExists returns true if the index or alias exists.
+	IndexExists(ctx context.Context, index string) (bool, error)
+	// Mapping returns the typeless mappings of the index, e.g. {"properties": {...}}.
+	Mapping(ctx context.Context, index string) (map[string]interface{}, error)
+	// IndexNames returns the names of all indexes.
+	IndexNames(ctx context.Context) ([]string, error)
+}
+
+var _ QuerySink = (*DryRun)(nil)
+
+// DryRun is a QuerySink that writes a report of the operations it receives to w instead of performing them.
+// Document operations are reported in the Elasticsearch bulk API format, as NDJSON writes them. Other operations are
+// reported as a single JSON object each, keyed by create_index, mapping_change, update_by_query, delete_by_query or
+// delete_index.
+//
+// If cluster is not nil, index creations are only reported for indexes that do not exist in it, and for existing
+// indexes a mapping_change is reported for each configured field whose mapping differs from the existing one. As
+// existing indexes are never changed, such fields keep their existing mapping until the index is recreated.
+type DryRun struct {
+	mu      sync.Mutex
+	w       io.Writer
+	typed   bool
+	cluster Inspector
+	// ensured is the set of indexes that EnsureIndex has reported
+	ensured map[string]bool
+}
+
+// NewDryRun returns a sink reporting to w the operations it would perform on cluster, which may be nil to report every
+// index creation. If typed is set, the index name is written as the document type of each document operation.
+func NewDryRun(w io.Writer, typed bool, cluster Inspector) *DryRun {
+	return &DryRun{w: w, typed: typed, cluster: cluster, ensured: make(map[string]bool)}
+}
+
+// EnsureIndex reports the creation of the index or, if it exists, the changes to its mappings.
+func (s *DryRun) EnsureIndex(ctx context.Context, index string, body map[string]interface{}) error {
+	s.mu.Lock()
+	ensured := s.ensured[index]
+	s.ensured[index] = true
+	s.mu.Unlock()
+	if ensured {
+		return nil
+	}
+
+	if s.cluster == nil {
+		return s.report("create_index", map[string]interface{}{"_index": index, "body": body})
+	}
+
+	exists, err := s.cluster.IndexExists(ctx, index)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return s.report("create_index", map[string]interface{}{"_index": index, "body": body})
+	}
+
+	configured := properties(body["mappings"])
+	if len(configured) == 0 {
+		return nil
+	}
+
+	current, err := s.cluster.Mapping(ctx, index)
+	if err != nil {
+		return err
+	}
+	existing := properties(current)
+
+	names := make([]string, 0, len(configured))
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if mappingType(existing[name]) == mappingType(configured[name]) {
+			continue
+		}
+		change := map[string]interface{}{"_index": index, "field": name, "current": existing[name], "configured": configured[name]}
+		if err = s.report("mapping_change", change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// properties returns the properties of mappings, or nil if it has none.
+func properties(mappings interface{}) map[string]interface{} {
+	m, _ := mappings.(map[string]interface{})
+	props, _ := m["properties"].(map[string]interface{})
+	return props
+}
+
+// mappingType returns the type of a field mapping. Fields with sub-properties have the type object unless they
+// declare another one, e.g. nested.
+func mappingType(mapping interface{}) interface{} {
+	m, ok := mapping.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if t, ok := m["type"]; ok {
+		return t
+	}
+	if _, ok := m["properties"]; ok {
+		return "object"
+	}
+	return nil
+}
+
+// Index reports an index operation.
+func (s *DryRun) Index(ctx context.Context, index, id, routing string, doc interface{}) error {
+	return s.Bulk(ctx, []Op{{Action: ActionIndex, Index: index, ID: id, Routing: routing, Body: doc}})
+}
+
+// Delete reports a delete operation.
+func (s *DryRun) Delete(ctx context.Context, index, id, routing string) error {
+	return s.Bulk(ctx, []Op{{Action: ActionDelete, Index: index, ID: id, Routing: routing}})
+}
+
+// Bulk reports the operations. The operations are reported together, even if the sink is used concurrently.
+func (s *DryRun) Bulk(ctx context.Context, ops []Op) error {
+	var buf bytes.Buffer
+	if err := EncodeBulk(&buf, ops, s.typed); err != nil {
+		return err
+	}
+	return s.write(buf.Bytes())
+}
+
+// Update reports an update operation with the script.
+func (s *DryRun) Update(ctx context.Context, index, id string, script *elastic.Script) error {
+	src, err := script.Source()
+	if err != nil {
+		return err
+	}
+	return s.Bulk(ctx, []Op{{Action: ActionUpdate, Index: index, ID: id, Body: map[string]interface{}{"script": src}}})
+}
+
+// UpdateByQuery reports an update by query request.
+func (s *DryRun) UpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script) error {
+	querySrc, err := query.Source()
+	if err != nil {
+		return err
+	}
+	scriptSrc, err := script.Source()
+	if err != nil {
+		return err
+	}
+	return s.report("update_by_query", map[string]interface{}{
+		"_index": index,
+		"body":   map[string]interface{}{"query": querySrc, "script": scriptSrc},
+	})
+}
+
+// DeleteByQuery reports a delete by query request.
+func (s *DryRun) DeleteByQuery(ctx context.Context, index string, query elastic.Query) error {
+	src, err := query.Source()
+	if err != nil {
+		return err
+	}
+	return s.report("delete_by_query", map[string]interface{}{"_index": index, "body": map[string]interface{}{"query": src}})
+}
+
+// IndexNames returns the names of the indexes in the cluster, or none if the sink has no cluster.
+func (s *DryRun) IndexNames(ctx context.Context) ([]string, error) {
+	if s.cluster == nil {
+		return nil, nil
+	}
+	return s.cluster.IndexNames(ctx)
+}
+
+// DeleteIndex reports the deletion of the indexes.
+func (s *DryRun) DeleteIndex(ctx context.Context, indexes ...string) error {
+	return s.report("delete_index", map[string]interface{}{"_index": indexes})
+}
+
+// report writes a line with an operation that is not a document operation.
+func (s *DryRun) report(action string, details map[string]interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{action: details}); err != nil {
+		return err
+	}
+	return s.write(buf.Bytes())
+}
+
+// write writes p to w.
+func (s *DryRun) write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(p)
+	return err
+}
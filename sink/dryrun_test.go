@@ -0,0 +1,124 @@
+package sink_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/olivere/elastic"
+
+	"mongo-elastic-sync/sink"
+)
+
+// cluster is an Inspector of a cluster with the given indexes and their mappings.
+type cluster map[string]map[string]interface{}
+
+func (c cluster) IndexExists(ctx context.Context, index string) (bool, error) {
+	_, ok := c[index]
+	return ok, nil
+}
+
+func (c cluster) Mapping(ctx context.Context, index string) (map[string]interface{}, error) {
+	return c[index], nil
+}
+
+func (c cluster) IndexNames(ctx context.Context) ([]string, error) {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func TestDryRun(t *testing.T) {
+	body := map[string]interface{}{
+		"mappings": map[string]interface{}{"properties": map[string]interface{}{
+			"join": map[string]interface{}{"type": "join"},
+			"a":    map[string]interface{}{"type": "keyword"},
+		}},
+	}
+
+	tests := []struct {
+		name    string
+		cluster sink.Inspector
+		want    string
+	}{
+		{
+			name: "without cluster",
+			want: `{"create_index":{"_index":"db.coll1","body":{"mappings":{"properties":{"a":{"type":"keyword"},"join":{"type":"join"}}}}}}
+`,
+		},
+		{
+			name:    "missing index",
+			cluster: cluster{},
+			want: `{"create_index":{"_index":"db.coll1","body":{"mappings":{"properties":{"a":{"type":"keyword"},"join":{"type":"join"}}}}}}
+`,
+		},
+		{
+			name: "changed mappings",
+			cluster: cluster{"db.coll1": {"properties": map[string]interface{}{
+				"a": map[string]interface{}{"type": "text"},
+				"join": map[string]interface{}{
+					"type":                  "join",
+					"eager_global_ordinals": true,
+				},
+			}}},
+			want: `{"mapping_change":{"_index":"db.coll1","configured":{"type":"keyword"},"current":{"type":"text"},"field":"a"}}
+`,
+		},
+		{
+			name: "unmapped field",
+			cluster: cluster{"db.coll1": {"properties": map[string]interface{}{
+				"a": map[string]interface{}{"type": "keyword"},
+			}}},
+			want: `{"mapping_change":{"_index":"db.coll1","configured":{"type":"join"},"current":null,"field":"join"}}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			snk := sink.NewDryRun(&buf, false, tt.cluster)
+
+			// Indexes are only reported once
+			for i := 0; i < 2; i++ {
+				if err := snk.EnsureIndex(context.Background(), "db.coll1", body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("EnsureIndex() wrote %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDryRunOperations(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	snk := sink.NewDryRun(&buf, true, nil)
+
+	ops := []func() error{
+		func() error { return snk.Index(ctx, "db.coll1", "1", "", map[string]interface{}{"a": "1"}) },
+		func() error { return snk.Update(ctx, "db.coll1", "1", elastic.NewScript("ctx._source.a = '2'")) },
+		func() error { return snk.DeleteByQuery(ctx, "db.coll1", elastic.NewTermQuery("a", "2")) },
+		func() error { return snk.DeleteIndex(ctx, "db.coll1", "db.coll2") },
+	}
+	for _, op := range ops {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `{"index":{"_id":"1","_index":"db.coll1","_type":"db.coll1"}}
+{"a":"1"}
+{"update":{"_id":"1","_index":"db.coll1","_type":"db.coll1"}}
+{"script":{"source":"ctx._source.a = '2'"}}
+{"delete_by_query":{"_index":"db.coll1","body":{"query":{"term":{"a":"2"}}}}}
+{"delete_index":{"_index":["db.coll1","db.coll2"]}}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("DryRun wrote %s, want %s", got, want)
+	}
+}
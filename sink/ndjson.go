@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// NDJSON is a Sink that writes operations to w in the Elasticsearch bulk API format, so that they can be loaded into a
+// cluster later with the bulk API. It does not create indexes; create them before loading the operations.
+type NDJSON struct {
+	mu    sync.Mutex
+	w     io.Writer
+	typed bool
+}
+
+// NewNDJSON returns a sink writing to w. If typed is set, the index name is written as the document type of each
+// operation, as Elasticsearch 6.x requires.
+func NewNDJSON(w io.Writer, typed bool) *NDJSON {
+	return &NDJSON{w: w, typed: typed}
+}
+
+// NewStdout returns a sink writing to the standard output.
+func NewStdout(typed bool) *NDJSON {
+	return NewNDJSON(os.Stdout, typed)
+}
+
+// EnsureIndex does nothing, as the bulk format cannot create indexes.
+func (s *NDJSON) EnsureIndex(ctx context.Context, index string, body map[string]interface{}) error {
+	return nil
+}
+
+// Index writes an index operation.
+func (s *NDJSON) Index(ctx context.Context, index, id, routing string, doc interface{}) error {
+	return s.Bulk(ctx, []Op{{Action: ActionIndex, Index: index, ID: id, Routing: routing, Body: doc}})
+}
+
+// Delete writes a delete operation.
+func (s *NDJSON) Delete(ctx context.Context, index, id, routing string) error {
+	return s.Bulk(ctx, []Op{{Action: ActionDelete, Index: index, ID: id, Routing: routing}})
+}
+
+// Bulk writes the operations. The operations are written together, even if the sink is used concurrently.
+func (s *NDJSON) Bulk(ctx context.Context, ops []Op) error {
+	var buf bytes.Buffer
+	if err := EncodeBulk(&buf, ops, s.typed); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// EncodeBulk writes ops to w in the Elasticsearch bulk API format.
+// If typed is set, the index name is written as the document type of each operation.
+func EncodeBulk(w io.Writer, ops []Op, typed bool) error {
+	enc := json.NewEncoder(w)
+	for _, op := range ops {
+		meta := map[string]interface{}{"_index": op.Index, "_id": op.ID}
+		if typed {
+			meta["_type"] = op.Index
+		}
+		if op.Routing != "" {
+			meta["routing"] = op.Routing
+		}
+
+		if err := enc.Encode(map[string]interface{}{op.Action: meta}); err != nil {
+			return err
+		}
+
+		switch op.Action {
+		case ActionIndex, ActionUpdate:
+			if err := enc.Encode(op.Body); err != nil {
+				return fmt.Errorf("encoding document [%s]: %w", op.ID, err)
+			}
+		case ActionDelete:
+		default:
+			return fmt.Errorf("unknown bulk action [%s]", op.Action)
+		}
+	}
+	return nil
+}
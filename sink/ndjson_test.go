@@ -0,0 +1,65 @@
+package sink_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"mongo-elastic-sync/sink"
+)
+
+func TestNDJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		typed bool
+		ops   []sink.Op
+		want  string
+	}{
+		{
+			name: "index",
+			ops:  []sink.Op{{Action: sink.ActionIndex, Index: "db.coll1", ID: "1", Body: map[string]interface{}{"a": "1"}}},
+			want: `{"index":{"_id":"1","_index":"db.coll1"}}
+{"a":"1"}
+`,
+		},
+		{
+			name: "routed delete",
+			ops:  []sink.Op{{Action: sink.ActionDelete, Index: "db.coll1", ID: "1", Routing: "p1"}},
+			want: `{"delete":{"_id":"1","_index":"db.coll1","routing":"p1"}}
+`,
+		},
+		{
+			name:  "typed",
+			typed: true,
+			ops: []sink.Op{
+				{Action: sink.ActionIndex, Index: "db.coll1", ID: "1", Body: map[string]interface{}{"a": "1"}},
+				{Action: sink.ActionUpdate, Index: "db.coll1", ID: "2", Body: map[string]interface{}{"doc": map[string]interface{}{"b": "2"}}},
+			},
+			want: `{"index":{"_id":"1","_index":"db.coll1","_type":"db.coll1"}}
+{"a":"1"}
+{"update":{"_id":"2","_index":"db.coll1","_type":"db.coll1"}}
+{"doc":{"b":"2"}}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := sink.NewNDJSON(&buf, tt.typed).Bulk(context.Background(), tt.ops); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("Bulk() wrote %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNDJSONUnknownAction(t *testing.T) {
+	var buf bytes.Buffer
+	err := sink.NewNDJSON(&buf, false).Bulk(context.Background(), []sink.Op{{Action: "upsert", Index: "db.coll1", ID: "1"}})
+	if err == nil {
+		t.Error("Bulk() expected error for unknown action")
+	}
+}
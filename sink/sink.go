@@ -0,0 +1,79 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/olivere/elastic"
+)
+
+// ErrUnsupported is returned when a sync feature needs an operation that the sink does not support.
+var ErrUnsupported = errors.New("operation not supported by sink")
+
+// Bulk operation actions
+const (
+	ActionIndex  = "index"
+	ActionDelete = "delete"
+	ActionUpdate = "update"
+)
+
+// Op is an operation on a single document, as in an Elasticsearch bulk request.
+// Body is the document for index operations and the update request body (e.g. {"script": ...}) for update
+// operations. Delete operations have no body.
+type Op struct {
+	Action  string
+	Index   string
+	ID      string
+	Routing string
+	Body    interface{}
+}
+
+// Sink receives the documents synced from Mongo.
+type Sink interface {
+	// EnsureIndex creates the index with the given create index request body, which may be nil, if it does not
+	// exist. Mappings in the body are typeless.
+	EnsureIndex(ctx context.Context, index string, body map[string]interface{}) error
+	// Index indexes doc with the given id into the index. If routing is not empty, the document is routed with it.
+	Index(ctx context.Context, index, id, routing string, doc interface{}) error
+	// Delete deletes the document with the given id from the index. It is not an error if the document does not
+	// exist.
+	Delete(ctx context.Context, index, id, routing string) error
+	// Bulk performs the operations in a single request.
+	Bulk(ctx context.Context, ops []Op) error
+}
+
+// QuerySink is a Sink that can also update and delete documents selected by a query, and list and delete indexes.
+// Embedded collections, cascading deletes of joined collections, deletes from routed collections and index retention
+// require a QuerySink.
+type QuerySink interface {
+	Sink
+	// Update updates the document with the given id in the index with a script. Use elastic.IsNotFound to check
+	// whether the document did not exist.
+	Update(ctx context.Context, index, id string, script *elastic.Script) error
+	// UpdateByQuery updates the documents matching query in the index with a script.
+	UpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script) error
+	// DeleteByQuery deletes the documents matching query in the index.
+	DeleteByQuery(ctx context.Context, index string, query elastic.Query) error
+	// IndexNames returns the names of all indexes.
+	IndexNames(ctx context.Context) ([]string, error)
+	// DeleteIndex deletes the given indexes.
+	DeleteIndex(ctx context.Context, indexes ...string) error
+}
+
+// Hit is a document read back from an index.
+type Hit struct {
+	Index   string
+	ID      string
+	Routing string
+	Source  json.RawMessage
+}
+
+// Reader is implemented by sinks whose documents can be read back, which verifying collections requires.
+type Reader interface {
+	// Count returns the number of documents matching query, which may be nil to match all documents, in the index.
+	Count(ctx context.Context, index string, query elastic.Query) (int64, error)
+	// Scan calls fn with each document matching query, which may be nil to match all documents, in the index, in no
+	// particular order. It stops at the first error returned by fn.
+	Scan(ctx context.Context, index string, query elastic.Query, fn func(Hit) error) error
+}
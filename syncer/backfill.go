@@ -0,0 +1,90 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+// Backfill re-syncs the documents of the collection ns whose _id is one of ids or, if ids is empty, that match filter,
+// into every index the collection is synced into, as if they had been replaced. Documents with one of ids that no
+// longer exist in Mongo are deleted from the indexes, as if they had been deleted. Event handlers are not called.
+// It returns the number of documents re-synced and deleted.
+func (s *syncer) Backfill(ctx context.Context, syncMapping config.SyncMapping, ns Namespace, ids []interface{}, filter bson.M) (int, int, error) {
+	if len(ids) > 0 {
+		filter = bson.M{"_id": bson.M{"$in": ids}}
+	}
+	if filter == nil {
+		return 0, 0, errors.New("backfill needs ids or a filter")
+	}
+
+	collectionSyncCommands, err := s.collectionSyncCommands(ctx, syncMapping)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var cmds []collectionSyncCommand
+	for _, cmd := range collectionSyncCommands {
+		if cmd.namespace() == ns {
+			cmds = append(cmds, cmd)
+		}
+	}
+	if len(cmds) == 0 {
+		return 0, 0, fmt.Errorf("collection [%s.%s] is not synced", ns.Database, ns.Collection)
+	}
+
+	cursor, err := s.source.Find(ctx, ns, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer func() { logIfErr(cursor.Close(ctx)) }()
+
+	synced := 0
+	found := make(map[string]bool, len(ids))
+	for cursor.Next(ctx) {
+		var doc map[string]interface{}
+		if err = cursor.Decode(&doc); err != nil {
+			return synced, 0, err
+		}
+
+		id := doc["_id"]
+		found[documentID(id)] = true
+
+		for _, cmd := range cmds {
+			evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeReplace, FullDocument: doc}
+			evt.DocumentKey.ID = id
+			if err = s.on(cmd).applyEvent(ctx, evt, cmd, cmd.indexName()); err != nil {
+				return synced, 0, fmt.Errorf("%s: backfilling document [%s]: %w", cmd, documentID(id), err)
+			}
+		}
+		synced++
+	}
+	if err = cursor.Err(); err != nil {
+		return synced, 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		if found[documentID(id)] {
+			continue
+		}
+
+		for _, cmd := range cmds {
+			evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete}
+			evt.DocumentKey.ID = id
+			if err = s.on(cmd).applyEvent(ctx, evt, cmd, cmd.indexName()); err != nil {
+				return synced, deleted, fmt.Errorf("%s: deleting document [%s]: %w", cmd, documentID(id), err)
+			}
+		}
+		deleted++
+	}
+
+	log.With("database", ns.Database, "collection", ns.Collection, "synced", synced, "deleted", deleted).Info("Completed backfill")
+	return synced, deleted, nil
+}
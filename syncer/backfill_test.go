@@ -0,0 +1,106 @@
+package syncer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+func TestBackfill(t *testing.T) {
+	oid1, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	oid2, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+	deletedID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837e")
+	ns := Namespace{Database: "db1", Collection: "coll1"}
+
+	source := mongo2.NewMemorySource()
+	if err := source.Insert(ns,
+		bson.M{"_id": oid1, "name": "a", "status": "broken"},
+		bson.M{"_id": oid2, "name": "b", "status": "ok"},
+		bson.M{"_id": "key", "name": "c"},
+		bson.M{"_id": int32(42), "name": "d"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := config.SyncMapping{Databases: []config.DatabaseMapping{{
+		Name: "db1",
+		Collections: []config.CollectionMapping{{
+			Name:    "coll1",
+			Fields:  []fields.M{{Name: "name"}},
+			Targets: []config.Target{{Name: "slim", Index: "slim"}},
+		}},
+	}}}
+
+	tests := []struct {
+		name        string
+		ids         []interface{}
+		filter      bson.M
+		wantSynced  int
+		wantDeleted int
+		want        []sink.Op
+	}{
+		{
+			name:        "ids",
+			ids:         []interface{}{oid1, deletedID},
+			wantSynced:  1,
+			wantDeleted: 1,
+			want: []sink.Op{
+				{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid1.Hex(), Body: map[string]interface{}{"id": oid1, "name": "a"}},
+				{Action: sink.ActionIndex, Index: "slim", ID: oid1.Hex(), Body: map[string]interface{}{"id": oid1, "name": "a"}},
+				{Action: sink.ActionDelete, Index: "db1.coll1", ID: deletedID.Hex()},
+				{Action: sink.ActionDelete, Index: "slim", ID: deletedID.Hex()},
+			},
+		},
+		{
+			name:        "typed ids",
+			ids:         []interface{}{"key", int32(42), "deleted"},
+			wantSynced:  2,
+			wantDeleted: 1,
+			want: []sink.Op{
+				{Action: sink.ActionIndex, Index: "db1.coll1", ID: "key", Body: map[string]interface{}{"id": "key", "name": "c"}},
+				{Action: sink.ActionIndex, Index: "slim", ID: "key", Body: map[string]interface{}{"id": "key", "name": "c"}},
+				{Action: sink.ActionIndex, Index: "db1.coll1", ID: "42", Body: map[string]interface{}{"id": int32(42), "name": "d"}},
+				{Action: sink.ActionIndex, Index: "slim", ID: "42", Body: map[string]interface{}{"id": int32(42), "name": "d"}},
+				{Action: sink.ActionDelete, Index: "db1.coll1", ID: "deleted"},
+				{Action: sink.ActionDelete, Index: "slim", ID: "deleted"},
+			},
+		},
+		{
+			name:       "filter",
+			filter:     bson.M{"status": "ok"},
+			wantSynced: 1,
+			want: []sink.Op{
+				{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid2.Hex(), Body: map[string]interface{}{"id": oid2, "name": "b"}},
+				{Action: sink.ActionIndex, Index: "slim", ID: oid2.Hex(), Body: map[string]interface{}{"id": oid2, "name": "b"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snk := &recordingSink{}
+			synced, deleted, err := New(source, snk).Backfill(context.Background(), mapping, ns, tt.ids, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if synced != tt.wantSynced || deleted != tt.wantDeleted {
+				t.Errorf("Backfill() = %d, %d, want %d, %d", synced, deleted, tt.wantSynced, tt.wantDeleted)
+			}
+			if !reflect.DeepEqual(snk.ops, tt.want) {
+				t.Errorf("Backfill() ops = %+v, want %+v", snk.ops, tt.want)
+			}
+		})
+	}
+
+	if _, _, err := New(source, &recordingSink{}).Backfill(context.Background(), mapping, Namespace{Database: "db1", Collection: "other"}, nil, bson.M{}); err == nil {
+		t.Error("Backfill() of a collection that is not synced error = nil, want error")
+	}
+}
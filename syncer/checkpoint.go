@@ -0,0 +1,111 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+// checkpointKey returns the key the resume token of the command's change stream is saved under.
+func checkpointKey(cmd collectionSyncCommand) string {
+	key := indexName(cmd.collMapping.Name, cmd.dbMapping.Name)
+	if cmd.target != "" {
+		key += "/" + cmd.target
+	}
+	return key
+}
+
+// lookupCheckpointKey returns the key the resume token of the change stream of a lookup's foreign collection is saved
+// under.
+func lookupCheckpointKey(cmd collectionSyncCommand, l config.Lookup) string {
+	return checkpointKey(cmd) + "/lookups/" + l.As
+}
+
+// dumpedCheckpointKey returns the key that marks, in transaction mode, that the command's collection was dumped. The
+// collections share the checkpoint of one change stream, which does not tell whether each of them was dumped.
+func dumpedCheckpointKey(cmd collectionSyncCommand) string {
+	return transactionsCheckpointKey + "/dumped/" + checkpointKey(cmd)
+}
+
+// watchOptions returns the options of the change stream whose resume token is saved under key. The change stream
+// starts at the replay position of the syncer, if it has one. Otherwise, it resumes after the saved token or, if there
+// is none, starts at startAt, if it is not nil, or at startUnix.
+func (s syncer) watchOptions(ctx context.Context, key string, startUnix int64, startAt *Position) (mongo2.WatchOptions, error) {
+	if s.replay != nil {
+		return s.replay.watchOptions(), nil
+	}
+
+	opts := mongo2.WatchOptions{StartAtOperationTime: &primitive.Timestamp{T: uint32(startUnix)}}
+	if startAt != nil {
+		opts = startAt.watchOptions()
+	}
+	if s.checkpoints == nil {
+		return opts, nil
+	}
+
+	cp, err := s.checkpoints.Load(ctx, key)
+	if err != nil {
+		return opts, fmt.Errorf("loading checkpoint [%s]: %w", key, err)
+	}
+	if cp.Token != "" {
+		opts = mongo2.WatchOptions{ResumeAfter: cp.Token}
+	}
+	return opts, nil
+}
+
+// saveCheckpoint saves the resume token of evt under key.
+func (s syncer) saveCheckpoint(ctx context.Context, key string, evt mongo2.ChangeStreamEvent) error {
+	if s.checkpoints == nil || evt.ID.Data == "" {
+		return nil
+	}
+
+	if err := s.checkpoints.Save(ctx, key, evt.ID.Data, evt.ClusterTime); err != nil {
+		return fmt.Errorf("saving checkpoint [%s]: %w", key, err)
+	}
+	return nil
+}
+
+// markDumped marks, in transaction mode, that the command's collection was dumped, so that it is resumed from the
+// checkpoint of the shared change stream from then on.
+func (s syncer) markDumped(ctx context.Context, cmd collectionSyncCommand) error {
+	if s.checkpoints == nil || !s.transactions {
+		return nil
+	}
+
+	key := dumpedCheckpointKey(cmd)
+	if err := s.checkpoints.Save(ctx, key, "dumped", time.Now()); err != nil {
+		return fmt.Errorf("saving checkpoint [%s]: %w", key, err)
+	}
+	return nil
+}
+
+// resumable returns true if the change stream the command is tailed in starts at a replay position, a saved resume
+// token or the configured start position of the collection, so that the collection does not need to be dumped.
+// In transaction mode, the collection must also have been dumped before, as collections added since the shared
+// checkpoint was saved were never dumped.
+func (s syncer) resumable(ctx context.Context, cmd collectionSyncCommand) (bool, error) {
+	if s.replay != nil || (cmd.startAt != nil && !s.transactions) {
+		return true, nil
+	}
+
+	key := checkpointKey(cmd)
+	if s.transactions {
+		key = transactionsCheckpointKey
+	}
+
+	opts, err := s.watchOptions(ctx, key, 0, nil)
+	if err != nil || opts.ResumeAfter == "" || !s.transactions {
+		return opts.ResumeAfter != "", err
+	}
+
+	dumped, err := s.checkpoints.Load(ctx, dumpedCheckpointKey(cmd))
+	if err != nil {
+		return false, fmt.Errorf("loading checkpoint [%s]: %w", dumpedCheckpointKey(cmd), err)
+	}
+	return dumped.Token != "", nil
+}
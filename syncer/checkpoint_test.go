@@ -0,0 +1,220 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+func TestTailCollectionCheckpoints(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	ns := Namespace{Database: "db1", Collection: "coll1"}
+
+	event := func(token string, name string) mongo2.ChangeStreamEvent {
+		evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: map[string]interface{}{"_id": oid, "name": name}}
+		evt.ID.Data = token
+		evt.DocumentKey.ID = oid
+		return evt
+	}
+
+	tests := []struct {
+		name      string
+		saved     string
+		want      []sink.Op
+		wantSaved string
+	}{
+		{
+			name: "no checkpoint",
+			want: []sink.Op{
+				{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "name": "a"}},
+				{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "name": "b"}},
+			},
+			wantSaved: "token2",
+		},
+		{
+			name:  "resume after checkpoint",
+			saved: "token1",
+			want: []sink.Op{
+				{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "name": "b"}},
+			},
+			wantSaved: "token2",
+		},
+		{
+			name:      "nothing after checkpoint",
+			saved:     "token2",
+			wantSaved: "token2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := mongo2.NewMemorySource()
+			source.AddEvents(ns, event("token1", "a"), event("token2", "b"))
+
+			checkpoints := mongo2.NewMemoryCheckpoints()
+			cmd := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+			if tt.saved != "" {
+				if err := checkpoints.Save(context.Background(), checkpointKey(cmd), tt.saved, time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			snk := &recordingSink{}
+			s := New(source, snk, WithCheckpoints(checkpoints))
+
+			resume, err := s.resumable(context.Background(), cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.saved != ""; resume != want {
+				t.Errorf("resumable() = %v, want %v", resume, want)
+			}
+
+			if err = s.tailCollection(context.Background(), 0, cmd, make(chan error)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(snk.ops, tt.want) {
+				t.Errorf("tailCollection() ops = %+v, want %+v", snk.ops, tt.want)
+			}
+
+			saved, _ := checkpoints.Load(context.Background(), checkpointKey(cmd))
+			if saved.Token != tt.wantSaved {
+				t.Errorf("saved checkpoint = %s, want %s", saved.Token, tt.wantSaved)
+			}
+		})
+	}
+}
+
+// flakySink is a recordingSink whose first write fails.
+type flakySink struct {
+	recordingSink
+	failed bool
+}
+
+func (s *flakySink) Bulk(ctx context.Context, ops []sink.Op) error {
+	if !s.failed {
+		s.failed = true
+		return errors.New("bulk failed")
+	}
+	return s.recordingSink.Bulk(ctx, ops)
+}
+
+func (s *flakySink) Index(ctx context.Context, index, id, routing string, doc interface{}) error {
+	return s.Bulk(ctx, []sink.Op{{Action: sink.ActionIndex, Index: index, ID: id, Routing: routing, Body: doc}})
+}
+
+func TestTailCheckpointsAfterFailure(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	ns := Namespace{Database: "db1", Collection: "coll1"}
+	cmd := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+	event := func(token string, name string) mongo2.ChangeStreamEvent {
+		evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: map[string]interface{}{"_id": oid, "name": name}}
+		evt.ID.Data = token
+		evt.DocumentKey.ID = oid
+		return evt
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		opts []Option
+		tail func(s *syncer, indexErrs chan error) error
+	}{
+		{
+			name: "collection",
+			key:  checkpointKey(cmd),
+			tail: func(s *syncer, indexErrs chan error) error {
+				return s.tailCollection(context.Background(), 0, cmd, indexErrs)
+			},
+		},
+		{
+			name: "transactions",
+			key:  transactionsCheckpointKey,
+			opts: []Option{WithTransactions()},
+			tail: func(s *syncer, indexErrs chan error) error {
+				return s.tailTransactions(context.Background(), 0, []collectionSyncCommand{cmd}, indexErrs)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := mongo2.NewMemorySource()
+			source.AddEvents(ns, event("token1", "a"), event("token2", "b"))
+
+			checkpoints := mongo2.NewMemoryCheckpoints()
+			snk := &flakySink{}
+			s := New(source, snk, append(tt.opts, WithCheckpoints(checkpoints))...)
+
+			indexErrs := make(chan error, 2)
+			if err := tt.tail(s, indexErrs); err != nil {
+				t.Fatal(err)
+			}
+			if len(indexErrs) != 1 {
+				t.Errorf("tailing reported %d errors, want 1", len(indexErrs))
+			}
+
+			// The later event is applied, but the checkpoint stays before the event that failed
+			want := []sink.Op{
+				{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "name": "b"}},
+			}
+			if !reflect.DeepEqual(snk.ops, want) {
+				t.Errorf("tailing ops = %+v, want %+v", snk.ops, want)
+			}
+			if saved, _ := checkpoints.Load(context.Background(), tt.key); saved.Token != "" {
+				t.Errorf("saved checkpoint = %s, want none", saved.Token)
+			}
+		})
+	}
+}
+
+func TestDumpCommandsTransactions(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	coll1 := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+	coll2 := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll2"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+	source := mongo2.NewMemorySource()
+	for _, cmd := range []collectionSyncCommand{coll1, coll2} {
+		if err := source.Insert(cmd.namespace(), bson.M{"_id": oid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// coll1 was dumped and tailed before coll2 was added to the sync mapping
+	checkpoints := mongo2.NewMemoryCheckpoints()
+	for _, key := range []string{transactionsCheckpointKey, dumpedCheckpointKey(coll1)} {
+		if err := checkpoints.Save(context.Background(), key, "token1", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snk := &recordingSink{}
+	s := New(source, snk, WithTransactions(), WithCheckpoints(checkpoints))
+	if _, err := s.dumpCommands(context.Background(), []collectionSyncCommand{coll1, coll2}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sink.Op{{Action: sink.ActionIndex, Index: "db1.coll2", ID: oid.Hex(), Body: map[string]interface{}{"id": oid}}}
+	if !reflect.DeepEqual(snk.ops, want) {
+		t.Errorf("dumpCommands() ops = %+v, want %+v", snk.ops, want)
+	}
+
+	// Once dumped, coll2 is resumed from the shared checkpoint too
+	resume, err := s.resumable(context.Background(), coll2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resume {
+		t.Error("resumable() = false after dumping, want true")
+	}
+}
@@ -0,0 +1,116 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/olivere/elastic"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+const (
+	// scriptRemoveEmbedded removes the embedded document with id params.id from the array at params.as.
+	scriptRemoveEmbedded = `if (ctx._source[params.as] != null) { ctx._source[params.as].removeIf(c -> c.id == params.id) }`
+	// scriptUpsertEmbedded replaces or adds the embedded document params.doc in the array at params.as.
+	scriptUpsertEmbedded = `if (ctx._source[params.as] == null) { ctx._source[params.as] = [] }
+ctx._source[params.as].removeIf(c -> c.id == params.id);
+ctx._source[params.as].add(params.doc)`
+)
+
+// embedLookup returns the lookup that joins the embedded child collection into its parent's documents.
+func embedLookup(child config.CollectionMapping) config.Lookup {
+	return config.Lookup{
+		From:         child.Name,
+		LocalField:   "_id",
+		ForeignField: child.Embed.ParentField,
+		As:           child.Embed.As,
+		Fields:       child.Fields,
+	}
+}
+
+// linkEmbedded registers each embedded collection in cmds with the command of its parent collection, so that the
+// parent documents are indexed with their children.
+func linkEmbedded(cmds []collectionSyncCommand) error {
+	for _, child := range cmds {
+		if child.collMapping.Embed == nil {
+			continue
+		}
+
+		found := false
+		for i, parent := range cmds {
+			// Children are only embedded into the parent's own index, not into its targets
+			if parent.dbMapping.Name == child.dbMapping.Name && parent.collMapping.Name == child.collMapping.Embed.Parent && parent.target == "" {
+				if parent.router != nil || child.router != nil || parent.collMapping.Index != "" || child.collMapping.Index != "" {
+					return fmt.Errorf("embedded collection [%s] and its parent must be indexed into the default index", child.collMapping.Name)
+				}
+				cmds[i].embedded = append(cmds[i].embedded, child.collMapping)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("parent collection [%s] of embedded collection [%s] is not synced", child.collMapping.Embed.Parent, child.collMapping.Name)
+		}
+	}
+	return nil
+}
+
+// handleEmbeddedEvent applies a change stream event of an embedded child collection to the parent documents in the
+// parent's index with scripted updates. The child is replaced in its current parent with a single scripted update,
+// and only removed from the other parents by query if it was deleted or its parent field may have changed.
+// Children are identified by their _id as the dump embeds it.
+func (s syncer) handleEmbeddedEvent(ctx context.Context, evt mongo2.ChangeStreamEvent, cmd collectionSyncCommand, index string) error {
+	embed := cmd.collMapping.Embed
+	id := evt.DocumentKey.ID
+
+	switch evt.OperationType {
+	case mongo2.ChangeStreamEventOperationTypeInsert, mongo2.ChangeStreamEventOperationTypeReplace, mongo2.ChangeStreamEventOperationTypeUpdate:
+		if evt.FullDocument == nil {
+			return nil
+		}
+
+		parentID, ok := fields.Get(evt.FullDocument, embed.ParentField)
+		if evt.OperationType != mongo2.ChangeStreamEventOperationTypeInsert && evt.Changes(embed.ParentField) {
+			// The child may have been moved from another parent
+			if err := s.removeEmbedded(ctx, index, embed, id, parentID); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			return nil
+		}
+
+		doc, err := fields.Select(evt.FullDocument, cmd.collMapping.Fields)
+		if err != nil {
+			return fmt.Errorf("mapping document [%s]: %w", documentID(id), err)
+		}
+		delete(doc, "_id")
+		doc["id"] = id
+
+		err = s.querySink.Update(ctx, index, documentID(parentID),
+			elastic.NewScript(scriptUpsertEmbedded).Params(map[string]interface{}{"as": embed.As, "id": id, "doc": doc}),
+		)
+		if elastic.IsNotFound(err) {
+			// The parent is not indexed yet. It will include the child when it is.
+			return nil
+		}
+		return err
+	case mongo2.ChangeStreamEventOperationTypeDelete:
+		return s.removeEmbedded(ctx, index, embed, id, nil)
+	}
+	return nil
+}
+
+// removeEmbedded removes the child with id from the parents it is embedded into, except the parent with id except if
+// it is not nil.
+func (s syncer) removeEmbedded(ctx context.Context, index string, embed *config.Embed, id, except interface{}) error {
+	query := elastic.NewBoolQuery().Must(elastic.NewMatchQuery(embed.As+".id", id))
+	if except != nil {
+		query = query.MustNot(elastic.NewIdsQuery().Ids(documentID(except)))
+	}
+	return s.querySink.UpdateByQuery(ctx, index, query,
+		elastic.NewScript(scriptRemoveEmbedded).Params(map[string]interface{}{"as": embed.As, "id": id}),
+	)
+}
@@ -0,0 +1,170 @@
+package syncer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/olivere/elastic"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+// embeddedComments is the mapping of a collection of comments embedded into the documents of posts.
+var embeddedComments = config.CollectionMapping{
+	Name:   "comments",
+	Fields: []fields.M{{Name: "text"}},
+	Embed:  &config.Embed{Parent: "posts", ParentField: "post", As: "comments"},
+}
+
+func TestDumpEmbedded(t *testing.T) {
+	postID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	commentID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+
+	source := mongo2.NewMemorySource()
+	if err := source.Insert(Namespace{Database: "db1", Collection: "posts"}, bson.M{"_id": postID, "title": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Insert(Namespace{Database: "db1", Collection: "comments"},
+		bson.M{"_id": commentID, "post": postID, "text": "b", "author": "c"},
+		bson.M{"_id": primitive.NewObjectID(), "post": primitive.NewObjectID(), "text": "orphan"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	snk := &recordingQuerySink{}
+	mapping := config.SyncMapping{Databases: []config.DatabaseMapping{{
+		Name:        "db1",
+		Collections: []config.CollectionMapping{{Name: "posts"}, embeddedComments},
+	}}}
+	if err := New(source, snk).Dump(context.Background(), mapping); err != nil {
+		t.Fatal(err)
+	}
+
+	// Embedded collections are dumped with their parents, not into indexes of their own
+	want := []sink.Op{{Action: sink.ActionIndex, Index: "db1.posts", ID: postID.Hex(), Body: map[string]interface{}{
+		"id":       postID,
+		"title":    "a",
+		"comments": primitive.A{map[string]interface{}{"id": commentID, "text": "b"}},
+	}}}
+	if !reflect.DeepEqual(snk.ops, want) {
+		t.Errorf("Dump() ops = %+v, want %+v", snk.ops, want)
+	}
+}
+
+func TestHandleEmbeddedEvent(t *testing.T) {
+	postID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	commentID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+
+	// The child is identified by its _id as the dump embeds it
+	remove := func(id interface{}, except *primitive.ObjectID) queryOp {
+		query := elastic.NewBoolQuery().Must(elastic.NewMatchQuery("comments.id", id))
+		if except != nil {
+			query = query.MustNot(elastic.NewIdsQuery().Ids(except.Hex()))
+		}
+		return queryOp{
+			Action: sink.ActionUpdate,
+			Index:  "db1.posts",
+			Query:  sourceJSON(query),
+			Script: sourceJSON(elastic.NewScript(scriptRemoveEmbedded).Params(map[string]interface{}{"as": "comments", "id": id})),
+		}
+	}
+	upsert := func(id interface{}) queryOp {
+		return queryOp{
+			Action: sink.ActionUpdate,
+			Index:  "db1.posts",
+			ID:     postID.Hex(),
+			Script: sourceJSON(elastic.NewScript(scriptUpsertEmbedded).Params(map[string]interface{}{
+				"as":  "comments",
+				"id":  id,
+				"doc": map[string]interface{}{"id": id, "text": "b"},
+			})),
+		}
+	}
+	comment := func(id interface{}) map[string]interface{} {
+		return map[string]interface{}{"_id": id, "post": postID, "text": "b", "author": "c"}
+	}
+	updated := func(fields ...string) *mongo2.UpdateDescription {
+		desc := &mongo2.UpdateDescription{UpdatedFields: map[string]interface{}{}}
+		for _, f := range fields {
+			desc.UpdatedFields[f] = nil
+		}
+		return desc
+	}
+
+	tests := []struct {
+		name string
+		id   interface{}
+		evt  mongo2.ChangeStreamEvent
+		want []queryOp
+	}{
+		{
+			name: "insert",
+			id:   commentID,
+			evt:  mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: comment(commentID)},
+			want: []queryOp{upsert(commentID)},
+		},
+		{
+			name: "insert with int id",
+			id:   int32(7),
+			evt:  mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: comment(int32(7))},
+			want: []queryOp{upsert(int32(7))},
+		},
+		{
+			name: "update",
+			id:   commentID,
+			evt:  mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: comment(commentID), UpdateDescription: updated("text")},
+			want: []queryOp{upsert(commentID)},
+		},
+		{
+			// The child is removed from the other parents it may be embedded into
+			name: "update parent",
+			id:   commentID,
+			evt:  mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: comment(commentID), UpdateDescription: updated("post")},
+			want: []queryOp{remove(commentID, &postID), upsert(commentID)},
+		},
+		{
+			name: "replace",
+			id:   commentID,
+			evt:  mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeReplace, FullDocument: comment(commentID)},
+			want: []queryOp{remove(commentID, &postID), upsert(commentID)},
+		},
+		{
+			name: "update without parent",
+			id:   commentID,
+			evt:  mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: map[string]interface{}{"_id": commentID, "text": "b"}},
+			want: []queryOp{remove(commentID, nil)},
+		},
+		{
+			name: "delete",
+			id:   commentID,
+			evt:  mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete},
+			want: []queryOp{remove(commentID, nil)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snk := &recordingQuerySink{}
+			s := New(nil, snk)
+			cmd := collectionSyncCommand{collMapping: embeddedComments, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+			evt := tt.evt
+			evt.DocumentKey.ID = tt.id
+			if err := s.handleStreamEvent(context.Background(), evt, cmd, cmd.indexName()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(snk.queryOps, tt.want) {
+				t.Errorf("handleStreamEvent() query ops = %+v, want %+v", snk.queryOps, tt.want)
+			}
+			if len(snk.ops) != 0 {
+				t.Errorf("handleStreamEvent() ops = %+v, want none", snk.ops)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/lease"
+)
+
+// SyncGroup synchronizes MongoDB and Elasticsearch like Sync, sharing the collections with the other workers of group.
+// Each collection is synced by one worker at a time. When a collection moves to another worker, the new worker resumes
+// tailing from the collection's saved resume token, so the syncer should be configured with checkpoints.
+func (s *syncer) SyncGroup(ctx context.Context, syncMapping config.SyncMapping, group lease.Group) error {
+	if s.transactions {
+		return errors.New("transactions are tailed in one change stream, which cannot be shared among workers")
+	}
+
+	collectionSyncCommands, err := s.collectionSyncCommands(ctx, syncMapping)
+	if err != nil {
+		return err
+	}
+
+	keys, units := workUnits(collectionSyncCommands)
+	return group.Run(ctx, keys, func(ctx context.Context, key string) error {
+		return s.syncCommands(ctx, units[key])
+	})
+}
+
+// workUnits groups cmds into the units of work that are shared among the workers of a group, by key.
+// Embedded and joined child collections are synced with their parent collection, as they share its index.
+func workUnits(cmds []collectionSyncCommand) ([]string, map[string][]collectionSyncCommand) {
+	var keys []string
+	units := make(map[string][]collectionSyncCommand)
+	for _, cmd := range cmds {
+		key := checkpointKey(cmd)
+		switch {
+		case cmd.collMapping.Embed != nil:
+			key = indexName(cmd.collMapping.Embed.Parent, cmd.dbMapping.Name)
+		case cmd.collMapping.Join != nil && cmd.collMapping.Join.Parent != "":
+			key = indexName(cmd.collMapping.Join.Parent, cmd.dbMapping.Name)
+		}
+
+		if _, ok := units[key]; !ok {
+			keys = append(keys, key)
+		}
+		units[key] = append(units[key], cmd)
+	}
+	return keys, units
+}
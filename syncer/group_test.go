@@ -0,0 +1,41 @@
+package syncer
+
+import (
+	"reflect"
+	"testing"
+
+	"mongo-elastic-sync/config"
+)
+
+func TestWorkUnits(t *testing.T) {
+	db := config.DatabaseMapping{Name: "db1"}
+	cmds := []collectionSyncCommand{
+		{collMapping: config.CollectionMapping{Name: "posts"}, dbMapping: db},
+		{collMapping: config.CollectionMapping{Name: "posts"}, dbMapping: db, target: "slim"},
+		{collMapping: config.CollectionMapping{Name: "comments", Embed: &config.Embed{Parent: "posts"}}, dbMapping: db},
+		{collMapping: config.CollectionMapping{Name: "questions", Join: &config.Join{Relation: "question"}}, dbMapping: db},
+		{collMapping: config.CollectionMapping{Name: "answers", Join: &config.Join{Relation: "answer", Parent: "questions"}}, dbMapping: db},
+	}
+
+	keys, units := workUnits(cmds)
+
+	wantKeys := []string{"db1.posts", "db1.posts/slim", "db1.questions"}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("workUnits() keys = %v, want %v", keys, wantKeys)
+	}
+
+	wantUnits := map[string][]string{
+		"db1.posts":      {"posts", "comments"},
+		"db1.posts/slim": {"posts"},
+		"db1.questions":  {"questions", "answers"},
+	}
+	for key, want := range wantUnits {
+		var got []string
+		for _, cmd := range units[key] {
+			got = append(got, cmd.collMapping.Name)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("workUnits() unit [%s] = %v, want %v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/olivere/elastic"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+)
+
+// linkJoined registers the relation name of each joined child collection in cmds with the command of its parent
+// collection, so that the parent can create the join field mapping of the shared index.
+func linkJoined(cmds []collectionSyncCommand) error {
+	for _, child := range cmds {
+		j := child.collMapping.Join
+		if j == nil || j.Parent == "" {
+			continue
+		}
+
+		found := false
+		for i, parent := range cmds {
+			if parent.dbMapping.Name == child.dbMapping.Name && parent.collMapping.Name == j.Parent {
+				if parent.router != nil || child.router != nil || parent.collMapping.Index != "" || child.collMapping.Index != "" {
+					return fmt.Errorf("joined collection [%s] and its parent must be indexed into the default index", child.collMapping.Name)
+				}
+				if parent.collMapping.Join == nil || parent.collMapping.Join.Field != j.Field {
+					return fmt.Errorf("parent collection [%s] of joined collection [%s] must have join field [%s]", j.Parent, child.collMapping.Name, j.Field)
+				}
+				cmds[i].joinChildren = append(cmds[i].joinChildren, j.Relation)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("parent collection [%s] of joined collection [%s] is not synced", j.Parent, child.collMapping.Name)
+		}
+	}
+	return nil
+}
+
+// joinMapping returns the body of the create index request that maps the join field of a parent collection,
+// or nil if the collection has no joined children.
+func (c collectionSyncCommand) joinMapping() map[string]interface{} {
+	if len(c.joinChildren) == 0 {
+		return nil
+	}
+
+	j := c.collMapping.Join
+	return map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"properties": map[string]interface{}{
+				j.Field: map[string]interface{}{
+					"type":      "join",
+					"relations": map[string]interface{}{j.Relation: c.joinChildren},
+				},
+			},
+		},
+	}
+}
+
+// routing returns the routing of doc in the collection's index. Joined child documents are routed with the id of their
+// parent; other documents use the default routing.
+func (c collectionSyncCommand) routing(doc map[string]interface{}) string {
+	j := c.collMapping.Join
+	if j == nil || j.Parent == "" {
+		return ""
+	}
+	if parentID, ok := fields.Get(doc, j.ParentField); ok {
+		return documentID(parentID)
+	}
+	return ""
+}
+
+// joinValue returns the value of the join field for doc.
+func joinValue(j *config.Join, doc map[string]interface{}) interface{} {
+	if j.Parent == "" {
+		return j.Relation
+	}
+
+	parentID, _ := fields.Get(doc, j.ParentField)
+	return map[string]interface{}{"name": j.Relation, "parent": documentID(parentID)}
+}
+
+// deleteMovedChild deletes the copies of the joined child document with the given id that are not routed with
+// routing, the id of its current parent. They remain in the shards of its former parents when the field that holds
+// the parent is updated. Update events carry no previous version of the document, so the copies are found by id and
+// routing across all shards. It is only called for events that may have changed the parent field.
+func (s syncer) deleteMovedChild(ctx context.Context, index string, id string, routing string) error {
+	query := elastic.NewBoolQuery().Must(elastic.NewIdsQuery().Ids(id))
+	if routing != "" {
+		query.MustNot(elastic.NewTermQuery("_routing", routing))
+	} else {
+		query.Must(elastic.NewExistsQuery("_routing"))
+	}
+
+	if err := s.querySink.DeleteByQuery(ctx, index, query); err != nil {
+		return fmt.Errorf("deleting moved copies of [%s]: %w", id, err)
+	}
+	return nil
+}
+
+// deleteJoinedDocument deletes a document of a joined collection given its document key, as delete events carry no
+// document. Child documents are routed by their parent field, which is only in the document key if it is part of the
+// shard key; otherwise, they are found by id across all shards. If the collection is a parent collection with
+// CascadeDelete set, the children of the document are deleted too.
+func (s syncer) deleteJoinedDocument(ctx context.Context, cmd collectionSyncCommand, index string, documentKey map[string]interface{}) error {
+	id := documentID(documentKey["_id"])
+
+	j := cmd.collMapping.Join
+	if j.Parent != "" {
+		if routing := cmd.routing(documentKey); routing != "" {
+			return s.deleteDocument(ctx, index, id, routing)
+		}
+		return s.querySink.DeleteByQuery(ctx, index, elastic.NewIdsQuery().Ids(id))
+	}
+
+	if err := s.deleteDocument(ctx, index, id, ""); err != nil {
+		return err
+	}
+
+	if !j.CascadeDelete {
+		return nil
+	}
+
+	for _, relation := range cmd.joinChildren {
+		if err := s.querySink.DeleteByQuery(ctx, index, elastic.NewParentIdQuery(relation, id)); err != nil {
+			return fmt.Errorf("deleting [%s] children of [%s]: %w", relation, id, err)
+		}
+	}
+	return nil
+}
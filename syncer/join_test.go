@@ -0,0 +1,141 @@
+package syncer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/olivere/elastic"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+var (
+	joinedQuestions = config.CollectionMapping{Name: "questions", Join: &config.Join{Field: "qa", Relation: "question", CascadeDelete: true}}
+	joinedAnswers   = config.CollectionMapping{Name: "answers", Join: &config.Join{Field: "qa", Relation: "answer", Parent: "questions", ParentField: "question"}}
+)
+
+func TestLinkJoined(t *testing.T) {
+	db := config.DatabaseMapping{Name: "db1"}
+	cmds := []collectionSyncCommand{{collMapping: joinedQuestions, dbMapping: db}, {collMapping: joinedAnswers, dbMapping: db}}
+	if err := linkJoined(cmds); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{"mappings": map[string]interface{}{"properties": map[string]interface{}{
+		"qa": map[string]interface{}{"type": "join", "relations": map[string]interface{}{"question": []string{"answer"}}},
+	}}}
+	if got := cmds[0].joinMapping(); !reflect.DeepEqual(got, want) {
+		t.Errorf("joinMapping() = %v, want %v", got, want)
+	}
+	if got := cmds[1].indexName(); got != "db1.questions" {
+		t.Errorf("indexName() = %s, want db1.questions", got)
+	}
+
+	if err := linkJoined([]collectionSyncCommand{{collMapping: joinedAnswers, dbMapping: db}}); err == nil {
+		t.Error("linkJoined() expected error for a child whose parent is not synced")
+	}
+}
+
+func TestHandleJoinedEvent(t *testing.T) {
+	questionID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	answerID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+	parentID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837e")
+	parent := parentID.Hex()
+
+	answer := map[string]interface{}{"_id": answerID, "question": parentID, "text": "a"}
+	indexAnswer := sink.Op{Action: sink.ActionIndex, Index: "db1.questions", ID: answerID.Hex(), Routing: parent, Body: map[string]interface{}{
+		"id":       answerID,
+		"question": parentID,
+		"text":     "a",
+		"qa":       map[string]interface{}{"name": "answer", "parent": parent},
+	}}
+
+	tests := []struct {
+		name        string
+		collMapping config.CollectionMapping
+		evt         mongo2.ChangeStreamEvent
+		id          primitive.ObjectID
+		want        []sink.Op
+		wantQuery   []queryOp
+	}{
+		{
+			name:        "insert child",
+			collMapping: joinedAnswers,
+			evt:         mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: answer},
+			id:          answerID,
+			want:        []sink.Op{indexAnswer},
+		},
+		{
+			name:        "update child",
+			collMapping: joinedAnswers,
+			evt:         mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: answer},
+			id:          answerID,
+			want:        []sink.Op{indexAnswer},
+			// The copy routed with the previous parent, if the parent changed, is deleted
+			wantQuery: []queryOp{{
+				Action: sink.ActionDelete,
+				Index:  "db1.questions",
+				Query:  sourceJSON(elastic.NewBoolQuery().Must(elastic.NewIdsQuery().Ids(answerID.Hex())).MustNot(elastic.NewTermQuery("_routing", parent))),
+			}},
+		},
+		{
+			// The child cannot have moved if its parent field was not updated
+			name:        "update child text",
+			collMapping: joinedAnswers,
+			evt: mongo2.ChangeStreamEvent{
+				OperationType:     mongo2.ChangeStreamEventOperationTypeUpdate,
+				FullDocument:      answer,
+				UpdateDescription: &mongo2.UpdateDescription{UpdatedFields: map[string]interface{}{"text": "a"}},
+			},
+			id:   answerID,
+			want: []sink.Op{indexAnswer},
+		},
+		{
+			name:        "delete child",
+			collMapping: joinedAnswers,
+			evt:         mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete},
+			id:          answerID,
+			wantQuery:   []queryOp{{Action: sink.ActionDelete, Index: "db1.questions", Query: sourceJSON(elastic.NewIdsQuery().Ids(answerID.Hex()))}},
+		},
+		{
+			name:        "delete parent",
+			collMapping: joinedQuestions,
+			evt:         mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete},
+			id:          questionID,
+			want:        []sink.Op{{Action: sink.ActionDelete, Index: "db1.questions", ID: questionID.Hex()}},
+			wantQuery:   []queryOp{{Action: sink.ActionDelete, Index: "db1.questions", Query: sourceJSON(elastic.NewParentIdQuery("answer", questionID.Hex()))}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snk := &recordingQuerySink{}
+			s := New(nil, snk)
+			db := config.DatabaseMapping{Name: "db1"}
+			cmds := []collectionSyncCommand{{collMapping: joinedQuestions, dbMapping: db}, {collMapping: joinedAnswers, dbMapping: db}}
+			if err := linkJoined(cmds); err != nil {
+				t.Fatal(err)
+			}
+			cmd := cmds[0]
+			if tt.collMapping.Name == joinedAnswers.Name {
+				cmd = cmds[1]
+			}
+
+			evt := tt.evt
+			evt.DocumentKey.ID = tt.id
+			if err := s.handleStreamEvent(context.Background(), evt, cmd, cmd.indexName()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(snk.ops, tt.want) {
+				t.Errorf("handleStreamEvent() ops = %+v, want %+v", snk.ops, tt.want)
+			}
+			if !reflect.DeepEqual(snk.queryOps, tt.wantQuery) {
+				t.Errorf("handleStreamEvent() query ops = %+v, want %+v", snk.queryOps, tt.wantQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/olivere/elastic"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+// lookupPipeline returns an aggregation pipeline that joins the given lookups into each document of a collection.
+func lookupPipeline(lookups []config.Lookup) []bson.M {
+	pipeline := make([]bson.M, 0, len(lookups))
+	for _, l := range lookups {
+		pipeline = append(pipeline, bson.M{"$lookup": bson.M{
+			"from":         l.From,
+			"localField":   l.LocalField,
+			"foreignField": l.ForeignField,
+			"as":           l.As,
+		}})
+	}
+	return pipeline
+}
+
+// lookupDocument joins the lookups of the collection into doc by querying the foreign collections.
+// It does the same work as lookupPipeline for a single document received from the change stream.
+func (s syncer) lookupDocument(ctx context.Context, cmd collectionSyncCommand, doc map[string]interface{}) error {
+	for _, l := range cmd.lookups() {
+		local, _ := fields.Get(doc, l.LocalField)
+
+		cursor, err := s.source.Find(ctx, Namespace{Database: cmd.dbMapping.Name, Collection: l.From}, lookupFilter(l.ForeignField, local))
+		if err != nil {
+			return fmt.Errorf("looking up [%s]: %w", l.From, err)
+		}
+
+		as := primitive.A{}
+		for cursor.Next(ctx) {
+			var joined map[string]interface{}
+			if err = cursor.Decode(&joined); err != nil {
+				break
+			}
+			as = append(as, joined)
+		}
+		if err == nil {
+			err = cursor.Err()
+		}
+		logIfErr(cursor.Close(ctx))
+		if err != nil {
+			return fmt.Errorf("looking up [%s]: %w", l.From, err)
+		}
+
+		doc[l.As] = as
+	}
+
+	return selectLookupFields(doc, cmd.lookups())
+}
+
+// selectLookupFields applies the field mappings of each lookup to the joined documents in doc.
+// As in indexed documents, the _id field of joined documents is always kept and renamed to id.
+func selectLookupFields(doc map[string]interface{}, lookups []config.Lookup) error {
+	for _, l := range lookups {
+		joined, ok := doc[l.As].(primitive.A)
+		if !ok {
+			continue
+		}
+
+		for i, j := range joined {
+			jAsMap, ok := j.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			selected, err := fields.Select(jAsMap, l.Fields)
+			if err != nil {
+				return fmt.Errorf("mapping lookup [%s]: %w", l.As, err)
+			}
+			if id, ok := jAsMap["_id"]; ok {
+				delete(selected, "_id")
+				selected["id"] = id
+			}
+			joined[i] = selected
+		}
+	}
+	return nil
+}
+
+// lookupFilter returns a filter matching documents whose field equals value, or any of value's elements if value is
+// an array, as a $lookup stage does.
+func lookupFilter(field string, value interface{}) bson.M {
+	switch v := value.(type) {
+	case primitive.A:
+		return bson.M{field: bson.M{"$in": v}}
+	case []interface{}:
+		return bson.M{field: bson.M{"$in": v}}
+	}
+	return bson.M{field: value}
+}
+
+// tailLookup watches for changes on the foreign collection of a lookup and re-indexes the documents of the
+// collection that reference the changed document, before and after the change.
+// Change events only carry the current foreign document, and delete events carry none, so unless the lookup's foreign
+// field is _id, the documents that referenced the foreign document before the change are found in the index by the
+// id of their joined copy of it. Sinks that cannot be read back only re-index the documents referencing it after the
+// change.
+func (s syncer) tailLookup(ctx context.Context, startUnix int64, cmd collectionSyncCommand, l config.Lookup, indexErrs chan<- error) error {
+	key := lookupCheckpointKey(cmd, l)
+	opts, err := s.watchOptions(ctx, key, startUnix, cmd.startAt)
+	if err != nil {
+		return err
+	}
+
+	stream, err := s.source.Watch(ctx, Namespace{Database: cmd.dbMapping.Name, Collection: l.From}, opts)
+	if err != nil {
+		return fmt.Errorf("starting change stream %s: %w", opts, err)
+	}
+
+	defer func() { logIfErr(stream.Close(ctx)) }()
+
+	index := cmd.indexName()
+
+	log := log.With(
+		"collection", cmd.collMapping.Name,
+		"database", cmd.dbMapping.Name,
+		"lookup", l.From,
+		"index", index,
+		"action", "tailing",
+	)
+
+	log.Info("Listening for new lookup events")
+
+	// failed is set once an event fails to apply, after which the checkpoint is no longer saved, as in tailCollection
+	failed := false
+
+	for stream.Next(ctx) {
+		evt := mongo2.ChangeStreamEvent{}
+		if err = stream.Decode(&evt); err != nil {
+			indexErrs <- fmt.Errorf("lookup [%s]: %w", l.From, err)
+			continue
+		}
+
+		// values are the values of the local field whose dependents are re-indexed, and former is set if the
+		// documents that joined the previous version of the foreign document are re-indexed too
+		var values []interface{}
+		former := false
+		switch evt.OperationType {
+		case mongo2.ChangeStreamEventOperationTypeInsert, mongo2.ChangeStreamEventOperationTypeReplace, mongo2.ChangeStreamEventOperationTypeUpdate:
+			if evt.FullDocument == nil {
+				// The document was deleted before its update could be looked up. The delete event will follow.
+				break
+			}
+			value, _ := fields.Get(evt.FullDocument, l.ForeignField)
+			values = append(values, value)
+			former = evt.OperationType != mongo2.ChangeStreamEventOperationTypeInsert && l.ForeignField != "_id"
+		case mongo2.ChangeStreamEventOperationTypeDelete:
+			if l.ForeignField == "_id" {
+				values = append(values, evt.DocumentKey.ID)
+			} else {
+				former = true
+			}
+		}
+
+		if len(values) > 0 || former {
+			log.With("eventType", evt.OperationType).Info("Re-indexing dependent documents")
+		}
+
+		synced := make(map[string]bool)
+		for _, value := range values {
+			if value == nil {
+				continue
+			}
+			if err = s.syncDependents(ctx, cmd, index, lookupFilter(l.LocalField, value), synced); err != nil {
+				indexErrs <- fmt.Errorf("lookup [%s]: %w", l.From, err)
+				failed = true
+			}
+		}
+		if former {
+			if err = s.syncFormerDependents(ctx, cmd, index, l, evt.DocumentKey.ID, synced); err != nil {
+				indexErrs <- fmt.Errorf("lookup [%s]: %w", l.From, err)
+				failed = true
+			}
+		}
+		if failed {
+			continue
+		}
+
+		if err = s.saveCheckpoint(ctx, key, evt); err != nil {
+			indexErrs <- fmt.Errorf("lookup [%s]: %w", l.From, err)
+		}
+	}
+
+	// stream died, return deadline/cursor error
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return stream.Err()
+}
+
+// syncFormerDependents re-syncs the documents of the collection whose indexed copy joined the foreign document with
+// id, that were not synced yet. It does nothing if the sink cannot be read back.
+func (s syncer) syncFormerDependents(ctx context.Context, cmd collectionSyncCommand, index string, l config.Lookup, id interface{}, synced map[string]bool) error {
+	reader, ok := s.sink.(sink.Reader)
+	if !ok {
+		return nil
+	}
+
+	ids := bson.A{}
+	err := reader.Scan(ctx, index, elastic.NewTermQuery(l.As+".id", documentID(id)), func(hit sink.Hit) error {
+		if !synced[hit.ID] {
+			ids = append(ids, indexedIDs(hit.ID)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading dependents: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.syncDependents(ctx, cmd, index, bson.M{"_id": bson.M{"$in": ids}}, synced)
+}
+
+// syncDependents re-syncs the documents of the collection matching filter that were not synced yet, and adds their ids
+// to synced.
+func (s syncer) syncDependents(ctx context.Context, cmd collectionSyncCommand, index string, filter bson.M, synced map[string]bool) error {
+	cursor, err := s.source.Find(ctx, cmd.namespace(), filter)
+	if err != nil {
+		return err
+	}
+
+	defer func() { logIfErr(cursor.Close(ctx)) }()
+
+	for cursor.Next(ctx) {
+		var doc map[string]interface{}
+		if err = cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		id := documentID(doc["_id"])
+		if synced[id] {
+			continue
+		}
+		if err = s.syncDocument(ctx, cmd, index, doc); err != nil {
+			return err
+		}
+		synced[id] = true
+	}
+	return cursor.Err()
+}
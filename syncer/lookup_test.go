@@ -0,0 +1,209 @@
+package syncer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/olivere/elastic"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+func TestLookupDocument(t *testing.T) {
+	postID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	authorID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+	tagID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837e")
+
+	source := mongo2.NewMemorySource()
+	if err := source.Insert(Namespace{Database: "db1", Collection: "authors"}, bson.M{"_id": authorID, "email": "a@example.com", "name": "a", "password": "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Insert(Namespace{Database: "db1", Collection: "tags"}, bson.M{"_id": tagID, "name": "go"}); err != nil {
+		t.Fatal(err)
+	}
+
+	snk := &recordingSink{}
+	s := New(source, snk)
+	cmd := collectionSyncCommand{
+		collMapping: config.CollectionMapping{
+			Name:   "posts",
+			Fields: []fields.M{{Name: "title"}},
+			Lookups: []config.Lookup{
+				{From: "authors", LocalField: "author", ForeignField: "email", As: "authors", Fields: []fields.M{{Name: "name"}}},
+				{From: "tags", LocalField: "tags", ForeignField: "_id", As: "tags"},
+			},
+		},
+		dbMapping: config.DatabaseMapping{Name: "db1"},
+	}
+
+	doc := map[string]interface{}{"_id": postID, "title": "a", "author": "a@example.com", "tags": primitive.A{tagID, primitive.NewObjectID()}}
+	if err := s.syncDocument(context.Background(), cmd, cmd.indexName(), doc); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sink.Op{{Action: sink.ActionIndex, Index: "db1.posts", ID: postID.Hex(), Body: map[string]interface{}{
+		"id":      postID,
+		"title":   "a",
+		"authors": primitive.A{map[string]interface{}{"id": authorID, "name": "a"}},
+		"tags":    primitive.A{map[string]interface{}{"id": tagID, "name": "go"}},
+	}}}
+	if !reflect.DeepEqual(snk.ops, want) {
+		t.Errorf("syncDocument() ops = %+v, want %+v", snk.ops, want)
+	}
+}
+
+// joinedSink is a recordingSink whose index holds the documents that joined each foreign document.
+type joinedSink struct {
+	recordingSink
+	// joined are the ids of the indexed documents that joined each foreign document, by foreign document id
+	joined map[string][]string
+}
+
+func (s *joinedSink) Count(ctx context.Context, index string, query elastic.Query) (int64, error) {
+	return 0, nil
+}
+
+func (s *joinedSink) Scan(ctx context.Context, index string, query elastic.Query, fn func(sink.Hit) error) error {
+	src, err := query.Source()
+	if err != nil {
+		return err
+	}
+	for _, value := range src.(map[string]interface{})["term"].(map[string]interface{}) {
+		for _, id := range s.joined[value.(string)] {
+			if err = fn(sink.Hit{Index: index, ID: id}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestTailLookup(t *testing.T) {
+	authorA, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837a")
+	authorB, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837b")
+	authorC, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	authors := Namespace{Database: "db1", Collection: "authors"}
+
+	update := func(id primitive.ObjectID, doc map[string]interface{}) mongo2.ChangeStreamEvent {
+		evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: doc}
+		evt.DocumentKey.ID = id
+		return evt
+	}
+	deleted := func(id primitive.ObjectID) mongo2.ChangeStreamEvent {
+		evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete}
+		evt.DocumentKey.ID = id
+		return evt
+	}
+
+	byEmail := config.Lookup{From: "authors", LocalField: "author", ForeignField: "email", As: "authors"}
+	byEmailPosts := []bson.M{
+		{"_id": "a", "title": "a", "author": "a@example.com"},
+		{"_id": "b1", "title": "b before", "author": "b@example.com"},
+		{"_id": "b2", "title": "b after", "author": "b2@example.com"},
+		{"_id": "c", "title": "c", "author": "c@example.com"},
+		{"_id": "d", "title": "unrelated", "author": "d@example.com"},
+	}
+	byEmailEvents := []mongo2.ChangeStreamEvent{
+		update(authorA, map[string]interface{}{"_id": authorA, "email": "a@example.com", "name": "renamed"}),
+		// Posts that referenced the previous email are re-indexed too
+		update(authorB, map[string]interface{}{"_id": authorB, "email": "b2@example.com"}),
+		// The document was deleted before the update could be looked up
+		update(authorC, nil),
+		deleted(authorC),
+	}
+	// The indexed posts hold the joined author they referenced before the events
+	joined := map[string][]string{authorA.Hex(): {"a"}, authorB.Hex(): {"b1"}, authorC.Hex(): {"c"}}
+
+	tests := []struct {
+		name   string
+		lookup config.Lookup
+		posts  []bson.M
+		events []mongo2.ChangeStreamEvent
+		// joined are the posts that joined each author in the index, or nil if the sink cannot be read back
+		joined map[string][]string
+		// want are the titles of the posts re-indexed, in order
+		want []string
+	}{
+		{
+			name:   "foreign field",
+			lookup: byEmail,
+			posts:  byEmailPosts,
+			events: byEmailEvents,
+			joined: joined,
+			want:   []string{"a", "b after", "b before", "c"},
+		},
+		{
+			// Only the posts that reference the current version of an author are found
+			name:   "foreign field unreadable sink",
+			lookup: byEmail,
+			posts:  byEmailPosts,
+			events: byEmailEvents,
+			want:   []string{"a", "b after"},
+		},
+		{
+			name:   "foreign id",
+			lookup: config.Lookup{From: "authors", LocalField: "author", ForeignField: "_id", As: "authors"},
+			posts: []bson.M{
+				{"_id": "a", "title": "a", "author": authorA},
+				{"_id": "c", "title": "c", "author": authorC},
+			},
+			events: []mongo2.ChangeStreamEvent{
+				update(authorA, map[string]interface{}{"_id": authorA, "name": "renamed"}),
+				deleted(authorC),
+			},
+			want: []string{"a", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := mongo2.NewMemorySource()
+			if err := source.Insert(authors,
+				bson.M{"_id": authorA, "email": "a@example.com"},
+				bson.M{"_id": authorB, "email": "b@example.com"},
+				bson.M{"_id": authorC, "email": "c@example.com"},
+			); err != nil {
+				t.Fatal(err)
+			}
+			for _, post := range tt.posts {
+				if err := source.Insert(Namespace{Database: "db1", Collection: "posts"}, post); err != nil {
+					t.Fatal(err)
+				}
+			}
+			source.AddEvents(authors, tt.events...)
+
+			recording := &recordingSink{}
+			var snk sink.Sink = recording
+			if tt.joined != nil {
+				js := &joinedSink{joined: tt.joined}
+				recording, snk = &js.recordingSink, js
+			}
+			s := New(source, snk)
+			cmd := collectionSyncCommand{
+				collMapping: config.CollectionMapping{Name: "posts", Lookups: []config.Lookup{tt.lookup}},
+				dbMapping:   config.DatabaseMapping{Name: "db1"},
+			}
+
+			if err := s.tailLookup(context.Background(), 0, cmd, tt.lookup, make(chan error)); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, op := range recording.ops {
+				if op.Action != sink.ActionIndex || op.Index != "db1.posts" {
+					t.Errorf("tailLookup() op = %+v, want an index operation into db1.posts", op)
+				}
+				got = append(got, op.Body.(map[string]interface{})["title"].(string))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tailLookup() re-indexed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+// ErrSkipEvent may be returned by an EventHandler to stop the syncer from applying the default action for an event.
+var ErrSkipEvent = errors.New("skip event")
+
+// Namespace identifies a Mongo collection.
+type Namespace = mongo2.Namespace
+
+// Filter decides whether a document should be synced into Elasticsearch.
+// It is called with the full Mongo document, before field selection.
+type Filter interface {
+	Include(ctx context.Context, ns Namespace, doc map[string]interface{}) (bool, error)
+}
+
+// FilterFunc is an adapter to allow the use of ordinary functions as filters.
+type FilterFunc func(ctx context.Context, ns Namespace, doc map[string]interface{}) (bool, error)
+
+// Include calls f(ctx, ns, doc).
+func (f FilterFunc) Include(ctx context.Context, ns Namespace, doc map[string]interface{}) (bool, error) {
+	return f(ctx, ns, doc)
+}
+
+// Transformer modifies a document before it is indexed.
+// It is called with the document returned by fields.Select. Returning a nil document excludes it like a filter.
+type Transformer interface {
+	Transform(ctx context.Context, ns Namespace, doc map[string]interface{}) (map[string]interface{}, error)
+}
+
+// TransformerFunc is an adapter to allow the use of ordinary functions as transformers.
+type TransformerFunc func(ctx context.Context, ns Namespace, doc map[string]interface{}) (map[string]interface{}, error)
+
+// Transform calls f(ctx, ns, doc).
+func (f TransformerFunc) Transform(ctx context.Context, ns Namespace, doc map[string]interface{}) (map[string]interface{}, error) {
+	return f(ctx, ns, doc)
+}
+
+// EventHandler is notified of every change stream event before the syncer handles it.
+// Returning ErrSkipEvent stops the default handling of the event; any other error is reported as a tailing error.
+type EventHandler interface {
+	HandleEvent(ctx context.Context, evt mongo2.ChangeStreamEvent) error
+}
+
+// EventHandlerFunc is an adapter to allow the use of ordinary functions as event handlers.
+type EventHandlerFunc func(ctx context.Context, evt mongo2.ChangeStreamEvent) error
+
+// HandleEvent calls f(ctx, evt).
+func (f EventHandlerFunc) HandleEvent(ctx context.Context, evt mongo2.ChangeStreamEvent) error {
+	return f(ctx, evt)
+}
+
+// Option configures a syncer.
+type Option func(*syncer)
+
+// WithFilter adds a filter to the syncer. Documents are only indexed if every filter includes them.
+func WithFilter(f Filter) Option {
+	return func(s *syncer) { s.filters = append(s.filters, f) }
+}
+
+// WithTransformer adds a transformer to the syncer. Transformers run in the order they are added.
+func WithTransformer(t Transformer) Option {
+	return func(s *syncer) { s.transformers = append(s.transformers, t) }
+}
+
+// WithEventHandler adds an event handler to the syncer. Handlers run in the order they are added.
+func WithEventHandler(h EventHandler) Option {
+	return func(s *syncer) { s.eventHandlers = append(s.eventHandlers, h) }
+}
+
+// WithCheckpoints saves the resume token of each change stream into checkpoints as it is tailed. Collections with a
+// saved resume token are not dumped, and their change streams resume after it.
+func WithCheckpoints(c mongo2.Checkpoints) Option {
+	return func(s *syncer) { s.checkpoints = c }
+}
+
+// WithReplay starts all change streams at p, ignoring their checkpoints, to re-apply the changes made since. Collections
+// are not dumped.
+func WithReplay(p Position) Option {
+	return func(s *syncer) { s.replay = &p }
+}
+
+// WithSample limits dumps to the first n documents indexed from each collection, e.g. to preview the documents of a
+// dry run. A sample of 0 dumps all documents.
+func WithSample(n int) Option {
+	return func(s *syncer) { s.sample = n }
+}
+
+// WithTransactions tails all collections in the change stream of the whole deployment and applies the events of each
+// multi-document transaction in one bulk request, instead of tailing each collection separately.
+func WithTransactions() Option {
+	return func(s *syncer) { s.transactions = true }
+}
+
+// WithConnection adds a sink named name that collection targets can write to.
+func WithConnection(name string, snk sink.Sink) Option {
+	return func(s *syncer) { s.connections[name] = &syncer{sink: snk} }
+}
@@ -0,0 +1,49 @@
+package syncer
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+// resumeTokenRegexp matches the hex encoded _data of change stream resume tokens.
+var resumeTokenRegexp = regexp.MustCompile(`^[0-9A-Fa-f]{16,}$`)
+
+// Position is a point in a change stream to start tailing at: after the event with the resume token Token or, if
+// Token is empty, at Time.
+type Position struct {
+	Time  time.Time
+	Token string
+}
+
+// ParsePosition parses a time in RFC 3339 format, e.g. 2020-05-01T00:00:00Z, or a resume token as saved in
+// checkpoints into a Position.
+func ParsePosition(s string) (Position, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return Position{Time: t}, nil
+	}
+	if resumeTokenRegexp.MatchString(s) {
+		return Position{Token: s}, nil
+	}
+	return Position{}, fmt.Errorf("position [%s] is neither an RFC 3339 time nor a resume token", s)
+}
+
+// String returns the token of the position or, if it has none, its time.
+func (p Position) String() string {
+	if p.Token != "" {
+		return p.Token
+	}
+	return p.Time.UTC().Format(time.RFC3339)
+}
+
+// watchOptions returns the options of a change stream that starts at the position.
+func (p Position) watchOptions() mongo2.WatchOptions {
+	if p.Token != "" {
+		return mongo2.WatchOptions{ResumeAfter: p.Token}
+	}
+	return mongo2.WatchOptions{StartAtOperationTime: &primitive.Timestamp{T: uint32(p.Time.Unix())}}
+}
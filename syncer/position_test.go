@@ -0,0 +1,92 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+func TestParsePosition(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Position
+		wantErr bool
+	}{
+		{in: "2020-05-01T00:00:00Z", want: Position{Time: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)}},
+		{in: "825EB6BD2D000000012B022C0100296E5A1004", want: Position{Token: "825EB6BD2D000000012B022C0100296E5A1004"}},
+		{in: "yesterday", wantErr: true},
+		{in: "1588291200", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePosition(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePosition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Time.Equal(tt.want.Time) || got.Token != tt.want.Token {
+				t.Errorf("ParsePosition() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchOptions(t *testing.T) {
+	startAt := Position{Time: time.Unix(200, 0)}
+	replay := Position{Token: "replayed"}
+
+	tests := []struct {
+		name    string
+		replay  *Position
+		saved   string
+		startAt *Position
+		want    mongo2.WatchOptions
+	}{
+		{name: "start of dump", want: mongo2.WatchOptions{StartAtOperationTime: &primitive.Timestamp{T: 100}}},
+		{name: "configured start", startAt: &startAt, want: mongo2.WatchOptions{StartAtOperationTime: &primitive.Timestamp{T: 200}}},
+		{name: "checkpoint wins over configured start", saved: "saved", startAt: &startAt, want: mongo2.WatchOptions{ResumeAfter: "saved"}},
+		{name: "replay wins over checkpoint", replay: &replay, saved: "saved", want: mongo2.WatchOptions{ResumeAfter: "replayed"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkpoints := mongo2.NewMemoryCheckpoints()
+			if tt.saved != "" {
+				if err := checkpoints.Save(context.Background(), "db1.coll1", tt.saved, time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts := []Option{WithCheckpoints(checkpoints)}
+			if tt.replay != nil {
+				opts = append(opts, WithReplay(*tt.replay))
+			}
+
+			got, err := New(nil, &recordingSink{}, opts...).watchOptions(context.Background(), "db1.coll1", 100, tt.startAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("watchOptions() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailCollectionHistoryLost(t *testing.T) {
+	source := mongo2.NewMemorySource()
+	s := New(source, &recordingSink{}, WithReplay(Position{Token: "expired"}))
+	cmd := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+	err := s.tailCollection(context.Background(), 0, cmd, make(chan error))
+	if !errors.Is(err, mongo2.ErrHistoryLost) {
+		t.Errorf("tailCollection() error = %v, want %v", err, mongo2.ErrHistoryLost)
+	}
+}
@@ -0,0 +1,142 @@
+package syncer
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultReconcileInterval is how often collections are reconciled, if no interval is configured
+	defaultReconcileInterval = time.Hour
+	// defaultReconcileRate is the number of documents read per second from Mongo and the index while reconciling, if no
+	// rate is configured
+	defaultReconcileRate = 100
+)
+
+// driftMetrics holds the drift found by reconciling each collection, exported by expvar as "drift".
+// Each collection has a map with the number of missing, extra and stale documents found by the last run, and the
+// total number of runs, failed runs and repaired documents.
+var driftMetrics = expvar.NewMap("drift")
+
+// reconcile periodically verifies the collection against its index and repairs the differences, until ctx is done.
+// The first run starts one interval after the collection was dumped.
+func (s syncer) reconcile(ctx context.Context, cmd collectionSyncCommand) {
+	r := cmd.collMapping.Reconcile
+	if r == nil || cmd.collMapping.Embed != nil {
+		return
+	}
+
+	interval, rate := r.Interval, r.Rate
+	if interval <= 0 {
+		interval = defaultReconcileInterval
+	}
+	if rate <= 0 {
+		rate = defaultReconcileRate
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.reconcileOn(ctx, cmd, ticker.C, rate)
+}
+
+// reconcileOn verifies the collection against its index and repairs the differences on each tick, reading rate
+// documents per second from Mongo and the index, until ctx is done or ticks is closed.
+func (s syncer) reconcileOn(ctx context.Context, cmd collectionSyncCommand, ticks <-chan time.Time, rate int) {
+	log := log.With("collection", cmd.collMapping.Name, "database", cmd.dbMapping.Name, "target", cmd.target, "action", "reconciling")
+	metrics := collectionMetrics(cmd)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-ticks:
+			if !ok {
+				return
+			}
+		}
+
+		drift, err := s.verifyCollection(ctx, cmd, true, newThrottle(rate))
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+
+		metrics.Add("runs", 1)
+		if err != nil {
+			metrics.Add("errors", 1)
+			log.Errorf("Reconciling failed: %+v", err)
+			continue
+		}
+
+		recordDrift(metrics, drift)
+		if !drift.InSync() {
+			log.With("missing", len(drift.Missing), "extra", len(drift.Extra), "stale", len(drift.Stale)).Warn("Repaired drift")
+		}
+	}
+}
+
+// collectionMetrics returns the drift metrics of the collection, creating them if they do not exist.
+func collectionMetrics(cmd collectionSyncCommand) *expvar.Map {
+	name := indexName(cmd.collMapping.Name, cmd.dbMapping.Name)
+	if cmd.target != "" {
+		name = fmt.Sprintf("%s/%s", name, cmd.target)
+	}
+
+	if m, ok := driftMetrics.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	driftMetrics.Set(name, m)
+	return m
+}
+
+// recordDrift records the drift found by a run in the metrics of a collection.
+func recordDrift(metrics *expvar.Map, drift Drift) {
+	for key, n := range map[string]int{"missing": len(drift.Missing), "extra": len(drift.Extra), "stale": len(drift.Stale)} {
+		v := new(expvar.Int)
+		v.Set(int64(n))
+		metrics.Set(key, v)
+	}
+	if drift.Repaired {
+		metrics.Add("repaired", int64(len(drift.Missing)+len(drift.Extra)+len(drift.Stale)))
+	}
+}
+
+// throttle limits an operation to a number of times per second. A nil throttle does not limit.
+type throttle struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newThrottle returns a throttle that allows rate operations per second.
+func newThrottle(rate int) *throttle {
+	return &throttle{interval: time.Second / time.Duration(rate)}
+}
+
+// wait blocks until the next operation is allowed, or ctx is done.
+func (t *throttle) wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
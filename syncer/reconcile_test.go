@@ -0,0 +1,107 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+func TestReconcile(t *testing.T) {
+	oid1, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	oid2, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+
+	source := mongo2.NewMemorySource()
+	if err := source.Insert(Namespace{Database: "db1", Collection: "reconciled"}, bson.M{"_id": oid1, "name": "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	snk := &readableSink{hits: []sink.Hit{
+		{Index: "db1.reconciled", ID: oid2.Hex(), Source: json.RawMessage(`{"id":"` + oid2.Hex() + `"}`)},
+	}}
+	s := New(source, snk)
+	cmd := collectionSyncCommand{
+		collMapping: config.CollectionMapping{Name: "reconciled", Reconcile: &config.Reconcile{}},
+		dbMapping:   config.DatabaseMapping{Name: "db1"},
+	}
+
+	// Metrics are global and outlive the test
+	metrics := collectionMetrics(cmd)
+	value := func(key string) int64 {
+		if v, ok := metrics.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	runsBefore, repairedBefore := value("runs"), value("repaired")
+
+	ticks := make(chan time.Time)
+	go func() {
+		ticks <- time.Now()
+		ticks <- time.Now()
+		close(ticks)
+	}()
+	s.reconcileOn(context.Background(), cmd, ticks, 1000)
+
+	// The index is not updated by the fake sink, so every run finds and repairs the same drift
+	if runs := value("runs") - runsBefore; runs != 2 {
+		t.Fatalf("reconcileOn() runs = %d, want 2", runs)
+	}
+	for key, want := range map[string]int64{"missing": 1, "extra": 1, "stale": 0, "repaired": repairedBefore + 4} {
+		if got := value(key); got != want {
+			t.Errorf("reconcileOn() metric %s = %d, want %d", key, got, want)
+		}
+	}
+
+	if got := len(snk.ops); got != 4 {
+		t.Errorf("reconcileOn() ops = %d, want 4", got)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	limit := newThrottle(100)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limit.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("wait() 5 times at 100/s took %v, want at least 40ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limit.next = time.Now().Add(time.Hour)
+	if err := limit.wait(ctx); err != context.Canceled {
+		t.Errorf("wait() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestVerifyCollectionThrottle(t *testing.T) {
+	// The index is read at the rate too, even if the collection is empty
+	var hits []sink.Hit
+	for i := 0; i < 5; i++ {
+		hits = append(hits, sink.Hit{Index: "db1.coll1", ID: strconv.Itoa(i), Source: json.RawMessage(`{}`)})
+	}
+	s := New(mongo2.NewMemorySource(), &readableSink{hits: hits})
+	cmd := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+	start := time.Now()
+	if _, err := s.verifyCollection(context.Background(), cmd, false, newThrottle(100)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("verifyCollection() of 5 indexed documents at 100/s took %v, want at least 40ms", elapsed)
+	}
+}
@@ -0,0 +1,192 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"mongo-elastic-sync/config"
+)
+
+// runningUnit is a unit of collections synced together by SyncReloading.
+type runningUnit struct {
+	cmds   []collectionSyncCommand
+	cancel context.CancelFunc
+	// stopped is closed when the unit has stopped syncing
+	stopped chan struct{}
+}
+
+// SyncReloading synchronizes MongoDB and Elasticsearch like Sync, and applies each sync mapping received from reloads
+// while syncing. Collections that are no longer configured stop being synced and new collections start being synced.
+// Collections whose mapping changed are dumped again, even if they have a checkpoint, and tailed from their checkpoint.
+// Embedded and joined child collections are restarted with their parent, and in transaction mode any change restarts
+// all collections; restarted collections without a checkpoint are dumped again, and added collections are dumped.
+// A sync mapping that cannot be applied is logged and ignored, and syncing continues without reloads once reloads is
+// closed. SyncReloading returns when ctx is done or every
+// collection has stopped syncing by itself.
+func (s *syncer) SyncReloading(ctx context.Context, syncMapping config.SyncMapping, reloads <-chan config.SyncMapping) error {
+	collectionSyncCommands, err := s.collectionSyncCommands(ctx, syncMapping)
+	if err != nil {
+		return err
+	}
+
+	// The initial dump is done for all collections at once, so that children are dumped after their parents
+	timeBeforeDump := time.Now().UTC().Unix()
+	if _, err = s.dumpCommands(ctx, collectionSyncCommands, true); err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintln(os.Stderr, MsgDumpingCompleted)
+
+	running := make(map[string]*runningUnit)
+	died := make(chan *runningUnit)
+	start := func(key string, cmds []collectionSyncCommand, dump bool) {
+		unitCtx, cancel := context.WithCancel(ctx)
+		u := &runningUnit{cmds: cmds, cancel: cancel, stopped: make(chan struct{})}
+		running[key] = u
+
+		go func() {
+			startUnix := timeBeforeDump
+			if dump {
+				startUnix = time.Now().UTC().Unix()
+				if _, err := s.dumpCommands(unitCtx, cmds, true); err != nil {
+					log.With("unit", key).Errorf("Dumping failed: %+v", err)
+				}
+			}
+			err := s.tailCommands(unitCtx, cmds, startUnix)
+			close(u.stopped)
+
+			if unitCtx.Err() == nil {
+				log.With("unit", key).Errorf("Syncing stopped: %+v", err)
+				select {
+				case died <- u:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	stop := func(key string) {
+		u := running[key]
+		u.cancel()
+		<-u.stopped
+		delete(running, key)
+	}
+
+	keys, units := s.reloadUnits(collectionSyncCommands)
+	for _, key := range keys {
+		start(key, units[key], false)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for key := range running {
+				stop(key)
+			}
+			return ctx.Err()
+		case u := <-died:
+			// The unit may have been replaced since it died
+			for key, r := range running {
+				if r == u {
+					delete(running, key)
+					if len(running) == 0 {
+						return errors.New("all tailers died")
+					}
+				}
+			}
+		case mapping, ok := <-reloads:
+			if !ok {
+				reloads = nil
+				continue
+			}
+
+			cmds, err := s.collectionSyncCommands(ctx, mapping)
+			if err != nil {
+				log.Errorf("Applying reloaded sync mapping failed, keeping the current mapping: %+v", err)
+				continue
+			}
+
+			keys, units := s.reloadUnits(cmds)
+			current := make(map[string][]collectionSyncCommand, len(running))
+			for key, u := range running {
+				current[key] = u.cmds
+			}
+
+			stopped, started := diffUnits(current, keys, units)
+			for _, key := range stopped {
+				log.With("unit", key).Info("Stopping sync")
+				stop(key)
+			}
+			for _, key := range started {
+				log.With("unit", key).Info("Starting sync")
+				start(key, units[key], true)
+			}
+		}
+	}
+}
+
+// reloadUnits groups cmds into the units that SyncReloading starts and stops together, by key. They are the units of
+// work of a group of workers or, in transaction mode, a single unit, as all collections share one change stream.
+func (s *syncer) reloadUnits(cmds []collectionSyncCommand) ([]string, map[string][]collectionSyncCommand) {
+	if s.transactions {
+		return []string{transactionsCheckpointKey}, map[string][]collectionSyncCommand{transactionsCheckpointKey: cmds}
+	}
+	return workUnits(cmds)
+}
+
+// diffUnits compares the units being synced, current, with the units of a new sync mapping, by key. It returns the
+// keys of the current units to stop, because they were removed or changed, and the keys of the units to start, in
+// order. The commands of changed units whose mapping changed are marked for reindexing.
+func diffUnits(current map[string][]collectionSyncCommand, keys []string, units map[string][]collectionSyncCommand) ([]string, []string) {
+	var stopped, started []string
+	for key := range current {
+		if _, ok := units[key]; !ok {
+			stopped = append(stopped, key)
+		}
+	}
+	sort.Strings(stopped)
+
+	for _, key := range keys {
+		cmds, ok := current[key]
+		if !ok {
+			started = append(started, key)
+			continue
+		}
+
+		previous := make(map[string]collectionSyncCommand, len(cmds))
+		for _, cmd := range cmds {
+			previous[checkpointKey(cmd)] = cmd
+		}
+
+		changed := len(cmds) != len(units[key])
+		for i, cmd := range units[key] {
+			prev, ok := previous[checkpointKey(cmd)]
+			if !ok {
+				changed = true
+				continue
+			}
+			if !sameMapping(prev, cmd) {
+				units[key][i].reindex = true
+				changed = true
+			}
+		}
+
+		if changed {
+			stopped = append(stopped, key)
+			started = append(started, key)
+		}
+	}
+	return stopped, started
+}
+
+// sameMapping returns true if a and b, commands of the same collection, sync it in the same way.
+func sameMapping(a, b collectionSyncCommand) bool {
+	return reflect.DeepEqual(a.collMapping, b.collMapping) &&
+		reflect.DeepEqual(a.embedded, b.embedded) &&
+		reflect.DeepEqual(a.joinChildren, b.joinChildren) &&
+		a.connection == b.connection
+}
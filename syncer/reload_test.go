@@ -0,0 +1,147 @@
+package syncer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+func TestDiffUnits(t *testing.T) {
+	db := config.DatabaseMapping{Name: "db1"}
+	posts := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "posts"}, dbMapping: db}
+	comments := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "comments", Embed: &config.Embed{Parent: "posts"}}, dbMapping: db}
+	users := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "users"}, dbMapping: db}
+	tags := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "tags"}, dbMapping: db}
+
+	changedUsers := users
+	changedUsers.collMapping.Fields = []fields.M{{Name: "name"}}
+
+	current := map[string][]collectionSyncCommand{
+		"db1.posts": {posts},
+		"db1.users": {users},
+		"db1.tags":  {tags},
+	}
+	keys, units := workUnits([]collectionSyncCommand{posts, comments, changedUsers, {collMapping: config.CollectionMapping{Name: "groups"}, dbMapping: db}})
+
+	stopped, started := diffUnits(current, keys, units)
+
+	if want := []string{"db1.tags", "db1.posts", "db1.users"}; !reflect.DeepEqual(stopped, want) {
+		t.Errorf("diffUnits() stopped = %v, want %v", stopped, want)
+	}
+	if want := []string{"db1.posts", "db1.users", "db1.groups"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("diffUnits() started = %v, want %v", started, want)
+	}
+
+	// Only changed collections are reindexed, not the unchanged parent of a new child
+	if units["db1.posts"][0].reindex || units["db1.posts"][1].reindex {
+		t.Error("diffUnits() marked db1.posts for reindexing, want no reindexing")
+	}
+	if !units["db1.users"][0].reindex {
+		t.Error("diffUnits() did not mark db1.users for reindexing")
+	}
+}
+
+// idleSource is a Source whose change streams have no events and wait for them until ctx is done.
+type idleSource struct {
+	*mongo2.MemorySource
+}
+
+func (s idleSource) Watch(ctx context.Context, ns Namespace, opts mongo2.WatchOptions) (mongo2.Cursor, error) {
+	return idleCursor{}, nil
+}
+
+type idleCursor struct{}
+
+func (idleCursor) Next(ctx context.Context) bool {
+	<-ctx.Done()
+	return false
+}
+
+func (idleCursor) Decode(v interface{}) error       { return nil }
+func (idleCursor) Err() error                       { return nil }
+func (idleCursor) Close(ctx context.Context) error  { return nil }
+func (idleCursor) TryNext(ctx context.Context) bool { return false }
+
+func TestSyncReloading(t *testing.T) {
+	source := mongo2.NewMemorySource()
+	for _, coll := range []string{"coll1", "coll2", "coll3"} {
+		if err := source.Insert(Namespace{Database: "db1", Collection: coll}, bson.M{"_id": primitive.NewObjectID(), "a": 1, "b": 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mapping := func(colls ...config.CollectionMapping) config.SyncMapping {
+		return config.SyncMapping{Databases: []config.DatabaseMapping{{Name: "db1", Collections: colls}}}
+	}
+	coll1 := config.CollectionMapping{Name: "coll1", Fields: []fields.M{{Name: "a"}}}
+	changedColl1 := config.CollectionMapping{Name: "coll1", Fields: []fields.M{{Name: "a"}, {Name: "b"}}}
+	coll2 := config.CollectionMapping{Name: "coll2"}
+	coll3 := config.CollectionMapping{Name: "coll3"}
+
+	checkpoints := mongo2.NewMemoryCheckpoints()
+	snk := &recordingSink{}
+	s := New(idleSource{source}, snk, WithCheckpoints(checkpoints))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := make(chan config.SyncMapping)
+	errs := make(chan error, 1)
+	go func() { errs <- s.SyncReloading(ctx, mapping(coll1, coll3), reloads) }()
+	waitForOps(t, snk, 2)
+
+	// Changed collections are dumped again even if they have a checkpoint; unchanged collections are not
+	if err := checkpoints.Save(ctx, "db1.coll1", "token1", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	reloads <- mapping(changedColl1, coll2, coll3)
+	waitForOps(t, snk, 4)
+
+	// Removed collections stop, and are dumped again when they are added back
+	reloads <- mapping(changedColl1)
+	reloads <- mapping(changedColl1, coll3)
+	waitForOps(t, snk, 5)
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("SyncReloading() error = %v, want %v", err, context.Canceled)
+	}
+
+	counts := make(map[string]int)
+	for _, op := range snk.ops {
+		counts[op.Index]++
+	}
+	if want := map[string]int{"db1.coll1": 2, "db1.coll2": 1, "db1.coll3": 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("SyncReloading() ops by index = %v, want %v", counts, want)
+	}
+	for _, op := range snk.ops[2:] {
+		if op.Index == "db1.coll1" && op.Body.(map[string]interface{})["b"] == nil {
+			t.Errorf("SyncReloading() reindexed %+v, want field b", op)
+		}
+	}
+}
+
+// waitForOps waits until snk has received n operations.
+func waitForOps(t *testing.T, snk *recordingSink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snk.mu.Lock()
+		got := len(snk.ops)
+		snk.mu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d operations, want %d", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,160 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+)
+
+const (
+	// RolloverPeriodDaily rolls indexes over every day
+	RolloverPeriodDaily = "daily"
+	// RolloverPeriodMonthly rolls indexes over every month
+	RolloverPeriodMonthly = "monthly"
+
+	// retentionInterval is how often indexes are checked for expiry
+	retentionInterval = time.Hour
+)
+
+// rolloverRouter selects the time-based index of each document of a rolled over collection.
+type rolloverRouter struct {
+	alias    string
+	layout   string
+	rollover config.Rollover
+}
+
+func newRolloverRouter(alias string, rollover config.Rollover) (rolloverRouter, error) {
+	r := rolloverRouter{alias: alias, rollover: rollover}
+	switch rollover.Period {
+	case RolloverPeriodDaily:
+		r.layout = "2006.01.02"
+	case RolloverPeriodMonthly:
+		r.layout = "2006.01"
+	default:
+		return r, fmt.Errorf("unknown rollover period [%s], must be %s or %s", rollover.Period, RolloverPeriodDaily, RolloverPeriodMonthly)
+	}
+	return r, nil
+}
+
+func (r rolloverRouter) index(doc map[string]interface{}) (string, error) {
+	t, err := r.documentTime(doc)
+	if err != nil {
+		return "", err
+	}
+	return r.alias + "-" + t.UTC().Format(r.layout), nil
+}
+
+func (r rolloverRouter) pattern() string {
+	return r.alias + "-*"
+}
+
+func (r rolloverRouter) createBody(string) map[string]interface{} {
+	return map[string]interface{}{
+		"aliases": map[string]interface{}{r.alias: map[string]interface{}{}},
+	}
+}
+
+func (r rolloverRouter) fields() []string {
+	if r.rollover.DateField == "" {
+		return []string{}
+	}
+	return []string{r.rollover.DateField}
+}
+
+// documentTime returns the time the document is rolled over by.
+func (r rolloverRouter) documentTime(doc map[string]interface{}) (time.Time, error) {
+	if r.rollover.DateField == "" {
+		id, ok := doc["_id"].(primitive.ObjectID)
+		if !ok {
+			return time.Time{}, fmt.Errorf("rolling over by _id requires an ObjectID, got [%s], set a dateField to roll over by", documentID(doc["_id"]))
+		}
+		return id.Timestamp(), nil
+	}
+
+	v, _ := fields.Get(doc, r.rollover.DateField)
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return time.Unix(0, int64(t)*int64(time.Millisecond)), nil
+	case time.Time:
+		return t, nil
+	case primitive.Timestamp:
+		return time.Unix(int64(t.T), 0), nil
+	case primitive.ObjectID:
+		return t.Timestamp(), nil
+	}
+	return time.Time{}, fmt.Errorf("rollover field [%s] is not a date, got [%v]", r.rollover.DateField, v)
+}
+
+// expiredIndexes returns the indexes in names that are older than the retention of the router at now.
+func (r rolloverRouter) expiredIndexes(names []string, now time.Time) []string {
+	if r.rollover.Retention <= 0 {
+		return nil
+	}
+
+	now = now.UTC()
+	var cutoff time.Time
+	switch r.rollover.Period {
+	case RolloverPeriodDaily:
+		cutoff = time.Date(now.Year(), now.Month(), now.Day()-r.rollover.Retention+1, 0, 0, 0, 0, time.UTC)
+	case RolloverPeriodMonthly:
+		cutoff = time.Date(now.Year(), now.Month()-time.Month(r.rollover.Retention)+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	var expired []string
+	prefix := r.alias + "-"
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		t, err := time.Parse(r.layout, strings.TrimPrefix(name, prefix))
+		if err != nil {
+			continue
+		}
+		if t.Before(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	return expired
+}
+
+// enforceRetention periodically deletes the indexes of a rolled over collection that are older than its retention,
+// until ctx is done.
+func (s syncer) enforceRetention(ctx context.Context, cmd collectionSyncCommand) {
+	r, ok := cmd.router.(rolloverRouter)
+	if !ok || r.rollover.Retention <= 0 || s.querySink == nil {
+		return
+	}
+
+	log := log.With("collection", cmd.collMapping.Name, "database", cmd.dbMapping.Name, "index", r.pattern())
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		names, err := s.querySink.IndexNames(ctx)
+		if err != nil {
+			log.Errorf("Listing indexes for retention: %+v", err)
+		} else if expired := r.expiredIndexes(names, time.Now()); len(expired) > 0 {
+			log.With("expired", expired).Info("Deleting expired indexes")
+			if err = s.querySink.DeleteIndex(ctx, expired...); err != nil {
+				log.Errorf("Deleting expired indexes: %+v", err)
+			} else {
+				for _, name := range expired {
+					s.ensuredIndexes.Delete(name)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
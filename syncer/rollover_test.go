@@ -0,0 +1,117 @@
+package syncer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+)
+
+func TestRolloverRouterIndex(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c") // 2020-05-09T14:26:53Z
+	createdAt := primitive.NewDateTimeFromTime(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	tests := []struct {
+		name     string
+		rollover config.Rollover
+		doc      map[string]interface{}
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "daily by object id",
+			rollover: config.Rollover{Period: RolloverPeriodDaily},
+			doc:      map[string]interface{}{"_id": oid},
+			want:     "db.events-2020.05.09",
+		},
+		{
+			name:     "monthly by object id",
+			rollover: config.Rollover{Period: RolloverPeriodMonthly},
+			doc:      map[string]interface{}{"_id": oid},
+			want:     "db.events-2020.05",
+		},
+		{
+			name:     "daily by date field",
+			rollover: config.Rollover{Period: RolloverPeriodDaily, DateField: "meta.createdAt"},
+			doc:      map[string]interface{}{"_id": oid, "meta": map[string]interface{}{"createdAt": createdAt}},
+			want:     "db.events-2020.01.02",
+		},
+		{
+			name:     "missing date field",
+			rollover: config.Rollover{Period: RolloverPeriodDaily, DateField: "createdAt"},
+			doc:      map[string]interface{}{"_id": oid},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newRolloverRouter("db.events", tt.rollover)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := r.index(tt.doc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("index() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("index() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRolloverRouterExpiredIndexes(t *testing.T) {
+	now := time.Date(2020, 5, 23, 12, 0, 0, 0, time.UTC)
+	names := []string{
+		"db.events-2020.05.23", "db.events-2020.05.22", "db.events-2020.05.21", "db.events-2020.04.30",
+		"db.events-2020.05", "db.events-2020.04", "db.events-2020.03", "db.events-2019.12",
+		"db.other-2020.01.01", "db.events",
+	}
+
+	tests := []struct {
+		name     string
+		rollover config.Rollover
+		want     []string
+	}{
+		{
+			name:     "daily retention",
+			rollover: config.Rollover{Period: RolloverPeriodDaily, Retention: 2},
+			want:     []string{"db.events-2020.05.21", "db.events-2020.04.30"},
+		},
+		{
+			name:     "monthly retention",
+			rollover: config.Rollover{Period: RolloverPeriodMonthly, Retention: 2},
+			want:     []string{"db.events-2020.03", "db.events-2019.12"},
+		},
+		{
+			name:     "no retention",
+			rollover: config.Rollover{Period: RolloverPeriodDaily},
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newRolloverRouter("db.events", tt.rollover)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := r.expiredIndexes(names, now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expiredIndexes() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRolloverRouterUnknownPeriod(t *testing.T) {
+	if _, err := newRolloverRouter("db.events", config.Rollover{Period: "weekly"}); err == nil {
+		t.Error("newRolloverRouter() expected error for unknown period")
+	}
+}
@@ -0,0 +1,198 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/olivere/elastic"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+var templateActionRegexp = regexp.MustCompile(`{{[^}]*}}`)
+
+// indexRouter selects the index of each document of a collection that is indexed into multiple indexes.
+type indexRouter interface {
+	// index returns the index selected for doc.
+	index(doc map[string]interface{}) (string, error)
+	// pattern returns a wildcard pattern matching every index the router can select.
+	pattern() string
+	// createBody returns the create index request body of a selected index, which may be nil.
+	createBody(index string) map[string]interface{}
+	// fields returns the paths of the document fields the index is selected by, other than _id, or nil if they are
+	// not known. Updates that change none of them never move documents.
+	fields() []string
+}
+
+// newIndexRouter returns the index router of the collection, or nil if the collection is indexed into a single index.
+// An index template without actions names a single index.
+func newIndexRouter(collMapping config.CollectionMapping, dbName string) (indexRouter, error) {
+	switch {
+	case collMapping.Index != "" && collMapping.Rollover != nil:
+		return nil, errors.New("index and rollover cannot both be set")
+	case collMapping.Index != "" && !templateActionRegexp.MatchString(collMapping.Index):
+		return nil, nil
+	case collMapping.Index != "":
+		tmpl, err := parseIndexTemplate(collMapping.Index)
+		if err != nil {
+			return nil, err
+		}
+		return templateRouter{tmpl: tmpl, text: collMapping.Index, paths: templateFields(tmpl)}, nil
+	case collMapping.Rollover != nil:
+		return newRolloverRouter(indexName(collMapping.Name, dbName), *collMapping.Rollover)
+	}
+	return nil, nil
+}
+
+// templateRouter selects indexes with an index template.
+type templateRouter struct {
+	tmpl *template.Template
+	text string
+	// paths are the fields the template refers to
+	paths []string
+}
+
+func (r templateRouter) index(doc map[string]interface{}) (string, error) {
+	return executeIndexTemplate(r.tmpl, doc)
+}
+
+func (r templateRouter) pattern() string {
+	return indexPattern(r.text)
+}
+
+func (r templateRouter) createBody(string) map[string]interface{} {
+	return nil
+}
+
+func (r templateRouter) fields() []string {
+	return r.paths
+}
+
+// parseIndexTemplate parses the index template of a routed collection.
+// Executing the template fails if it refers to a field that is missing from the document.
+func parseIndexTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("index").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing index template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// templateFields returns the paths of the document fields the index template refers to, or nil if it refers to
+// anything other than fields, such as variables.
+func templateFields(tmpl *template.Template) []string {
+	paths := []string{}
+	var walk func(node parse.Node) bool
+	walk = func(node parse.Node) bool {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			for _, child := range n.Nodes {
+				if !walk(child) {
+					return false
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe)
+		case *parse.PipeNode:
+			if len(n.Decl) > 0 {
+				return false
+			}
+			for _, cmd := range n.Cmds {
+				if !walk(cmd) {
+					return false
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				if !walk(arg) {
+					return false
+				}
+			}
+		case *parse.FieldNode:
+			paths = append(paths, strings.Join(n.Ident, "."))
+		case *parse.TextNode, *parse.IdentifierNode, *parse.StringNode, *parse.NumberNode, *parse.BoolNode:
+		default:
+			return false
+		}
+		return true
+	}
+
+	if !walk(tmpl.Tree.Root) {
+		return nil
+	}
+	return paths
+}
+
+// changesAny returns true if the event may have changed any of the fields at paths, or paths is nil.
+func changesAny(evt mongo2.ChangeStreamEvent, paths []string) bool {
+	if paths == nil {
+		return true
+	}
+	for _, path := range paths {
+		if evt.Changes(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// executeIndexTemplate returns the index selected by tmpl for doc.
+// Elasticsearch index names must be lowercase, so the result is lowercased.
+func executeIndexTemplate(tmpl *template.Template, doc map[string]interface{}) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, doc); err != nil {
+		return "", fmt.Errorf("selecting index: %w", err)
+	}
+	return strings.ToLower(b.String()), nil
+}
+
+// indexPattern returns a wildcard pattern matching every index the index template can select.
+func indexPattern(text string) string {
+	return strings.ToLower(templateActionRegexp.ReplaceAllString(text, "*"))
+}
+
+// routeDocument returns the index selected for doc in a routed collection and makes sure the index exists.
+func (s syncer) routeDocument(ctx context.Context, cmd collectionSyncCommand, doc map[string]interface{}) (string, error) {
+	index, err := cmd.router.index(doc)
+	if err != nil {
+		return "", fmt.Errorf("routing document [%s]: %w", documentID(doc["_id"]), err)
+	}
+
+	if err = s.ensureIndex(ctx, index, cmd.router.createBody(index)); err != nil {
+		return "", err
+	}
+	return index, nil
+}
+
+// deleteMovedDocument deletes the copies of the document with the given id of a routed collection from the indexes
+// matching pattern other than index, the index it is routed to. They remain in the index it was routed to before an
+// update changed the field its index is selected by. Update events carry no previous version of the document, so the
+// copies are found by id across all indexes. It is only called for events that may have changed the fields the index
+// is selected by.
+func (s syncer) deleteMovedDocument(ctx context.Context, pattern string, id string, index string) error {
+	query := elastic.NewBoolQuery().Must(elastic.NewIdsQuery().Ids(id)).MustNot(elastic.NewTermQuery("_index", index))
+	if err := s.querySink.DeleteByQuery(ctx, pattern, query); err != nil {
+		return fmt.Errorf("deleting moved copies of [%s]: %w", id, err)
+	}
+	return nil
+}
+
+// deleteRoutedDocument deletes a document of a routed collection. Delete events carry no document to select the index
+// with, only the document key, so the document is deleted from the index selected by the document key. This works if
+// the index is selected by the _id or, in sharded collections, by shard key fields. Otherwise, the document is deleted
+// from every index matching pattern.
+func (s syncer) deleteRoutedDocument(ctx context.Context, cmd collectionSyncCommand, pattern string, documentKey map[string]interface{}) error {
+	id := documentID(documentKey["_id"])
+
+	if index, err := cmd.router.index(documentKey); err == nil {
+		return s.deleteDocument(ctx, index, id, "")
+	}
+
+	return s.querySink.DeleteByQuery(ctx, pattern, elastic.NewIdsQuery().Ids(id))
+}
@@ -0,0 +1,205 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/olivere/elastic"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+func TestExecuteIndexTemplate(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+
+	tests := []struct {
+		name     string
+		template string
+		doc      map[string]interface{}
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "select by field",
+			template: "orders-{{.tenantId}}",
+			doc:      map[string]interface{}{"tenantId": "acme"},
+			want:     "orders-acme",
+		},
+		{
+			name:     "select by nested field",
+			template: "orders-{{.tenant.name}}",
+			doc:      map[string]interface{}{"tenant": map[string]interface{}{"name": "acme"}},
+			want:     "orders-acme",
+		},
+		{
+			name:     "select by object id",
+			template: "orders-{{.tenantId.Hex}}",
+			doc:      map[string]interface{}{"tenantId": oid},
+			want:     "orders-5eb6bd2d0b6bdf6514bb837c",
+		},
+		{
+			name:     "lowercase index",
+			template: "orders-{{.tenantId}}",
+			doc:      map[string]interface{}{"tenantId": "ACME"},
+			want:     "orders-acme",
+		},
+		{
+			name:     "missing field",
+			template: "orders-{{.tenantId}}",
+			doc:      map[string]interface{}{},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseIndexTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := executeIndexTemplate(tmpl, tt.doc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("executeIndexTemplate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("executeIndexTemplate() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexPattern(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "orders-{{.tenantId}}", want: "orders-*"},
+		{template: "{{.region}}-Orders-{{.tenantId}}", want: "*-orders-*"},
+		{template: "orders", want: "orders"},
+	}
+
+	for _, tt := range tests {
+		if got := indexPattern(tt.template); got != tt.want {
+			t.Errorf("indexPattern(%q) got = %v, want %v", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestParseIndexTemplate(t *testing.T) {
+	if _, err := parseIndexTemplate("orders-{{.tenantId"); err == nil {
+		t.Error("parseIndexTemplate() expected error for malformed template")
+	} else if errors.Unwrap(err) == nil {
+		t.Errorf("parseIndexTemplate() error = %v, want wrapped template error", err)
+	}
+}
+
+func TestTemplateFields(t *testing.T) {
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{template: "orders-{{.tenant}}", want: []string{"tenant"}},
+		{template: "orders-{{.meta.region}}-{{printf \"%v\" .year}}", want: []string{"meta.region", "year"}},
+		// Variables may refer to any field
+		{template: "orders-{{$t := .tenant}}{{$t}}", want: nil},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseIndexTemplate(tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := templateFields(tmpl); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("templateFields(%q) = %v, want %v", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestHandleRoutedEvent(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	id := oid.Hex()
+	orders := config.CollectionMapping{Name: "orders", Index: "orders-{{.tenant}}"}
+	events := config.CollectionMapping{Name: "events", Rollover: &config.Rollover{Period: RolloverPeriodMonthly}}
+
+	tests := []struct {
+		name        string
+		collMapping config.CollectionMapping
+		evt         mongo2.ChangeStreamEvent
+		want        []sink.Op
+		wantQuery   []queryOp
+	}{
+		{
+			name:        "insert",
+			collMapping: orders,
+			evt:         mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: map[string]interface{}{"_id": oid, "tenant": "a"}},
+			want:        []sink.Op{{Action: sink.ActionIndex, Index: "orders-a", ID: id, Body: map[string]interface{}{"id": oid, "tenant": "a"}}},
+		},
+		{
+			name:        "update",
+			collMapping: orders,
+			evt:         mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: map[string]interface{}{"_id": oid, "tenant": "b"}},
+			want:        []sink.Op{{Action: sink.ActionIndex, Index: "orders-b", ID: id, Body: map[string]interface{}{"id": oid, "tenant": "b"}}},
+			// The copy in the index the document was routed to before the update, if it moved, is deleted
+			wantQuery: []queryOp{{
+				Action: sink.ActionDelete,
+				Index:  "orders-*",
+				Query:  sourceJSON(elastic.NewBoolQuery().Must(elastic.NewIdsQuery().Ids(id)).MustNot(elastic.NewTermQuery("_index", "orders-b"))),
+			}},
+		},
+		{
+			// The document cannot have moved if the field its index is selected by was not updated
+			name:        "update other field",
+			collMapping: orders,
+			evt: mongo2.ChangeStreamEvent{
+				OperationType:     mongo2.ChangeStreamEventOperationTypeUpdate,
+				FullDocument:      map[string]interface{}{"_id": oid, "tenant": "b"},
+				UpdateDescription: &mongo2.UpdateDescription{UpdatedFields: map[string]interface{}{"total": 1}},
+			},
+			want: []sink.Op{{Action: sink.ActionIndex, Index: "orders-b", ID: id, Body: map[string]interface{}{"id": oid, "tenant": "b"}}},
+		},
+		{
+			name:        "update routed by id",
+			collMapping: events,
+			evt:         mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: map[string]interface{}{"_id": oid}},
+			want:        []sink.Op{{Action: sink.ActionIndex, Index: "db1.events-2020.05", ID: id, Body: map[string]interface{}{"id": oid}}},
+		},
+		{
+			name:        "delete",
+			collMapping: orders,
+			evt:         mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete},
+			wantQuery:   []queryOp{{Action: sink.ActionDelete, Index: "orders-*", Query: sourceJSON(elastic.NewIdsQuery().Ids(id))}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snk := &recordingQuerySink{}
+			s := New(nil, snk)
+
+			cmd := collectionSyncCommand{collMapping: tt.collMapping, dbMapping: config.DatabaseMapping{Name: "db1"}}
+			router, err := newIndexRouter(tt.collMapping, "db1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd.router = router
+
+			evt := tt.evt
+			evt.DocumentKey.ID = oid
+			if err = s.handleStreamEvent(context.Background(), evt, cmd, cmd.indexName()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(snk.ops, tt.want) {
+				t.Errorf("handleStreamEvent() ops = %+v, want %+v", snk.ops, tt.want)
+			}
+			if !reflect.DeepEqual(snk.queryOps, tt.wantQuery) {
+				t.Errorf("handleStreamEvent() query ops = %+v, want %+v", snk.queryOps, tt.wantQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package syncer
+
+import (
+	"reflect"
+
+	"mongo-elastic-sync/fields"
+)
+
+// softDeleted returns true if doc is marked as deleted by the soft delete rule of the collection.
+func (c collectionSyncCommand) softDeleted(doc map[string]interface{}) bool {
+	sd := c.collMapping.SoftDelete
+	if sd == nil {
+		return false
+	}
+
+	v, ok := fields.Get(doc, sd.Field)
+	if !ok || v == nil {
+		return false
+	}
+	if sd.Value == nil {
+		return true
+	}
+	return valuesEqual(v, sd.Value)
+}
+
+// valuesEqual returns true if the Mongo value a equals the config value b. Numbers are equal if they have the same
+// value, whatever their type.
+func valuesEqual(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		return ok && af == bf
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
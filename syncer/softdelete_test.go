@@ -0,0 +1,39 @@
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+)
+
+func TestSoftDeleted(t *testing.T) {
+	deletedAt := primitive.NewDateTimeFromTime(time.Now())
+
+	tests := []struct {
+		name       string
+		softDelete *config.SoftDelete
+		doc        map[string]interface{}
+		want       bool
+	}{
+		{name: "no rule", softDelete: nil, doc: map[string]interface{}{"deletedAt": deletedAt}, want: false},
+		{name: "field set", softDelete: &config.SoftDelete{Field: "deletedAt"}, doc: map[string]interface{}{"deletedAt": deletedAt}, want: true},
+		{name: "field null", softDelete: &config.SoftDelete{Field: "deletedAt"}, doc: map[string]interface{}{"deletedAt": nil}, want: false},
+		{name: "field missing", softDelete: &config.SoftDelete{Field: "deletedAt"}, doc: map[string]interface{}{}, want: false},
+		{name: "value equal", softDelete: &config.SoftDelete{Field: "isDeleted", Value: true}, doc: map[string]interface{}{"isDeleted": true}, want: true},
+		{name: "value not equal", softDelete: &config.SoftDelete{Field: "isDeleted", Value: true}, doc: map[string]interface{}{"isDeleted": false}, want: false},
+		{name: "number value equal", softDelete: &config.SoftDelete{Field: "status", Value: 2}, doc: map[string]interface{}{"status": int32(2)}, want: true},
+		{name: "nested field", softDelete: &config.SoftDelete{Field: "meta.deleted", Value: "yes"}, doc: map[string]interface{}{"meta": map[string]interface{}{"deleted": "yes"}}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := collectionSyncCommand{collMapping: config.CollectionMapping{SoftDelete: tt.softDelete}}
+			if got := cmd.softDeleted(tt.doc); got != tt.want {
+				t.Errorf("softDeleted() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+// CollectionStatus is the tailing progress of a synced collection, as reported by Status.
+type CollectionStatus struct {
+	Namespace Namespace
+	// Target is the name of the collection target, or empty for the collection's own index
+	Target string
+	// Checkpoint is the checkpoint the change stream of the collection resumes from. Its token is empty if there is
+	// none. In transaction mode, all collections share the checkpoint of the change stream of the deployment.
+	Checkpoint mongo2.Checkpoint
+}
+
+// Validate checks that the collections configured by syncMapping can be synced with the syncer's sinks.
+func (s *syncer) Validate(ctx context.Context, syncMapping config.SyncMapping) error {
+	_, err := s.collectionSyncCommands(ctx, syncMapping)
+	return err
+}
+
+// Status returns the saved checkpoint of each collection configured by syncMapping.
+func (s *syncer) Status(ctx context.Context, syncMapping config.SyncMapping) ([]CollectionStatus, error) {
+	if s.checkpoints == nil {
+		return nil, errors.New("status needs checkpoints")
+	}
+
+	collectionSyncCommands, err := s.collectionSyncCommands(ctx, syncMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]CollectionStatus, 0, len(collectionSyncCommands))
+	for _, cmd := range collectionSyncCommands {
+		key := checkpointKey(cmd)
+		if s.transactions {
+			key = transactionsCheckpointKey
+		}
+
+		cp, err := s.checkpoints.Load(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("loading checkpoint [%s]: %w", key, err)
+		}
+		statuses = append(statuses, CollectionStatus{Namespace: cmd.namespace(), Target: cmd.target, Checkpoint: cp})
+	}
+	return statuses, nil
+}
@@ -0,0 +1,49 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+)
+
+func TestStatus(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	clusterTime := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	source := mongo2.NewMemorySource()
+	for _, coll := range []string{"coll1", "coll2"} {
+		if err := source.Insert(Namespace{Database: "db1", Collection: coll}, bson.M{"_id": oid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkpoints := mongo2.NewMemoryCheckpoints()
+	if err := checkpoints.Save(context.Background(), "db1.coll1", "token1", clusterTime); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := New(source, &recordingSink{}, WithCheckpoints(checkpoints)).Status(context.Background(), config.SyncMapping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != 2 {
+		t.Fatalf("Status() got %d collections, want 2", len(statuses))
+	}
+	if got := statuses[0]; got.Namespace.Collection != "coll1" || got.Checkpoint.Token != "token1" || !got.Checkpoint.ClusterTime.Equal(clusterTime) {
+		t.Errorf("Status() coll1 = %+v, want checkpoint token1 at %v", got, clusterTime)
+	}
+	if got := statuses[1]; got.Namespace.Collection != "coll2" || got.Checkpoint.Token != "" {
+		t.Errorf("Status() coll2 = %+v, want no checkpoint", got)
+	}
+
+	if _, err = New(source, &recordingSink{}).Status(context.Background(), config.SyncMapping{}); err == nil {
+		t.Error("Status() without checkpoints error = nil, want error")
+	}
+}
@@ -2,39 +2,80 @@ package syncer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/olivere/elastic"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"mongo-elastic-sync/config"
 	"mongo-elastic-sync/fields"
 	"mongo-elastic-sync/logger"
 	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
 )
 
 const (
-	// MsgDumpingCompleted is the message printed out by the binary after dumping.
+	// MsgDumpingCompleted is the message printed out by the binary to stderr after dumping. Stdout is left to sinks.
 	// I use this to track when to stop the dumping tests. Is there a better way?
 	MsgDumpingCompleted = "Dumping completed, now tailing"
+
+	// dumpBatchSize is the number of documents indexed in each bulk request while dumping
+	dumpBatchSize = 500
 )
 
 var log = logger.Log
 
 // New returns a new syncer.
-func New(mongoClient *mongo.Client, elasticClient *elastic.Client) *syncer {
-	return &syncer{mongoClient: mongoClient, elasticClient: elasticClient}
+func New(source mongo2.Source, snk sink.Sink, opts ...Option) *syncer {
+	s := &syncer{source: source, connections: make(map[string]*syncer)}
+	s.setSink(snk)
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	// Each connection writes with the same options as the default sink
+	for name, c := range s.connections {
+		conn := *s
+		conn.setSink(c.sink)
+		s.connections[name] = &conn
+	}
+	return s
+}
+
+// setSink sets the sink the syncer writes to and resets the state it keeps about it.
+func (s *syncer) setSink(snk sink.Sink) {
+	s.sink = snk
+	s.querySink, _ = snk.(sink.QuerySink)
+	s.ensuredIndexes = &sync.Map{}
 }
 
 // syncer syncs documents from Mongo into Elasticsearch.
 type syncer struct {
-	mongoClient   *mongo.Client
-	elasticClient *elastic.Client
+	source mongo2.Source
+	sink   sink.Sink
+	// querySink is the sink if it is a QuerySink, or nil
+	querySink     sink.QuerySink
+	filters       []Filter
+	transformers  []Transformer
+	eventHandlers []EventHandler
+	// ensuredIndexes is the set of indexes known to exist
+	ensuredIndexes *sync.Map
+	// checkpoints saves the resume tokens of change streams, or is nil if tailing always starts after the dump
+	checkpoints mongo2.Checkpoints
+	// transactions is set if the collections are tailed in one change stream that groups events by transaction
+	transactions bool
+	// connections are the syncers that write to the named sinks of collection targets
+	connections map[string]*syncer
+	// replay is the position all change streams start at regardless of their checkpoints, or nil
+	replay *Position
+	// sample is the maximum number of documents dumped from each collection, or 0 to dump all documents
+	sample int
 }
 
 // Sync synchronizes MongoDB and Elasticsearch as configured by syncMapping.
@@ -42,132 +83,283 @@ type syncer struct {
 // Elasticsearch indexes and then tails the change stream of the collections
 // and updates the indexes.
 func (s *syncer) Sync(ctx context.Context, syncMapping config.SyncMapping) error {
-	timeBeforeDump := time.Now().UTC().Unix()
+	collectionSyncCommands, err := s.collectionSyncCommands(ctx, syncMapping)
+	if err != nil {
+		return err
+	}
+
+	return s.syncCommands(ctx, collectionSyncCommands)
+}
 
+// Dump indexes all documents of the collections configured by syncMapping once, without tailing their change streams.
+// Collections are dumped even if they have a checkpoint. It returns an error if any collection failed to dump.
+func (s *syncer) Dump(ctx context.Context, syncMapping config.SyncMapping) error {
 	collectionSyncCommands, err := s.collectionSyncCommands(ctx, syncMapping)
 	if err != nil {
 		return err
 	}
 
-	// Dump documents in the Mongo databases according to the given config.
+	failed, err := s.dumpCommands(ctx, collectionSyncCommands, false)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d collections failed to dump", failed, len(collectionSyncCommands))
+	}
+	return nil
+}
 
-	var wg sync.WaitGroup
-	for _, collSyncCmd := range collectionSyncCommands {
-		wg.Add(1)
+// Tail tails the change streams of the collections configured by syncMapping without dumping them first, until ctx is
+// done or every tailer has died. Change streams start at the replay position, if the syncer has one, or resume after
+// their checkpoint. Otherwise, they start at the configured start position of their collection or now.
+func (s *syncer) Tail(ctx context.Context, syncMapping config.SyncMapping) error {
+	collectionSyncCommands, err := s.collectionSyncCommands(ctx, syncMapping)
+	if err != nil {
+		return err
+	}
 
-		// Dump collection to an elastic index in a new goroutine.
-		go func(collSyncCmd collectionSyncCommand) {
-			defer wg.Done()
-			if err := s.dumpCollection(ctx, collSyncCmd); err != nil {
-				log.With("collection", collSyncCmd.coll.Name()).Errorf("Dumper died: %+v", err)
+	return s.tailCommands(ctx, collectionSyncCommands, time.Now().UTC().Unix())
+}
+
+// syncCommands dumps and then tails the collections of collectionSyncCommands until ctx is done or every tailer has
+// died.
+func (s *syncer) syncCommands(ctx context.Context, collectionSyncCommands []collectionSyncCommand) error {
+	timeBeforeDump := time.Now().UTC().Unix()
+
+	// Dumping errors are logged, and the collections that failed are still tailed
+	if _, err := s.dumpCommands(ctx, collectionSyncCommands, true); err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintln(os.Stderr, MsgDumpingCompleted)
+
+	return s.tailCommands(ctx, collectionSyncCommands, timeBeforeDump)
+}
+
+// dumpCommands dumps the collections of collectionSyncCommands and returns the number of collections that failed to
+// dump. If resume is set, collections with a checkpoint are not dumped, unless they are marked for reindexing.
+func (s *syncer) dumpCommands(ctx context.Context, collectionSyncCommands []collectionSyncCommand, resume bool) (int, error) {
+	var failed int32
+
+	// Dump documents in the Mongo databases according to the given config.
+	// Collections that are indexed into the index of a parent collection are dumped after their parents.
+
+	for _, phase := range dumpPhases(collectionSyncCommands) {
+		var wg sync.WaitGroup
+		for _, collSyncCmd := range phase {
+			// Collections with a checkpoint were dumped before and resume tailing from it
+			if resume && !collSyncCmd.reindex {
+				resumable, err := s.resumable(ctx, collSyncCmd)
+				if err != nil {
+					return 0, err
+				}
+				if resumable {
+					log.With("collection", collSyncCmd.collMapping.Name, "target", collSyncCmd.target).Info("Resuming from checkpoint or start position, skipping dump")
+					continue
+				}
 			}
-		}(collSyncCmd)
+
+			wg.Add(1)
+
+			// Dump collection to an elastic index in a new goroutine.
+			go func(collSyncCmd collectionSyncCommand) {
+				defer wg.Done()
+				err := s.on(collSyncCmd).dumpCollection(ctx, collSyncCmd)
+				if err == nil {
+					err = s.markDumped(ctx, collSyncCmd)
+				}
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+					log.With("collection", collSyncCmd.collMapping.Name, "target", collSyncCmd.target).Errorf("Dumper died: %+v", err)
+				}
+			}(collSyncCmd)
+		}
+
+		// Wait for all goroutines to complete
+		wg.Wait()
 	}
 
-	// TODO: Report indexing errors from dumping, wait in separate goroutine, then select for stop signal or error signal
-	// Wait for all goroutines to complete
-	wg.Wait()
+	return int(failed), nil
+}
 
-	fmt.Println(MsgDumpingCompleted)
+// tailCommands tails the collections of collectionSyncCommands from startUnix, or their checkpoints, until ctx is done
+// or every tailer has died. Retention and reconciliation run in the background while tailing.
+func (s *syncer) tailCommands(ctx context.Context, collectionSyncCommands []collectionSyncCommand, startUnix int64) error {
+	// Delete expired indexes of rolled over collections and repair drift in the background
+	for _, collSyncCmd := range collectionSyncCommands {
+		go s.on(collSyncCmd).enforceRetention(ctx, collSyncCmd)
+		go s.on(collSyncCmd).reconcile(ctx, collSyncCmd)
+	}
 
 	// Tail Mongo change stream for each collection
 	indexErrs := make(chan error)
-	for _, collSyncCmd := range collectionSyncCommands {
-		go func(collSyncCmd collectionSyncCommand) {
-			if err := s.tailCollection(ctx, timeBeforeDump, collSyncCmd, indexErrs); err != nil {
-				log.With("collection", collSyncCmd.coll.Name()).Errorf("Tailer died: %+v", err)
+	var tailers sync.WaitGroup
+	if s.transactions {
+		tailers.Add(1)
+		go func() {
+			defer tailers.Done()
+			if err := s.tailTransactions(ctx, startUnix, collectionSyncCommands, indexErrs); err != nil {
+				log.Errorf("Transaction tailer died: %+v", err)
 			}
-		}(collSyncCmd)
+		}()
 	}
+	for _, collSyncCmd := range collectionSyncCommands {
+		if !s.transactions {
+			tailers.Add(1)
+			go func(collSyncCmd collectionSyncCommand) {
+				defer tailers.Done()
+				if err := s.on(collSyncCmd).tailCollection(ctx, startUnix, collSyncCmd, indexErrs); err != nil {
+					log.With("collection", collSyncCmd.collMapping.Name, "target", collSyncCmd.target).Errorf("Tailer died: %+v", err)
+				}
+			}(collSyncCmd)
+		}
 
-	for {
-		select {
-		case err = <-indexErrs:
-			log.Errorf("Tailing error: %w", err)
+		// Re-index documents when the documents they join change
+		for _, l := range collSyncCmd.collMapping.Lookups {
+			tailers.Add(1)
+			go func(collSyncCmd collectionSyncCommand, l config.Lookup) {
+				defer tailers.Done()
+				if err := s.on(collSyncCmd).tailLookup(ctx, startUnix, collSyncCmd, l, indexErrs); err != nil {
+					log.With("collection", collSyncCmd.collMapping.Name, "target", collSyncCmd.target, "lookup", l.From).Errorf("Lookup tailer died: %+v", err)
+				}
+			}(collSyncCmd, l)
 		}
 	}
+
+	go func() {
+		tailers.Wait()
+		close(indexErrs)
+	}()
+
+	// Report tailing errors until the tailers stop when ctx is done
+	for err := range indexErrs {
+		log.Errorf("Tailing error: %w", err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("all tailers died")
 }
 
 // dumpCollection indexes all documents in the given collection to Elasticsearch.
 // It returns errors that occur while creating the index or getting a cursor.
 // TODO: If an error occurs wile indexing a document, return through a provided error channel and continue indexing.
 func (s *syncer) dumpCollection(ctx context.Context, cmd collectionSyncCommand) error {
-	idxName := indexName(cmd.collMapping.Name, cmd.dbMapping.Name)
+	idxName := cmd.indexName()
 
-	log := log.With("collection", cmd.collMapping.Name, "database", cmd.dbMapping.Name, "index", idxName)
+	log := log.With("collection", cmd.collMapping.Name, "database", cmd.dbMapping.Name, "target", cmd.target, "index", idxName)
 
 	log.Infof("Starting dump")
 
-	idxExists, err := s.elasticClient.IndexExists(idxName).Do(ctx)
-	if err != nil {
-		return err
-	}
-
-	if idxExists {
-		log.Info("Index already exists, skipping create")
-	} else {
-		log.Info("Index does not exist, creating")
-		if _, err := s.elasticClient.CreateIndex(idxName).Do(ctx); err != nil {
+	// Routed collections create their indexes as documents are routed to them
+	if cmd.router == nil {
+		if err := s.ensureIndex(ctx, idxName, cmd.joinMapping()); err != nil {
 			return err
 		}
-		log.Info("Index created")
 	}
 
-	cursor, err := cmd.coll.Find(ctx, bson.D{})
+	cursor, err := s.collectionCursor(ctx, cmd)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	defer func() { logIfErr(cursor.Close(ctx)) }()
 
+	// Index documents in batches
 	indexCount := 0
-	for cursor.Next(ctx) {
+	batch := make([]sink.Op, 0, dumpBatchSize)
+	flush := func() error {
+		if err := s.sink.Bulk(ctx, batch); err != nil {
+			return err
+		}
+		indexCount += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for (s.sample == 0 || indexCount+len(batch) < s.sample) && cursor.Next(ctx) {
 		err = func() error {
 			var doc map[string]interface{}
 			if err = cursor.Decode(&doc); err != nil {
 				return err
 			}
 
-			return s.indexDocument(ctx, idxName, doc, cmd.collMapping.Fields)
+			if err = selectLookupFields(doc, cmd.lookups()); err != nil {
+				return err
+			}
+
+			prepared, include, err := s.prepareDocument(ctx, cmd, doc)
+			if err != nil || !include {
+				return err
+			}
+
+			index := idxName
+			if cmd.router != nil {
+				if index, err = s.routeDocument(ctx, cmd, doc); err != nil {
+					return err
+				}
+			}
+
+			batch = append(batch, indexOp(index, prepared, cmd.routing(doc)))
+			if len(batch) == dumpBatchSize {
+				return flush()
+			}
+			return nil
 		}()
 		if err != nil {
 			// 	TODO: Chan
 			return err
 		}
+	}
 
-		indexCount += 1
+	if err = flush(); err != nil {
+		return err
 	}
 
 	log.Infof("Completed dump, count=%v", indexCount)
 	return nil
 }
 
+// collectionCursor returns a cursor over all documents of the collection, with their lookups joined.
+func (s syncer) collectionCursor(ctx context.Context, cmd collectionSyncCommand) (mongo2.Cursor, error) {
+	if lookups := cmd.lookups(); len(lookups) > 0 {
+		return s.source.Aggregate(ctx, cmd.namespace(), lookupPipeline(lookups))
+	}
+	return s.source.Find(ctx, cmd.namespace(), bson.D{})
+}
+
 // tailCollection watches for changes on the given Mongo collection and updates the matching Elasticsearch index.
 // It returns an error if the change stream cursor cannot be obtained, but errors that occur while decoding or
 // indexing a single document are reported through indexErrs.
 func (s syncer) tailCollection(ctx context.Context, startUnix int64, cmd collectionSyncCommand, indexErrs chan<- error) error {
-	opts := options.ChangeStream().
-		SetFullDocument(options.UpdateLookup).
-		SetStartAtOperationTime(&primitive.Timestamp{T: uint32(startUnix)})
-
-	stream, err := cmd.coll.Watch(ctx, []bson.M{}, opts)
+	key := checkpointKey(cmd)
+	opts, err := s.watchOptions(ctx, key, startUnix, cmd.startAt)
 	if err != nil {
 		return err
 	}
 
+	stream, err := s.source.Watch(ctx, cmd.namespace(), opts)
+	if err != nil {
+		return fmt.Errorf("starting change stream %s: %w", opts, err)
+	}
+
 	defer func() { logIfErr(stream.Close(ctx)) }()
 
-	index := indexName(cmd.collMapping.Name, cmd.dbMapping.Name)
+	index := cmd.indexName()
 
 	log := log.With(
 		"collection", cmd.collMapping.Name,
 		"database", cmd.dbMapping.Name,
+		"target", cmd.target,
 		"index", index,
 		"action", "tailing",
 	)
 
 	log.Info("Listening for new events")
 
+	// failed is set once an event fails to apply. The checkpoint then stays before it, so that the event is applied
+	// again when the change stream resumes after a restart or a handover.
+	failed := false
 	for {
 		log.Info("Listening for next stream event")
 		if !stream.Next(ctx) {
@@ -180,59 +372,259 @@ func (s syncer) tailCollection(ctx context.Context, startUnix int64, cmd collect
 
 		evt := mongo2.ChangeStreamEvent{}
 		if err = stream.Decode(&evt); err != nil {
-			indexErrs <- fmt.Errorf("collection [%s]: %w", cmd.coll.Name(), err)
+			indexErrs <- fmt.Errorf("%s: %w", cmd, err)
 			continue
 		}
 
 		log.With("eventType", evt.OperationType).Info("Received new stream event")
 
-		if err = s.handleStreamEvent(ctx, evt, cmd.collMapping, index); err != nil {
-			indexErrs <- fmt.Errorf("collection [%s]: %w", cmd.coll.Name(), err)
+		if err = s.handleStreamEvent(ctx, evt, cmd, index); err != nil {
+			indexErrs <- fmt.Errorf("%s: %w", cmd, err)
+			failed = true
+		}
+		if failed {
 			continue
 		}
+
+		if err = s.saveCheckpoint(ctx, key, evt); err != nil {
+			indexErrs <- fmt.Errorf("%s: %w", cmd, err)
+		}
 	}
 }
 
 // handleStreamEvent performs an action corresponding to the operation type of the change stream event.
-func (s syncer) handleStreamEvent(ctx context.Context, evt mongo2.ChangeStreamEvent, collMapping config.CollectionMapping, index string) error {
+// Registered event handlers are called first and may skip the default action by returning ErrSkipEvent.
+func (s syncer) handleStreamEvent(ctx context.Context, evt mongo2.ChangeStreamEvent, cmd collectionSyncCommand, index string) error {
+	for _, h := range s.eventHandlers {
+		if err := h.HandleEvent(ctx, evt); err != nil {
+			if errors.Is(err, ErrSkipEvent) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return s.applyEvent(ctx, evt, cmd, index)
+}
+
+// applyEvent applies a change stream event of the command's collection to the index.
+func (s syncer) applyEvent(ctx context.Context, evt mongo2.ChangeStreamEvent, cmd collectionSyncCommand, index string) error {
+	if cmd.collMapping.Embed != nil {
+		return s.handleEmbeddedEvent(ctx, evt, cmd, index)
+	}
 
 	// TODO: Handle all other event types, as listed in: https://docs.mongodb.com/manual/reference/change-events/#change-stream-output
 	switch evt.OperationType {
 	case mongo2.ChangeStreamEventOperationTypeInsert, mongo2.ChangeStreamEventOperationTypeReplace, mongo2.ChangeStreamEventOperationTypeUpdate:
-		return s.indexDocument(ctx, index, evt.FullDocument, collMapping.Fields)
+		if evt.FullDocument == nil {
+			// The document was deleted before its update could be looked up. The delete event will follow.
+			return nil
+		}
+		if err := s.syncDocument(ctx, cmd, index, evt.FullDocument); err != nil {
+			return err
+		}
+		if evt.OperationType == mongo2.ChangeStreamEventOperationTypeInsert {
+			return nil
+		}
+
+		// Updated documents may have been indexed elsewhere before the update
+		id := documentID(evt.DocumentKey.ID)
+		if cmd.router != nil && changesAny(evt, cmd.router.fields()) {
+			routedIndex, err := cmd.router.index(evt.FullDocument)
+			if err != nil {
+				return err
+			}
+			return s.deleteMovedDocument(ctx, index, id, routedIndex)
+		}
+		if j := cmd.collMapping.Join; j != nil && j.Parent != "" && evt.Changes(j.ParentField) {
+			return s.deleteMovedChild(ctx, index, id, cmd.routing(evt.FullDocument))
+		}
+		return nil
 	case mongo2.ChangeStreamEventOperationTypeDelete:
-		return s.deleteDocument(ctx, index, evt.DocumentKey.ID.Hex())
+		// In sharded collections, the document key includes the shard key, which may select the document's index or
+		// routing
+		key := evt.DocumentKey.Document()
+		if cmd.router != nil {
+			return s.deleteRoutedDocument(ctx, cmd, index, key)
+		}
+		if cmd.collMapping.Join != nil {
+			return s.deleteJoinedDocument(ctx, cmd, index, key)
+		}
+		return s.deleteDocument(ctx, index, documentID(evt.DocumentKey.ID), "")
 	}
 	return nil
 }
 
-func (s syncer) indexDocument(ctx context.Context, index string, doc map[string]interface{}, fieldMapping []fields.M) error {
-	id := doc["_id"].(primitive.ObjectID)
+// syncDocument joins, filters and maps the full Mongo document doc and indexes the result.
+// If the filters exclude the document or it is soft-deleted, it is deleted from the index instead, as it may have been
+// indexed before an update excluded it.
+func (s syncer) syncDocument(ctx context.Context, cmd collectionSyncCommand, index string, doc map[string]interface{}) error {
+	if err := s.lookupDocument(ctx, cmd, doc); err != nil {
+		return err
+	}
 
-	doc, err := fields.Select(doc, fieldMapping)
+	if cmd.router != nil {
+		var err error
+		if index, err = s.routeDocument(ctx, cmd, doc); err != nil {
+			return err
+		}
+	}
+
+	prepared, include, err := s.prepareDocument(ctx, cmd, doc)
 	if err != nil {
-		return fmt.Errorf("mapping document [%s]: %w", id.Hex(), err)
+		return err
+	}
+	if !include {
+		return s.deleteDocument(ctx, index, documentID(doc["_id"]), cmd.routing(doc))
+	}
+	return s.indexDocument(ctx, index, prepared, cmd.routing(doc))
+}
+
+// prepareDocument runs the registered filters on doc and, if the document is included and not soft-deleted, selects
+// the mapped fields and runs the registered transformers on the result.
+func (s syncer) prepareDocument(ctx context.Context, cmd collectionSyncCommand, doc map[string]interface{}) (map[string]interface{}, bool, error) {
+	id := doc["_id"]
+	ns := cmd.namespace()
+
+	for _, f := range s.filters {
+		include, err := f.Include(ctx, ns, doc)
+		if err != nil {
+			return nil, false, fmt.Errorf("filtering document [%v]: %w", id, err)
+		}
+		if !include {
+			return nil, false, nil
+		}
+	}
+
+	deleted := cmd.softDeleted(doc)
+	if deleted && cmd.collMapping.SoftDelete.Flag == "" {
+		return nil, false, nil
+	}
+
+	selected, err := fields.Select(doc, cmd.collMapping.Fields)
+	if err != nil {
+		return nil, false, fmt.Errorf("mapping document [%v]: %w", id, err)
+	}
+
+	// Joined documents are always kept, whether or not their field is mapped.
+	for _, l := range cmd.lookups() {
+		if joined, ok := doc[l.As]; ok {
+			selected[l.As] = joined
+		}
+	}
+
+	prepared := selected
+	for _, t := range s.transformers {
+		if prepared, err = t.Transform(ctx, ns, prepared); err != nil {
+			return nil, false, fmt.Errorf("transforming document [%v]: %w", id, err)
+		}
+		if prepared == nil {
+			return nil, false, nil
+		}
+	}
+
+	if sd := cmd.collMapping.SoftDelete; sd != nil && sd.Flag != "" {
+		prepared[sd.Flag] = deleted
 	}
 
+	if j := cmd.collMapping.Join; j != nil {
+		prepared[j.Field] = joinValue(j, doc)
+	}
+
+	// fields.Select drops _id unless it is mapped. Restore it so the document can be indexed by its Mongo id.
+	prepared["_id"] = id
+	return prepared, true, nil
+}
+
+// ensureIndex creates the index with the given create index request body, which may be nil, if it does not exist.
+func (s syncer) ensureIndex(ctx context.Context, index string, body map[string]interface{}) error {
+	if _, ok := s.ensuredIndexes.Load(index); ok {
+		return nil
+	}
+
+	if err := s.sink.EnsureIndex(ctx, index, body); err != nil {
+		return err
+	}
+
+	log.With("index", index).Info("Index ready")
+	s.ensuredIndexes.Store(index, true)
+	return nil
+}
+
+// indexDocument indexes doc into the index. If routing is not empty, the document is routed with it.
+func (s syncer) indexDocument(ctx context.Context, index string, doc map[string]interface{}, routing string) error {
+	op := indexOp(index, doc, routing)
+	return s.sink.Index(ctx, op.Index, op.ID, op.Routing, op.Body)
+}
+
+// indexOp returns the operation that indexes doc into the index.
+func indexOp(index string, doc map[string]interface{}, routing string) sink.Op {
+	id := doc["_id"]
+
 	// _id is reserved as a metadata field in Elasticsearch and cannot be added to a document. Rename to id.
 	doc["id"] = id
 	delete(doc, "_id")
 
-	_, err = s.elasticClient.Index().
-		Index(index).Type(index).
-		Id(id.Hex()).BodyJson(doc).Do(ctx)
-	return err
+	return sink.Op{Action: sink.ActionIndex, Index: index, ID: documentID(id), Routing: routing, Body: doc}
 }
 
-func (s syncer) deleteDocument(ctx context.Context, index string, id string) error {
-	_, err := s.elasticClient.Delete().Index(index).Type(index).Id(id).Do(ctx)
-	return err
+// deleteDocument deletes the document with the given id from the index. It is not an error if the document does not exist.
+// If routing is not empty, the document is looked up with it.
+func (s syncer) deleteDocument(ctx context.Context, index string, id string, routing string) error {
+	return s.sink.Delete(ctx, index, id, routing)
 }
 
 type collectionSyncCommand struct {
-	coll        *mongo.Collection
 	collMapping config.CollectionMapping
 	dbMapping   config.DatabaseMapping
+	// embedded are the mappings of the child collections embedded into this collection's documents
+	embedded []config.CollectionMapping
+	// joinChildren are the relation names of the child collections joined to this collection's documents
+	joinChildren []string
+	// router selects the index of each document, if the collection routes its documents to multiple indexes
+	router indexRouter
+	// target is the name of the collection target the command syncs, or empty for the collection's own index
+	target string
+	// connection is the name of the connection the target writes to, or empty for the default sink
+	connection string
+	// startAt is the position the change stream of the collection starts at if it has no checkpoint, or nil to dump
+	// the collection and start tailing where the dump started
+	startAt *Position
+	// reindex is set if the collection is dumped even if it can resume tailing, because its mapping changed
+	reindex bool
+}
+
+// indexName returns the Elasticsearch index of the collection.
+// Collections with an index template without actions use the index it names. Embedded and joined child collections
+// use their parent's index. Routed collections return a wildcard pattern matching all their indexes.
+func (c collectionSyncCommand) indexName() string {
+	if c.router != nil {
+		return c.router.pattern()
+	}
+	if c.collMapping.Index != "" {
+		return strings.ToLower(c.collMapping.Index)
+	}
+	if c.collMapping.Embed != nil {
+		return indexName(c.collMapping.Embed.Parent, c.dbMapping.Name)
+	}
+	if c.collMapping.Join != nil && c.collMapping.Join.Parent != "" {
+		return indexName(c.collMapping.Join.Parent, c.dbMapping.Name)
+	}
+	return indexName(c.collMapping.Name, c.dbMapping.Name)
+}
+
+// lookups returns the configured lookups of the collection and the lookups that join its embedded collections.
+func (c collectionSyncCommand) lookups() []config.Lookup {
+	lookups := append([]config.Lookup{}, c.collMapping.Lookups...)
+	for _, child := range c.embedded {
+		lookups = append(lookups, embedLookup(child))
+	}
+	return lookups
+}
+
+// namespace returns the namespace of the collection.
+func (c collectionSyncCommand) namespace() Namespace {
+	return Namespace{Database: c.dbMapping.Name, Collection: c.collMapping.Name}
 }
 
 func (s syncer) collectionSyncCommands(ctx context.Context, syncMapping config.SyncMapping) ([]collectionSyncCommand, error) {
@@ -243,51 +635,137 @@ func (s syncer) collectionSyncCommands(ctx context.Context, syncMapping config.S
 		includedDBs[database.Name] = database
 	}
 
-	listDatabasesResult, err := s.mongoClient.ListDatabases(ctx, bson.D{})
+	dbFilter, err := mongo2.NewNameFilter(syncMapping.Include, syncMapping.Exclude)
 	if err != nil {
 		return nil, err
 	}
 
-	databases := make(map[*mongo.Database]config.DatabaseMapping, len(listDatabasesResult.Databases))
-	for _, database := range listDatabasesResult.Databases {
-		if !mongo2.IsSystemDB(database.Name) {
-			if len(includedDBs) == 0 {
-				databases[s.mongoClient.Database(database.Name)] = config.DatabaseMapping{Name: database.Name}
-			} else if dbConf, ok := includedDBs[database.Name]; ok {
-				databases[s.mongoClient.Database(database.Name)] = dbConf
-			}
+	databaseNames, err := s.source.ListDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	databases := make([]config.DatabaseMapping, 0, len(databaseNames))
+	for _, databaseName := range databaseNames {
+		if mongo2.IsSystemDB(databaseName) {
+			continue
+		}
+
+		dbConf, listed := includedDBs[databaseName]
+		if !isSelected(databaseName, listed, len(includedDBs) > 0, dbFilter) {
+			continue
+		}
+		if !listed {
+			dbConf = config.DatabaseMapping{Name: databaseName}
 		}
+		databases = append(databases, dbConf)
 	}
 
-	for database, dbMapping := range databases {
-		collections := make(map[*mongo.Collection]config.CollectionMapping)
+	for _, dbMapping := range databases {
+		var collections []config.CollectionMapping
 
 		includedCollections := make(map[string]config.CollectionMapping, len(dbMapping.Collections))
 		for _, collection := range dbMapping.Collections {
 			includedCollections[collection.Name] = collection
 		}
 
-		collectionNames, err := database.ListCollectionNames(ctx, bson.D{})
+		collFilter, err := mongo2.NewNameFilter(dbMapping.Include, dbMapping.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("database [%s]: %w", dbMapping.Name, err)
+		}
+
+		// Views cannot be watched, so they are not listed
+		collectionNames, err := s.source.ListCollections(ctx, dbMapping.Name)
 		if err != nil {
 			return nil, err
 		}
 
 		for _, collectionName := range collectionNames {
-			if len(includedCollections) == 0 {
-				collections[database.Collection(collectionName)] = config.CollectionMapping{Name: collectionName}
-			} else if collConf, ok := includedCollections[collectionName]; ok {
-				collections[database.Collection(collectionName)] = collConf
+			if mongo2.IsSystemCollection(collectionName) {
+				continue
+			}
+
+			collConf, listed := includedCollections[collectionName]
+			if !isSelected(collectionName, listed, len(includedCollections) > 0, collFilter) {
+				continue
+			}
+			if !listed {
+				collConf = config.CollectionMapping{Name: collectionName}
 			}
+			collections = append(collections, collConf)
 		}
 
-		for coll, collMapping := range collections {
-			collectionSyncCommands = append(collectionSyncCommands, collectionSyncCommand{coll: coll, collMapping: collMapping, dbMapping: dbMapping})
+		for _, collMapping := range collections {
+			cmds, err := s.targetCommands(collMapping, dbMapping)
+			if err != nil {
+				return nil, fmt.Errorf("collection [%s]: %w", collMapping.Name, err)
+			}
+
+			for _, cmd := range cmds {
+				if cmd.router, err = newIndexRouter(cmd.collMapping, dbMapping.Name); err != nil {
+					return nil, fmt.Errorf("%s: %w", cmd, err)
+				}
+				if collMapping.StartAt != "" {
+					startAt, err := ParsePosition(collMapping.StartAt)
+					if err != nil {
+						return nil, fmt.Errorf("%s: startAt: %w", cmd, err)
+					}
+					cmd.startAt = &startAt
+				}
+				collectionSyncCommands = append(collectionSyncCommands, cmd)
+			}
+		}
+	}
+
+	if err := linkEmbedded(collectionSyncCommands); err != nil {
+		return nil, err
+	}
+
+	if err := linkJoined(collectionSyncCommands); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range collectionSyncCommands {
+		if _, ok := s.on(cmd).sink.(sink.Reader); cmd.collMapping.Reconcile != nil && !ok {
+			return nil, fmt.Errorf("%s: reconciling needs an Elasticsearch sink: %w", cmd, sink.ErrUnsupported)
+		}
+		if s.on(cmd).querySink != nil {
+			continue
+		}
+		if cmd.collMapping.Embed != nil || cmd.collMapping.Join != nil || cmd.router != nil {
+			return nil, fmt.Errorf("%s: embedded, joined and routed collections need an Elasticsearch sink: %w", cmd, sink.ErrUnsupported)
 		}
 	}
 
 	return collectionSyncCommands, nil
 }
 
+// isSelected returns true if the database or collection called name should be synced, given whether it is listed in
+// the sync mapping, whether any names are listed, and the include and exclude patterns of the mapping.
+func isSelected(name string, listed, anyListed bool, filter mongo2.NameFilter) bool {
+	if filter.Excluded(name) {
+		return false
+	}
+	return listed || filter.Included(name) || (!anyListed && !filter.HasIncludes())
+}
+
+// dumpPhases groups cmds into the phases in which they must be dumped.
+// Joined child collections are dumped after their parents have created the shared index.
+// Embedded collections are dumped with their parents and are not included.
+func dumpPhases(cmds []collectionSyncCommand) [][]collectionSyncCommand {
+	var parents, children []collectionSyncCommand
+	for _, cmd := range cmds {
+		switch {
+		case cmd.collMapping.Embed != nil:
+		case cmd.collMapping.Join != nil && cmd.collMapping.Join.Parent != "":
+			children = append(children, cmd)
+		default:
+			parents = append(parents, cmd)
+		}
+	}
+	return [][]collectionSyncCommand{parents, children}
+}
+
 // indexName returns the Elasticsearch index name for the given Mongo collection and database.
 func indexName(collName, dbName string) string {
 	return fmt.Sprintf("%s.%s", dbName, collName)
@@ -298,3 +776,11 @@ func logIfErr(err error) {
 		log.Error(err)
 	}
 }
+
+// documentID returns the Elasticsearch document id for the Mongo document id v.
+func documentID(v interface{}) string {
+	if id, ok := v.(primitive.ObjectID); ok {
+		return id.Hex()
+	}
+	return fmt.Sprint(v)
+}
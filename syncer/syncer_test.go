@@ -0,0 +1,585 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+func TestIsSelected(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		listed    bool
+		anyListed bool
+		include   []string
+		exclude   []string
+		want      bool
+	}{
+		{name: "nothing configured", in: "db1", want: true},
+		{name: "listed", in: "db1", listed: true, anyListed: true, want: true},
+		{name: "not listed", in: "db2", anyListed: true, want: false},
+		{name: "included", in: "tenant_1", include: []string{"tenant_*"}, want: true},
+		{name: "not included", in: "db1", include: []string{"tenant_*"}, want: false},
+		{name: "listed or included", in: "tenant_1", anyListed: true, include: []string{"tenant_*"}, want: true},
+		{name: "excluded", in: "tmp", exclude: []string{"tmp"}, want: false},
+		{name: "exclude wins over listed", in: "tmp", listed: true, anyListed: true, exclude: []string{"tmp"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := mongo2.NewNameFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isSelected(tt.in, tt.listed, tt.anyListed, filter); got != tt.want {
+				t.Errorf("isSelected() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingSink is a sink that records the operations it receives, and the batches they were received in.
+type recordingSink struct {
+	mu      sync.Mutex
+	ops     []sink.Op
+	batches [][]sink.Op
+}
+
+func (s *recordingSink) EnsureIndex(ctx context.Context, index string, body map[string]interface{}) error {
+	return nil
+}
+
+func (s *recordingSink) Index(ctx context.Context, index, id, routing string, doc interface{}) error {
+	return s.Bulk(ctx, []sink.Op{{Action: sink.ActionIndex, Index: index, ID: id, Routing: routing, Body: doc}})
+}
+
+func (s *recordingSink) Delete(ctx context.Context, index, id, routing string) error {
+	return s.Bulk(ctx, []sink.Op{{Action: sink.ActionDelete, Index: index, ID: id, Routing: routing}})
+}
+
+func (s *recordingSink) Bulk(ctx context.Context, ops []sink.Op) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, ops...)
+	s.batches = append(s.batches, append([]sink.Op{}, ops...))
+	return nil
+}
+
+// recordingQuerySink is a recordingSink that also records the scripted updates and the operations by query it
+// receives, with their queries and scripts as JSON.
+type recordingQuerySink struct {
+	recordingSink
+	queryOps []queryOp
+}
+
+// queryOp is a scripted update of the document with ID, or an update or delete by Query if ID is empty.
+type queryOp struct {
+	Action string
+	Index  string
+	ID     string
+	Query  string
+	Script string
+}
+
+func (s *recordingQuerySink) Update(ctx context.Context, index, id string, script *elastic.Script) error {
+	return s.record(queryOp{Action: sink.ActionUpdate, Index: index, ID: id, Script: sourceJSON(script)})
+}
+
+func (s *recordingQuerySink) UpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script) error {
+	return s.record(queryOp{Action: sink.ActionUpdate, Index: index, Query: sourceJSON(query), Script: sourceJSON(script)})
+}
+
+func (s *recordingQuerySink) DeleteByQuery(ctx context.Context, index string, query elastic.Query) error {
+	return s.record(queryOp{Action: sink.ActionDelete, Index: index, Query: sourceJSON(query)})
+}
+
+func (s *recordingQuerySink) IndexNames(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (s *recordingQuerySink) DeleteIndex(ctx context.Context, indexes ...string) error {
+	return nil
+}
+
+func (s *recordingQuerySink) record(op queryOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queryOps = append(s.queryOps, op)
+	return nil
+}
+
+// sourceJSON returns the JSON of the source of a query or script.
+func sourceJSON(v interface{ Source() (interface{}, error) }) string {
+	src, err := v.Source()
+	if err != nil {
+		return err.Error()
+	}
+	b, err := json.Marshal(src)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+func TestSyncDocument(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	id := oid.Hex()
+
+	excludeArchived := WithFilter(FilterFunc(func(ctx context.Context, ns Namespace, doc map[string]interface{}) (bool, error) {
+		return doc["archived"] != true, nil
+	}))
+	upperName := WithTransformer(TransformerFunc(func(ctx context.Context, ns Namespace, doc map[string]interface{}) (map[string]interface{}, error) {
+		doc["name"] = strings.ToUpper(doc["name"].(string))
+		return doc, nil
+	}))
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		collMapping config.CollectionMapping
+		doc         map[string]interface{}
+		want        []sink.Op
+	}{
+		{
+			name:        "index selected fields",
+			collMapping: config.CollectionMapping{Name: "coll1", Fields: []fields.M{{Name: "name"}}},
+			doc:         map[string]interface{}{"_id": oid, "name": "a", "secret": "b"},
+			want:        []sink.Op{{Action: sink.ActionIndex, Index: "db1.coll1", ID: id, Body: map[string]interface{}{"id": oid, "name": "a"}}},
+		},
+		{
+			name:        "index document with string id",
+			collMapping: config.CollectionMapping{Name: "coll1"},
+			doc:         map[string]interface{}{"_id": "a", "name": "a"},
+			want:        []sink.Op{{Action: sink.ActionIndex, Index: "db1.coll1", ID: "a", Body: map[string]interface{}{"id": "a", "name": "a"}}},
+		},
+		{
+			name:        "delete filtered out document with int id",
+			opts:        []Option{excludeArchived},
+			collMapping: config.CollectionMapping{Name: "coll1"},
+			doc:         map[string]interface{}{"_id": int32(1), "archived": true},
+			want:        []sink.Op{{Action: sink.ActionDelete, Index: "db1.coll1", ID: "1"}},
+		},
+		{
+			name:        "delete filtered out document",
+			opts:        []Option{excludeArchived},
+			collMapping: config.CollectionMapping{Name: "coll1"},
+			doc:         map[string]interface{}{"_id": oid, "archived": true},
+			want:        []sink.Op{{Action: sink.ActionDelete, Index: "db1.coll1", ID: id}},
+		},
+		{
+			name:        "transform document",
+			opts:        []Option{upperName},
+			collMapping: config.CollectionMapping{Name: "coll1"},
+			doc:         map[string]interface{}{"_id": oid, "name": "a"},
+			want:        []sink.Op{{Action: sink.ActionIndex, Index: "db1.coll1", ID: id, Body: map[string]interface{}{"id": oid, "name": "A"}}},
+		},
+		{
+			name: "delete document excluded by transformer",
+			opts: []Option{WithTransformer(TransformerFunc(func(ctx context.Context, ns Namespace, doc map[string]interface{}) (map[string]interface{}, error) {
+				return nil, nil
+			}))},
+			collMapping: config.CollectionMapping{Name: "coll1"},
+			doc:         map[string]interface{}{"_id": oid, "name": "a"},
+			want:        []sink.Op{{Action: sink.ActionDelete, Index: "db1.coll1", ID: id}},
+		},
+		{
+			name:        "delete soft-deleted document",
+			collMapping: config.CollectionMapping{Name: "coll1", SoftDelete: &config.SoftDelete{Field: "isDeleted", Value: true}},
+			doc:         map[string]interface{}{"_id": oid, "isDeleted": true},
+			want:        []sink.Op{{Action: sink.ActionDelete, Index: "db1.coll1", ID: id}},
+		},
+		{
+			name:        "flag soft-deleted document",
+			collMapping: config.CollectionMapping{Name: "coll1", SoftDelete: &config.SoftDelete{Field: "deletedAt", Flag: "deleted"}},
+			doc:         map[string]interface{}{"_id": oid, "deletedAt": "yesterday"},
+			want:        []sink.Op{{Action: sink.ActionIndex, Index: "db1.coll1", ID: id, Body: map[string]interface{}{"id": oid, "deletedAt": "yesterday", "deleted": true}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snk := &recordingSink{}
+			s := New(nil, snk, tt.opts...)
+			cmd := collectionSyncCommand{collMapping: tt.collMapping, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+			if err := s.syncDocument(context.Background(), cmd, cmd.indexName(), tt.doc); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(snk.ops, tt.want) {
+				t.Errorf("syncDocument() ops = %+v, want %+v", snk.ops, tt.want)
+			}
+			// The document may be synced into other targets too
+			if _, ok := tt.doc["_id"]; !ok {
+				t.Errorf("syncDocument() removed _id from the document")
+			}
+		})
+	}
+}
+
+func TestSyncDocumentErrors(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	errFilter := errors.New("filter failed")
+	errTransform := errors.New("transform failed")
+
+	tests := []struct {
+		name    string
+		opt     Option
+		wantErr error
+	}{
+		{
+			name: "filter",
+			opt: WithFilter(FilterFunc(func(ctx context.Context, ns Namespace, doc map[string]interface{}) (bool, error) {
+				return false, errFilter
+			})),
+			wantErr: errFilter,
+		},
+		{
+			name: "transformer",
+			opt: WithTransformer(TransformerFunc(func(ctx context.Context, ns Namespace, doc map[string]interface{}) (map[string]interface{}, error) {
+				return nil, errTransform
+			})),
+			wantErr: errTransform,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snk := &recordingSink{}
+			s := New(nil, snk, tt.opt)
+			cmd := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+			err := s.syncDocument(context.Background(), cmd, cmd.indexName(), map[string]interface{}{"_id": oid})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("syncDocument() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(snk.ops) != 0 {
+				t.Errorf("syncDocument() ops = %+v, want none", snk.ops)
+			}
+		})
+	}
+}
+
+func TestHandleStreamEventHandlers(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	errHandler := errors.New("handler failed")
+
+	evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: map[string]interface{}{"_id": oid}}
+	evt.DocumentKey.ID = oid
+	indexed := []sink.Op{{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid.Hex(), Body: map[string]interface{}{"id": oid}}}
+
+	tests := []struct {
+		name    string
+		results []error
+		want    []sink.Op
+		wantErr error
+		// wantCalls is the number of handlers called
+		wantCalls int
+	}{
+		{name: "default action", results: []error{nil, nil}, want: indexed, wantCalls: 2},
+		{name: "skip event", results: []error{ErrSkipEvent, nil}, wantCalls: 1},
+		{name: "wrapped skip event", results: []error{nil, fmt.Errorf("ignored: %w", ErrSkipEvent)}, wantCalls: 2},
+		{name: "error", results: []error{errHandler, nil}, wantErr: errHandler, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			var opts []Option
+			for _, result := range tt.results {
+				result := result
+				opts = append(opts, WithEventHandler(EventHandlerFunc(func(ctx context.Context, got mongo2.ChangeStreamEvent) error {
+					calls++
+					if !reflect.DeepEqual(got, evt) {
+						t.Errorf("HandleEvent() called with %+v, want %+v", got, evt)
+					}
+					return result
+				})))
+			}
+
+			snk := &recordingSink{}
+			s := New(nil, snk, opts...)
+			cmd := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+			err := s.handleStreamEvent(context.Background(), evt, cmd, cmd.indexName())
+			if err != tt.wantErr {
+				t.Errorf("handleStreamEvent() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handleStreamEvent() called %d handlers, want %d", calls, tt.wantCalls)
+			}
+			if !reflect.DeepEqual(snk.ops, tt.want) {
+				t.Errorf("handleStreamEvent() ops = %+v, want %+v", snk.ops, tt.want)
+			}
+		})
+	}
+}
+
+func TestDumpCollection(t *testing.T) {
+	oid1, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	oid2, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+	authorID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837e")
+
+	source := mongo2.NewMemorySource()
+	if err := source.Insert(Namespace{Database: "db1", Collection: "posts"},
+		bson.M{"_id": oid1, "title": "a", "author": authorID},
+		bson.M{"_id": oid2, "title": "b", "author": authorID, "archived": true},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Insert(Namespace{Database: "db1", Collection: "authors"}, bson.M{"_id": authorID, "name": "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	excludeArchived := WithFilter(FilterFunc(func(ctx context.Context, ns Namespace, doc map[string]interface{}) (bool, error) {
+		return doc["archived"] != true, nil
+	}))
+
+	snk := &recordingSink{}
+	s := New(source, snk, excludeArchived)
+	cmd := collectionSyncCommand{
+		collMapping: config.CollectionMapping{
+			Name:    "posts",
+			Fields:  []fields.M{{Name: "title"}},
+			Lookups: []config.Lookup{{From: "authors", LocalField: "author", ForeignField: "_id", As: "authors"}},
+		},
+		dbMapping: config.DatabaseMapping{Name: "db1"},
+	}
+
+	if err := s.dumpCollection(context.Background(), cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sink.Op{{Action: sink.ActionIndex, Index: "db1.posts", ID: oid1.Hex(), Body: map[string]interface{}{
+		"id":      oid1,
+		"title":   "a",
+		"authors": primitive.A{map[string]interface{}{"id": authorID, "name": "c"}},
+	}}}
+	if !reflect.DeepEqual(snk.ops, want) {
+		t.Errorf("dumpCollection() ops = %+v, want %+v", snk.ops, want)
+	}
+}
+
+// failingSink is a sink whose bulk requests fail.
+type failingSink struct {
+	recordingSink
+	err error
+}
+
+func (s *failingSink) Bulk(ctx context.Context, ops []sink.Op) error {
+	return s.err
+}
+
+func TestDump(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	errBulk := errors.New("bulk failed")
+
+	source := mongo2.NewMemorySource()
+	for _, coll := range []string{"coll1", "coll2"} {
+		if err := source.Insert(Namespace{Database: "db1", Collection: coll}, bson.M{"_id": oid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Collections with a checkpoint are dumped too
+	checkpoints := mongo2.NewMemoryCheckpoints()
+	if err := checkpoints.Save(context.Background(), "db1.coll1", "token1", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	snk := &recordingSink{}
+	if err := New(source, snk, WithCheckpoints(checkpoints)).Dump(context.Background(), config.SyncMapping{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(snk.ops) != 2 {
+		t.Errorf("Dump() ops = %+v, want 2", snk.ops)
+	}
+
+	err := New(source, &failingSink{err: errBulk}).Dump(context.Background(), config.SyncMapping{})
+	if want := "2 of 2 collections failed to dump"; err == nil || err.Error() != want {
+		t.Errorf("Dump() error = %v, want %s", err, want)
+	}
+}
+
+func TestDumpSample(t *testing.T) {
+	ns := Namespace{Database: "db1", Collection: "coll1"}
+	source := mongo2.NewMemorySource()
+	for i := 0; i < 3; i++ {
+		if err := source.Insert(ns, bson.M{"_id": primitive.NewObjectID(), "n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Excluded documents do not count towards the sample
+	excludeFirst := WithFilter(FilterFunc(func(ctx context.Context, ns Namespace, doc map[string]interface{}) (bool, error) {
+		return doc["n"] != int32(0), nil
+	}))
+
+	snk := &recordingSink{}
+	if err := New(source, snk, excludeFirst, WithSample(1)).Dump(context.Background(), config.SyncMapping{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(snk.ops) != 1 || snk.ops[0].Body.(map[string]interface{})["n"] != int32(1) {
+		t.Errorf("Dump() ops = %+v, want the document with n = 1", snk.ops)
+	}
+}
+
+func TestTailCollection(t *testing.T) {
+	oid1, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	oid2, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+	ns := Namespace{Database: "db1", Collection: "coll1"}
+	start := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	errStream := errors.New("stream died")
+
+	event := func(evt mongo2.ChangeStreamEvent, id primitive.ObjectID, at time.Time) mongo2.ChangeStreamEvent {
+		evt.DocumentKey.ID = id
+		evt.ClusterTime = at
+		return evt
+	}
+
+	source := mongo2.NewMemorySource()
+	source.AddEvents(ns,
+		event(mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: map[string]interface{}{"_id": oid1, "name": "before start"}}, oid1, start.Add(-time.Second)),
+		event(mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: map[string]interface{}{"_id": oid1, "name": "a"}}, oid1, start),
+		event(mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: map[string]interface{}{"_id": oid2, "name": "b"}}, oid2, start.Add(time.Second)),
+		// The document was deleted before the update could be looked up
+		event(mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate}, oid2, start.Add(2*time.Second)),
+		event(mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete}, oid1, start.Add(3*time.Second)),
+		event(mongo2.ChangeStreamEvent{OperationType: "drop"}, primitive.NilObjectID, start.Add(4*time.Second)),
+	)
+	source.SetStreamError(ns, errStream)
+
+	snk := &recordingSink{}
+	s := New(source, snk)
+	cmd := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+
+	err := s.tailCollection(context.Background(), start.Unix(), cmd, make(chan error))
+	if !errors.Is(err, errStream) {
+		t.Errorf("tailCollection() error = %v, want %v", err, errStream)
+	}
+
+	want := []sink.Op{
+		{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid1.Hex(), Body: map[string]interface{}{"id": oid1, "name": "a"}},
+		{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid2.Hex(), Body: map[string]interface{}{"id": oid2, "name": "b"}},
+		{Action: sink.ActionDelete, Index: "db1.coll1", ID: oid1.Hex()},
+	}
+	if !reflect.DeepEqual(snk.ops, want) {
+		t.Errorf("tailCollection() ops = %+v, want %+v", snk.ops, want)
+	}
+}
+
+func TestTailShardedCollection(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	ns := Namespace{Database: "shop", Collection: "orders"}
+
+	// Through mongos, the document key of events holds the shard key, and chunk migrations between shards produce no
+	// events, so the events of a document are the same whichever shard holds it
+	event := func(evt mongo2.ChangeStreamEvent) mongo2.ChangeStreamEvent {
+		evt.DocumentKey = mongo2.DocumentKey{ID: oid, ShardKey: map[string]interface{}{"tenant": "A"}}
+		return evt
+	}
+	source := mongo2.NewMemorySource()
+	source.AddEvents(ns,
+		event(mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: map[string]interface{}{"_id": oid, "tenant": "A"}}),
+		event(mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeUpdate, FullDocument: map[string]interface{}{"_id": oid, "tenant": "A", "status": "shipped"}}),
+		event(mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete}),
+	)
+
+	snk := &recordingQuerySink{}
+	s := New(source, snk)
+	collMapping := config.CollectionMapping{Name: "orders", Index: "orders-{{.tenant}}"}
+	cmd := collectionSyncCommand{collMapping: collMapping, dbMapping: config.DatabaseMapping{Name: "shop"}}
+	router, err := newIndexRouter(collMapping, "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.router = router
+
+	if err = s.tailCollection(context.Background(), 0, cmd, make(chan error)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The document is deleted from the index selected by the shard key in its document key
+	want := []sink.Op{
+		{Action: sink.ActionIndex, Index: "orders-a", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "tenant": "A"}},
+		{Action: sink.ActionIndex, Index: "orders-a", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "tenant": "A", "status": "shipped"}},
+		{Action: sink.ActionDelete, Index: "orders-a", ID: oid.Hex()},
+	}
+	if !reflect.DeepEqual(snk.ops, want) {
+		t.Errorf("tailCollection() ops = %+v, want %+v", snk.ops, want)
+	}
+	for _, op := range snk.queryOps {
+		if op.Action == sink.ActionDelete && !strings.Contains(op.Query, "must_not") {
+			t.Errorf("tailCollection() deleted by query %+v, want deletes by shard key", op)
+		}
+	}
+}
+
+func TestDeleteByDocumentKey(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	parentID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+
+	tests := []struct {
+		name        string
+		collMapping config.CollectionMapping
+		shardKey    map[string]interface{}
+		want        []sink.Op
+	}{
+		{
+			name:        "index selected by shard key",
+			collMapping: config.CollectionMapping{Name: "orders", Index: "orders-{{.tenant}}"},
+			shardKey:    map[string]interface{}{"tenant": "A"},
+			want:        []sink.Op{{Action: sink.ActionDelete, Index: "orders-a", ID: oid.Hex()}},
+		},
+		{
+			name:        "index selected by id",
+			collMapping: config.CollectionMapping{Name: "events", Rollover: &config.Rollover{Period: RolloverPeriodMonthly}},
+			want:        []sink.Op{{Action: sink.ActionDelete, Index: "db1.events-2020.05", ID: oid.Hex()}},
+		},
+		{
+			name:        "joined child routed by shard key",
+			collMapping: config.CollectionMapping{Name: "answers", Join: &config.Join{Field: "qa", Relation: "answer", Parent: "questions", ParentField: "question"}},
+			shardKey:    map[string]interface{}{"question": parentID},
+			want:        []sink.Op{{Action: sink.ActionDelete, Index: "db1.questions", ID: oid.Hex(), Routing: parentID.Hex()}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snk := &recordingSink{}
+			s := New(nil, snk)
+
+			cmd := collectionSyncCommand{collMapping: tt.collMapping, dbMapping: config.DatabaseMapping{Name: "db1"}}
+			router, err := newIndexRouter(tt.collMapping, "db1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd.router = router
+
+			evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeDelete}
+			evt.DocumentKey = mongo2.DocumentKey{ID: oid, ShardKey: tt.shardKey}
+
+			if err = s.handleStreamEvent(context.Background(), evt, cmd, cmd.indexName()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(snk.ops, tt.want) {
+				t.Errorf("handleStreamEvent() ops = %+v, want %+v", snk.ops, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+
+	"mongo-elastic-sync/config"
+)
+
+// targetCommands returns the sync commands of a collection: one for the collection's own index, followed by one for
+// each of its targets.
+func (s *syncer) targetCommands(collMapping config.CollectionMapping, dbMapping config.DatabaseMapping) ([]collectionSyncCommand, error) {
+	cmds := []collectionSyncCommand{{collMapping: collMapping, dbMapping: dbMapping}}
+	if len(collMapping.Targets) == 0 {
+		return cmds, nil
+	}
+
+	if collMapping.Embed != nil || collMapping.Join != nil {
+		return nil, errors.New("embedded and joined collections cannot have targets")
+	}
+
+	for i, target := range collMapping.Targets {
+		name := target.Name
+		if name == "" {
+			name = fmt.Sprintf("targets[%d]", i)
+		}
+
+		if _, ok := s.connections[target.Connection]; target.Connection != "" && !ok {
+			return nil, fmt.Errorf("target [%s]: unknown connection [%s]", name, target.Connection)
+		}
+
+		targetMapping := collMapping
+		targetMapping.Targets = nil
+		if target.Index != "" {
+			targetMapping.Index = target.Index
+			targetMapping.Rollover = nil
+		}
+		if target.Fields != nil {
+			targetMapping.Fields = target.Fields
+		}
+
+		cmds = append(cmds, collectionSyncCommand{
+			collMapping: targetMapping,
+			dbMapping:   dbMapping,
+			target:      name,
+			connection:  target.Connection,
+		})
+	}
+	return cmds, nil
+}
+
+// on returns the syncer that writes to the connection of cmd.
+func (s *syncer) on(cmd collectionSyncCommand) *syncer {
+	if c, ok := s.connections[cmd.connection]; ok {
+		return c
+	}
+	return s
+}
+
+// String identifies the command in errors by its collection and, for targets, the target name.
+func (c collectionSyncCommand) String() string {
+	if c.target == "" {
+		return fmt.Sprintf("collection [%s]", c.collMapping.Name)
+	}
+	return fmt.Sprintf("collection [%s] target [%s]", c.collMapping.Name, c.target)
+}
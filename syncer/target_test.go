@@ -0,0 +1,91 @@
+package syncer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+func TestTargets(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+
+	source := mongo2.NewMemorySource()
+	if err := source.Insert(Namespace{Database: "db1", Collection: "posts"}, bson.M{"_id": oid, "title": "a", "body": "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defaultSink, analyticsSink := &recordingSink{}, &recordingSink{}
+	s := New(source, defaultSink, WithConnection("analytics", analyticsSink))
+
+	cmds, err := s.collectionSyncCommands(context.Background(), config.SyncMapping{Databases: []config.DatabaseMapping{{
+		Name: "db1",
+		Collections: []config.CollectionMapping{{
+			Name: "posts",
+			Targets: []config.Target{
+				{Name: "slim", Index: "posts-slim", Fields: []fields.M{{Name: "title"}}},
+				{Name: "analytics", Connection: "analytics", Fields: []fields.M{{Name: "body"}}},
+			},
+		}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range cmds {
+		if err = s.on(cmd).dumpCollection(context.Background(), cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantDefault := []sink.Op{
+		{Action: sink.ActionIndex, Index: "db1.posts", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "title": "a", "body": "b"}},
+		{Action: sink.ActionIndex, Index: "posts-slim", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "title": "a"}},
+	}
+	if !reflect.DeepEqual(defaultSink.ops, wantDefault) {
+		t.Errorf("default sink ops = %+v, want %+v", defaultSink.ops, wantDefault)
+	}
+
+	wantAnalytics := []sink.Op{
+		{Action: sink.ActionIndex, Index: "db1.posts", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "body": "b"}},
+	}
+	if !reflect.DeepEqual(analyticsSink.ops, wantAnalytics) {
+		t.Errorf("analytics sink ops = %+v, want %+v", analyticsSink.ops, wantAnalytics)
+	}
+}
+
+func TestTargetCommandsErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		collMapping config.CollectionMapping
+		wantErr     string
+	}{
+		{
+			name:        "unknown connection",
+			collMapping: config.CollectionMapping{Name: "posts", Targets: []config.Target{{Connection: "missing"}}},
+			wantErr:     "target [targets[0]]: unknown connection [missing]",
+		},
+		{
+			name:        "embedded collection",
+			collMapping: config.CollectionMapping{Name: "comments", Embed: &config.Embed{Parent: "posts"}, Targets: []config.Target{{Name: "t"}}},
+			wantErr:     "embedded and joined collections cannot have targets",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, &recordingSink{})
+			_, err := s.targetCommands(tt.collMapping, config.DatabaseMapping{Name: "db1"})
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("targetCommands() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+// transactionsCheckpointKey is the key the resume token of the change stream of all collections is saved under
+const transactionsCheckpointKey = "transactions"
+
+// bufferSink buffers the index and delete operations written to it until they are flushed to the underlying sink in
+// one bulk request.
+type bufferSink struct {
+	sink.Sink
+	ops []sink.Op
+}
+
+func (b *bufferSink) Index(ctx context.Context, index, id, routing string, doc interface{}) error {
+	b.ops = append(b.ops, sink.Op{Action: sink.ActionIndex, Index: index, ID: id, Routing: routing, Body: doc})
+	return nil
+}
+
+func (b *bufferSink) Delete(ctx context.Context, index, id, routing string) error {
+	b.ops = append(b.ops, sink.Op{Action: sink.ActionDelete, Index: index, ID: id, Routing: routing})
+	return nil
+}
+
+func (b *bufferSink) Bulk(ctx context.Context, ops []sink.Op) error {
+	b.ops = append(b.ops, ops...)
+	return nil
+}
+
+// flush writes the buffered operations to the underlying sink.
+func (b *bufferSink) flush(ctx context.Context) error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	err := b.Sink.Bulk(ctx, b.ops)
+	b.ops = nil
+	return err
+}
+
+// tailTransactions watches for changes on all collections of cmds in the change stream of the deployment, and applies
+// the events of each multi-document transaction to each sink in one bulk request, so that searches do not see
+// half-applied transactions. Events outside of transactions are applied one at a time.
+// Only the collections of cmds are watched, so the writes of the state database, such as checkpoints and leases, are
+// not streamed back. The checkpoint is saved after each transaction that changed any of them.
+// Changes that are not written as index or delete operations, such as the updates of embedded collections, are not
+// batched.
+// It returns an error if the change stream cursor cannot be obtained, but errors that occur while decoding or
+// indexing events are reported through indexErrs.
+func (s *syncer) tailTransactions(ctx context.Context, startUnix int64, cmds []collectionSyncCommand, indexErrs chan<- error) error {
+	opts, err := s.watchOptions(ctx, transactionsCheckpointKey, startUnix, nil)
+	if err != nil {
+		return err
+	}
+
+	byNamespace := make(map[Namespace][]collectionSyncCommand)
+	var namespaces []Namespace
+	for _, cmd := range cmds {
+		if _, ok := byNamespace[cmd.namespace()]; !ok {
+			namespaces = append(namespaces, cmd.namespace())
+		}
+		byNamespace[cmd.namespace()] = append(byNamespace[cmd.namespace()], cmd)
+	}
+
+	stream, err := s.source.WatchAll(ctx, namespaces, opts)
+	if err != nil {
+		return fmt.Errorf("starting change stream %s: %w", opts, err)
+	}
+
+	defer func() { logIfErr(stream.Close(ctx)) }()
+
+	log.With("action", "tailing").Info("Listening for new events in all collections")
+
+	// failed is set once a transaction fails to apply, after which the checkpoint is no longer saved, as in
+	// tailCollection
+	failed := false
+	apply := func(txn []mongo2.ChangeStreamEvent) {
+		applied, succeeded := s.applyTransaction(ctx, txn, byNamespace, indexErrs)
+		if failed = failed || !succeeded; failed || !applied {
+			return
+		}
+		if err := s.saveCheckpoint(ctx, transactionsCheckpointKey, txn[len(txn)-1]); err != nil {
+			indexErrs <- fmt.Errorf("transactions: %w", err)
+		}
+	}
+
+	for {
+		if !stream.Next(ctx) {
+			// stream died, return deadline/cursor error
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return stream.Err()
+		}
+
+		// Read the events that are available without waiting, as a transaction's events arrive together, and apply
+		// each transaction once all its events have been read
+		var txn []mongo2.ChangeStreamEvent
+		for {
+			evt := mongo2.ChangeStreamEvent{}
+			if err = stream.Decode(&evt); err != nil {
+				indexErrs <- fmt.Errorf("transactions: %w", err)
+			} else {
+				if len(txn) > 0 && !txn[0].SameTransaction(evt) {
+					apply(txn)
+					txn = nil
+				}
+				txn = append(txn, evt)
+			}
+
+			if !stream.TryNext(ctx) {
+				break
+			}
+		}
+		if len(txn) > 0 {
+			apply(txn)
+		}
+	}
+}
+
+// applyTransaction applies the events of a transaction, or a single event outside of a transaction, to the
+// collections of byNamespace, writing the resulting operations to each sink in one bulk request. It returns whether
+// any event was applied to a collection, and whether all of them were applied without errors.
+func (s *syncer) applyTransaction(ctx context.Context, txn []mongo2.ChangeStreamEvent, byNamespace map[Namespace][]collectionSyncCommand, indexErrs chan<- error) (bool, bool) {
+	buffers := make(map[*syncer]*bufferSink)
+	buffered := make(map[*syncer]*syncer)
+	applied, succeeded := false, true
+
+	for _, evt := range txn {
+		for _, cmd := range byNamespace[evt.EventNamespace()] {
+			applied = true
+			target := s.on(cmd)
+			if _, ok := buffered[target]; !ok {
+				buffers[target] = &bufferSink{Sink: target.sink}
+				b := *target
+				b.sink = buffers[target]
+				buffered[target] = &b
+			}
+
+			if err := buffered[target].handleStreamEvent(ctx, evt, cmd, cmd.indexName()); err != nil {
+				indexErrs <- fmt.Errorf("%s: %w", cmd, err)
+				succeeded = false
+			}
+		}
+	}
+
+	for _, buf := range buffers {
+		if err := buf.flush(ctx); err != nil {
+			indexErrs <- fmt.Errorf("transactions: %w", err)
+			succeeded = false
+		}
+	}
+	return applied, succeeded
+}
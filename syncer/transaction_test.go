@@ -0,0 +1,73 @@
+package syncer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+func TestTailTransactions(t *testing.T) {
+	oid1, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837c")
+	oid2, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb837d")
+	coll1 := Namespace{Database: "db1", Collection: "coll1"}
+	coll2 := Namespace{Database: "db1", Collection: "coll2"}
+	session := &mongo2.SessionID{ID: primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}}
+
+	event := func(token string, id primitive.ObjectID, name string, txnNumber int64) mongo2.ChangeStreamEvent {
+		evt := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: map[string]interface{}{"_id": id, "name": name}}
+		evt.ID.Data = token
+		evt.DocumentKey.ID = id
+		if txnNumber > 0 {
+			evt.TxnNumber, evt.LSID = &txnNumber, session
+		}
+		return evt
+	}
+
+	source := mongo2.NewMemorySource()
+	source.AddEvents(coll1, event("token1", oid1, "a", 1))
+	source.AddEvents(coll2, event("token2", oid2, "b", 1))
+	source.AddEvents(coll1, event("token3", oid1, "c", 0))
+	source.AddEvents(coll2, event("token4", oid2, "d", 2))
+	source.AddEvents(coll1, event("token5", oid1, "e", 2))
+	// The writes of the state database are not streamed back
+	state := Namespace{Database: "mongo-elastic-sync", Collection: "checkpoints"}
+	checkpoint := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeReplace, FullDocument: map[string]interface{}{"_id": transactionsCheckpointKey}}
+	checkpoint.ID.Data, checkpoint.DocumentKey.ID = "token6", transactionsCheckpointKey
+	lease := mongo2.ChangeStreamEvent{OperationType: mongo2.ChangeStreamEventOperationTypeInsert, FullDocument: map[string]interface{}{"_id": "leader"}}
+	lease.ID.Data, lease.DocumentKey.ID = "token7", "leader"
+	source.AddEvents(state, checkpoint, lease)
+
+	snk := &recordingSink{}
+	checkpoints := mongo2.NewMemoryCheckpoints()
+	s := New(source, snk, WithTransactions(), WithCheckpoints(checkpoints))
+	cmds := []collectionSyncCommand{
+		{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}},
+		{collMapping: config.CollectionMapping{Name: "coll2"}, dbMapping: config.DatabaseMapping{Name: "db1"}},
+	}
+
+	if err := s.tailTransactions(context.Background(), 0, cmds, make(chan error)); err != nil {
+		t.Fatal(err)
+	}
+
+	op := func(coll string, id primitive.ObjectID, name string) sink.Op {
+		return sink.Op{Action: sink.ActionIndex, Index: "db1." + coll, ID: id.Hex(), Body: map[string]interface{}{"id": id, "name": name}}
+	}
+	want := [][]sink.Op{
+		{op("coll1", oid1, "a"), op("coll2", oid2, "b")},
+		{op("coll1", oid1, "c")},
+		{op("coll2", oid2, "d"), op("coll1", oid1, "e")},
+	}
+	if !reflect.DeepEqual(snk.batches, want) {
+		t.Errorf("tailTransactions() batches = %+v, want %+v", snk.batches, want)
+	}
+
+	if saved, _ := checkpoints.Load(context.Background(), transactionsCheckpointKey); saved.Token != "token5" {
+		t.Errorf("saved checkpoint = %s, want token5", saved.Token)
+	}
+}
@@ -0,0 +1,476 @@
+package syncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/olivere/elastic"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/sink"
+)
+
+// Drift is the difference between a synced collection and its index, as found by Verify.
+type Drift struct {
+	Namespace Namespace
+	// Target is the name of the verified collection target, or empty for the collection's own index
+	Target string
+	// Index is the index of the collection, or the pattern matching the indexes of a routed collection
+	Index string
+	// MongoCount is the number of documents in the collection and IndexCount the number of documents in its index.
+	// They may differ without drift if documents are filtered out or soft-deleted.
+	MongoCount int64
+	IndexCount int64
+	// Missing are the documents that should be indexed but are not
+	Missing []DriftDocument
+	// Extra are the indexed documents that should not be, e.g. because they were deleted from Mongo
+	Extra []DriftDocument
+	// Stale are the indexed documents whose content differs from the document that would be indexed now
+	Stale []DriftDocument
+	// Repaired is set if the differences were repaired
+	Repaired bool
+}
+
+// InSync returns true if no differences were found.
+func (d Drift) InSync() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Stale) == 0
+}
+
+// DriftDocument identifies a document that differs between a collection and its index.
+type DriftDocument struct {
+	Index string
+	ID    string
+}
+
+// verifyBatchSize is the number of documents Verify reads from the other side at once.
+const verifyBatchSize = 500
+
+// expectedDocument is a Mongo document as Verify expects it to be indexed.
+type expectedDocument struct {
+	key indexedKey
+	// mongoID is the _id of the Mongo document
+	mongoID interface{}
+	op      sink.Op
+	hash    string
+}
+
+// indexedKey identifies an indexed document. The index is only set for routed collections, whose documents may be
+// indexed into the wrong index.
+type indexedKey struct {
+	index string
+	id    string
+}
+
+// Verify compares the documents of the collections configured by syncMapping with the documents in their indexes.
+// It prepares each Mongo document as it would be indexed and compares a hash of it with a hash of the indexed
+// document. If repair is set, missing and stale documents are re-indexed and extra documents are deleted.
+// Embedded collections are verified as part of their parents. Documents are compared in batches of ids, so that
+// neither a collection nor its index is held in memory. Each document is read again from Mongo right before it is
+// repaired, so that repairs do not overwrite changes tailed in the meantime.
+func (s *syncer) Verify(ctx context.Context, syncMapping config.SyncMapping, repair bool) ([]Drift, error) {
+	cmds, err := s.collectionSyncCommands(ctx, syncMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	drifts := make([]Drift, 0, len(cmds))
+	for _, cmd := range cmds {
+		if cmd.collMapping.Embed != nil {
+			continue
+		}
+
+		drift, err := s.on(cmd).verifyCollection(ctx, cmd, repair, nil)
+		if err != nil {
+			return drifts, fmt.Errorf("%s: %w", cmd, err)
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts, nil
+}
+
+// verifyCollection compares the documents of the collection with the documents in its index and, if repair is set,
+// repairs the differences. If limit is not nil, documents are read from Mongo and from the index at its rate.
+func (s syncer) verifyCollection(ctx context.Context, cmd collectionSyncCommand, repair bool, limit *throttle) (Drift, error) {
+	drift := Drift{Namespace: cmd.namespace(), Target: cmd.target, Index: cmd.indexName()}
+
+	reader, ok := s.sink.(sink.Reader)
+	if !ok {
+		return drift, fmt.Errorf("verifying needs an Elasticsearch sink: %w", sink.ErrUnsupported)
+	}
+
+	log := log.With("collection", cmd.collMapping.Name, "database", cmd.dbMapping.Name, "target", cmd.target, "index", drift.Index, "action", "verifying")
+
+	var err error
+	if drift.MongoCount, err = s.source.Count(ctx, cmd.namespace(), bson.D{}); err != nil {
+		return drift, fmt.Errorf("counting documents: %w", err)
+	}
+
+	// Joined collections share their index with the other collections of the join
+	var query elastic.Query
+	if j := cmd.collMapping.Join; j != nil {
+		query = elastic.NewTermQuery(j.Field, j.Relation)
+	}
+
+	if drift.IndexCount, err = reader.Count(ctx, drift.Index, query); err != nil {
+		return drift, fmt.Errorf("counting indexed documents: %w", err)
+	}
+
+	log.With("mongoCount", drift.MongoCount, "indexCount", drift.IndexCount).Info("Counted documents")
+
+	if repair && cmd.router == nil {
+		if err = s.ensureIndex(ctx, drift.Index, cmd.joinMapping()); err != nil {
+			return drift, err
+		}
+	}
+
+	// Both sides are compared in batches of ids, so that neither is held in memory. The Mongo documents are compared
+	// with their indexed copies first, and the indexed documents are then matched with the Mongo documents they were
+	// indexed from, to find the copies that should not be indexed.
+	if err = s.verifyDocuments(ctx, cmd, reader, query, repair, limit, &drift); err != nil {
+		return drift, err
+	}
+	if err = s.verifyIndexed(ctx, cmd, reader, query, repair, limit, &drift); err != nil {
+		return drift, err
+	}
+
+	sort.Slice(drift.Extra, func(i, j int) bool {
+		if drift.Extra[i].Index != drift.Extra[j].Index {
+			return drift.Extra[i].Index < drift.Extra[j].Index
+		}
+		return drift.Extra[i].ID < drift.Extra[j].ID
+	})
+
+	drift.Repaired = repair && !drift.InSync()
+
+	log.With("missing", len(drift.Missing), "extra", len(drift.Extra), "stale", len(drift.Stale), "repaired", drift.Repaired).
+		Info("Verified collection")
+	return drift, nil
+}
+
+// verifyDocuments compares the documents of the collection, in batches, with their indexed copies, and records the
+// missing and stale documents in drift. If repair is set, they are indexed again.
+func (s syncer) verifyDocuments(ctx context.Context, cmd collectionSyncCommand, reader sink.Reader, query elastic.Query, repair bool, limit *throttle, drift *Drift) error {
+	cursor, err := s.collectionCursor(ctx, cmd)
+	if err != nil {
+		return err
+	}
+
+	defer func() { logIfErr(cursor.Close(ctx)) }()
+
+	batch := make([]expectedDocument, 0, verifyBatchSize)
+	for cursor.Next(ctx) {
+		if err = limit.wait(ctx); err != nil {
+			return err
+		}
+
+		var doc map[string]interface{}
+		if err = cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		if err = selectLookupFields(doc, cmd.lookups()); err != nil {
+			return err
+		}
+
+		expected, include, err := s.expectDocument(ctx, cmd, doc)
+		if err != nil {
+			return err
+		}
+		if !include {
+			// Indexed copies of excluded documents are reported as extra
+			continue
+		}
+
+		if batch = append(batch, expected); len(batch) == verifyBatchSize {
+			if err = s.compareBatch(ctx, cmd, reader, query, batch, repair, drift); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	return s.compareBatch(ctx, cmd, reader, query, batch, repair, drift)
+}
+
+// compareBatch compares a batch of documents of the collection with their indexed copies, and records the missing and
+// stale documents in drift. If repair is set, they are indexed again.
+func (s syncer) compareBatch(ctx context.Context, cmd collectionSyncCommand, reader sink.Reader, query elastic.Query, batch []expectedDocument, repair bool, drift *Drift) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(batch))
+	for i, expected := range batch {
+		ids[i] = expected.key.id
+	}
+
+	// hashes holds the hashes of the indexed copies of the batch
+	hashes := make(map[indexedKey]string, len(batch))
+	err := reader.Scan(ctx, drift.Index, withIDs(query, ids), func(hit sink.Hit) error {
+		hash, err := documentHash(hit.Source)
+		if err != nil {
+			return fmt.Errorf("hashing indexed document [%s]: %w", hit.ID, err)
+		}
+		hashes[hitKey(cmd, hit)] = hash
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading indexed documents: %w", err)
+	}
+
+	for _, expected := range batch {
+		hash, ok := hashes[expected.key]
+		switch {
+		case !ok:
+			drift.Missing = append(drift.Missing, DriftDocument{Index: expected.op.Index, ID: expected.op.ID})
+		case hash != expected.hash:
+			drift.Stale = append(drift.Stale, DriftDocument{Index: expected.op.Index, ID: expected.op.ID})
+		default:
+			continue
+		}
+
+		if repair {
+			if cmd.router != nil {
+				if err = s.ensureIndex(ctx, expected.op.Index, cmd.router.createBody(expected.op.Index)); err != nil {
+					return err
+				}
+			}
+			filter := bson.M{"_id": expected.mongoID}
+			if err = s.repairDocument(ctx, cmd, expected.op.Index, filter, expected.op.ID, expected.op.Routing); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyIndexed matches the indexed documents of the collection, in batches, with the Mongo documents they were indexed
+// from, and records the documents that should not be indexed in drift, because their Mongo document was deleted, is
+// excluded or is routed to another index. If repair is set, they are repaired.
+func (s syncer) verifyIndexed(ctx context.Context, cmd collectionSyncCommand, reader sink.Reader, query elastic.Query, repair bool, limit *throttle, drift *Drift) error {
+	var matchErr error
+	batch := make([]sink.Hit, 0, verifyBatchSize)
+	err := reader.Scan(ctx, drift.Index, query, func(hit sink.Hit) error {
+		if err := limit.wait(ctx); err != nil {
+			return err
+		}
+
+		if batch = append(batch, hit); len(batch) == verifyBatchSize {
+			if matchErr = s.matchBatch(ctx, cmd, batch, repair, drift); matchErr != nil {
+				return matchErr
+			}
+			batch = batch[:0]
+		}
+		return nil
+	})
+	if matchErr != nil {
+		return matchErr
+	}
+	if err != nil {
+		return fmt.Errorf("reading indexed documents: %w", err)
+	}
+	return s.matchBatch(ctx, cmd, batch, repair, drift)
+}
+
+// matchBatch matches a batch of indexed documents of the collection with the Mongo documents they may have been
+// indexed from, and records the documents that should not be indexed in drift. If repair is set, they are repaired.
+func (s syncer) matchBatch(ctx context.Context, cmd collectionSyncCommand, hits []sink.Hit, repair bool, drift *Drift) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	ids := bson.A{}
+	for _, hit := range hits {
+		ids = append(ids, indexedIDs(hit.ID)...)
+	}
+
+	cursor, err := s.source.Find(ctx, cmd.namespace(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return fmt.Errorf("reading documents: %w", err)
+	}
+
+	defer func() { logIfErr(cursor.Close(ctx)) }()
+
+	// expected holds the keys the Mongo documents of the batch are indexed under
+	expected := make(map[indexedKey]bool, len(hits))
+	for cursor.Next(ctx) {
+		var doc map[string]interface{}
+		if err = cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		if err = s.lookupDocument(ctx, cmd, doc); err != nil {
+			return err
+		}
+
+		e, include, err := s.expectDocument(ctx, cmd, doc)
+		if err != nil {
+			return err
+		}
+		if include {
+			expected[e.key] = true
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+
+	for _, hit := range hits {
+		key := hitKey(cmd, hit)
+		if expected[key] {
+			continue
+		}
+
+		index := key.index
+		if index == "" {
+			index = drift.Index
+		}
+		drift.Extra = append(drift.Extra, DriftDocument{Index: index, ID: hit.ID})
+
+		if repair {
+			filter := bson.M{"_id": bson.M{"$in": indexedIDs(hit.ID)}}
+			if err = s.repairDocument(ctx, cmd, index, filter, hit.ID, hit.Routing); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expectDocument prepares doc, a document of the collection with its lookups joined, as it would be indexed. It
+// returns false if the document is not indexed.
+func (s syncer) expectDocument(ctx context.Context, cmd collectionSyncCommand, doc map[string]interface{}) (expectedDocument, bool, error) {
+	prepared, include, err := s.prepareDocument(ctx, cmd, doc)
+	if err != nil || !include {
+		return expectedDocument{}, false, err
+	}
+
+	expected := expectedDocument{key: indexedKey{id: documentID(doc["_id"])}, mongoID: doc["_id"]}
+	index := cmd.indexName()
+	if cmd.router != nil {
+		if index, err = cmd.router.index(doc); err != nil {
+			return expected, false, fmt.Errorf("routing document [%s]: %w", expected.key.id, err)
+		}
+		expected.key.index = index
+	}
+
+	expected.op = indexOp(index, prepared, cmd.routing(doc))
+	if expected.hash, err = documentHash(expected.op.Body); err != nil {
+		return expected, false, fmt.Errorf("hashing document [%s]: %w", expected.key.id, err)
+	}
+	return expected, true, nil
+}
+
+// hitKey returns the key of an indexed document of the collection.
+func hitKey(cmd collectionSyncCommand, hit sink.Hit) indexedKey {
+	key := indexedKey{id: hit.ID}
+	if cmd.router != nil {
+		key.index = hit.Index
+	}
+	return key
+}
+
+// withIDs restricts query, which may be nil to match all documents, to the documents with ids.
+func withIDs(query elastic.Query, ids []string) elastic.Query {
+	idsQuery := elastic.NewIdsQuery().Ids(ids...)
+	if query == nil {
+		return idsQuery
+	}
+	return elastic.NewBoolQuery().Filter(query, idsQuery)
+}
+
+// repairDocument repairs the copy of the document matching filter in index. The document is read again from Mongo
+// right before it is repaired, so that a version tailed since the collection was read is not overwritten by an
+// older one: its current version is indexed if it belongs in index, and the copy is deleted otherwise.
+func (s syncer) repairDocument(ctx context.Context, cmd collectionSyncCommand, index string, filter bson.M, id, routing string) error {
+	cursor, err := s.source.Find(ctx, cmd.namespace(), filter)
+	if err != nil {
+		return fmt.Errorf("reading document [%s]: %w", id, err)
+	}
+
+	var doc map[string]interface{}
+	if cursor.Next(ctx) {
+		err = cursor.Decode(&doc)
+	}
+	if err == nil {
+		err = cursor.Err()
+	}
+	logIfErr(cursor.Close(ctx))
+	if err != nil {
+		return fmt.Errorf("reading document [%s]: %w", id, err)
+	}
+
+	if doc != nil {
+		if err = s.lookupDocument(ctx, cmd, doc); err != nil {
+			return err
+		}
+
+		current := cmd.indexName()
+		if cmd.router != nil {
+			if current, err = cmd.router.index(doc); err != nil {
+				return fmt.Errorf("routing document [%s]: %w", id, err)
+			}
+		}
+
+		prepared, include, err := s.prepareDocument(ctx, cmd, doc)
+		if err != nil {
+			return err
+		}
+		if include && current == index {
+			if err = s.indexDocument(ctx, index, prepared, cmd.routing(doc)); err != nil {
+				return fmt.Errorf("repairing document [%s]: %w", id, err)
+			}
+			return nil
+		}
+	}
+
+	if err = s.deleteDocument(ctx, index, id, routing); err != nil {
+		return fmt.Errorf("repairing document [%s]: %w", id, err)
+	}
+	return nil
+}
+
+// indexedIDs returns the Mongo ids an indexed document with id may have been indexed from.
+func indexedIDs(id string) bson.A {
+	ids := bson.A{id}
+	if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+		ids = append(ids, oid)
+	}
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		ids = append(ids, n)
+		if int64(int32(n)) == n {
+			ids = append(ids, int32(n))
+		}
+	}
+	return ids
+}
+
+// documentHash returns a hash of the JSON encoding of doc, which is the same for a document that is indexed and the
+// source of the document read back from the index. Fields are hashed in lexical order.
+func documentHash(doc interface{}) (string, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	// Decode and re-encode to order the fields of objects and normalize numbers
+	var normalized interface{}
+	if err = json.Unmarshal(b, &normalized); err != nil {
+		return "", err
+	}
+	if b, err = json.Marshal(normalized); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,220 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/olivere/elastic"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mongo-elastic-sync/config"
+	"mongo-elastic-sync/fields"
+	mongo2 "mongo-elastic-sync/mongo"
+	"mongo-elastic-sync/sink"
+)
+
+// readableSink is a recordingSink whose index holds a fixed set of documents.
+type readableSink struct {
+	recordingSink
+	hits []sink.Hit
+	// scans is the number of times the index was scanned
+	scans int
+}
+
+func (s *readableSink) Count(ctx context.Context, index string, query elastic.Query) (int64, error) {
+	return int64(len(s.hits)), nil
+}
+
+func (s *readableSink) Scan(ctx context.Context, index string, query elastic.Query, fn func(sink.Hit) error) error {
+	s.scans++
+	for _, hit := range s.hits {
+		if err := fn(hit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	oids := make([]primitive.ObjectID, 4)
+	for i, hex := range []string{"5eb6bd2d0b6bdf6514bb8370", "5eb6bd2d0b6bdf6514bb8371", "5eb6bd2d0b6bdf6514bb8372", "5eb6bd2d0b6bdf6514bb8373"} {
+		oids[i], _ = primitive.ObjectIDFromHex(hex)
+	}
+
+	source := mongo2.NewMemorySource()
+	if err := source.Insert(Namespace{Database: "db1", Collection: "coll1"},
+		bson.M{"_id": oids[0], "name": "in sync", "secret": "s"},
+		bson.M{"_id": oids[1], "name": "updated"},
+		bson.M{"_id": oids[2], "name": "missing"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	hits := []sink.Hit{
+		{Index: "db1.coll1", ID: oids[0].Hex(), Source: json.RawMessage(`{"name":"in sync","id":"` + oids[0].Hex() + `"}`)},
+		{Index: "db1.coll1", ID: oids[1].Hex(), Source: json.RawMessage(`{"id":"` + oids[1].Hex() + `","name":"outdated"}`)},
+		{Index: "db1.coll1", ID: oids[3].Hex(), Routing: "r", Source: json.RawMessage(`{"id":"` + oids[3].Hex() + `","name":"deleted"}`)},
+	}
+	mapping := config.SyncMapping{Databases: []config.DatabaseMapping{{
+		Name:        "db1",
+		Collections: []config.CollectionMapping{{Name: "coll1", Fields: []fields.M{{Name: "name"}}}},
+	}}}
+
+	wantDrift := Drift{
+		Namespace:  Namespace{Database: "db1", Collection: "coll1"},
+		Index:      "db1.coll1",
+		MongoCount: 3,
+		IndexCount: 3,
+		Missing:    []DriftDocument{{Index: "db1.coll1", ID: oids[2].Hex()}},
+		Extra:      []DriftDocument{{Index: "db1.coll1", ID: oids[3].Hex()}},
+		Stale:      []DriftDocument{{Index: "db1.coll1", ID: oids[1].Hex()}},
+	}
+
+	t.Run("report", func(t *testing.T) {
+		snk := &readableSink{hits: hits}
+		drifts, err := New(source, snk).Verify(context.Background(), mapping, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(drifts, []Drift{wantDrift}) {
+			t.Errorf("Verify() got = %+v, want %+v", drifts, []Drift{wantDrift})
+		}
+		if len(snk.ops) != 0 {
+			t.Errorf("Verify() ops = %+v, want none", snk.ops)
+		}
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		snk := &readableSink{hits: hits}
+		drifts, err := New(source, snk).Verify(context.Background(), mapping, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repaired := wantDrift
+		repaired.Repaired = true
+		if !reflect.DeepEqual(drifts, []Drift{repaired}) {
+			t.Errorf("Verify() got = %+v, want %+v", drifts, []Drift{repaired})
+		}
+
+		want := []sink.Op{
+			{Action: sink.ActionIndex, Index: "db1.coll1", ID: oids[1].Hex(), Body: map[string]interface{}{"id": oids[1], "name": "updated"}},
+			{Action: sink.ActionIndex, Index: "db1.coll1", ID: oids[2].Hex(), Body: map[string]interface{}{"id": oids[2], "name": "missing"}},
+			{Action: sink.ActionDelete, Index: "db1.coll1", ID: oids[3].Hex(), Routing: "r"},
+		}
+		if !reflect.DeepEqual(snk.ops, want) {
+			t.Errorf("Verify() ops = %+v, want %+v", snk.ops, want)
+		}
+	})
+
+	t.Run("unreadable sink", func(t *testing.T) {
+		_, err := New(source, &recordingSink{}).Verify(context.Background(), mapping, false)
+		if !errors.Is(err, sink.ErrUnsupported) {
+			t.Errorf("Verify() error = %v, want %v", err, sink.ErrUnsupported)
+		}
+	})
+}
+
+func TestVerifyBatches(t *testing.T) {
+	ns := Namespace{Database: "db1", Collection: "coll1"}
+	n := 2*verifyBatchSize + 1
+
+	// The index misses the first document and has an extra one after the last
+	source := mongo2.NewMemorySource()
+	var hits []sink.Hit
+	for i := 0; i < n; i++ {
+		if err := source.Insert(ns, bson.M{"_id": int32(i)}); err != nil {
+			t.Fatal(err)
+		}
+		id := strconv.Itoa(i + 1)
+		hits = append(hits, sink.Hit{Index: "db1.coll1", ID: id, Source: json.RawMessage(`{"id":` + id + `}`)})
+	}
+
+	snk := &readableSink{hits: hits}
+	cmd := collectionSyncCommand{collMapping: config.CollectionMapping{Name: "coll1"}, dbMapping: config.DatabaseMapping{Name: "db1"}}
+	drift, err := New(source, snk).verifyCollection(context.Background(), cmd, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []DriftDocument{{Index: "db1.coll1", ID: "0"}}; !reflect.DeepEqual(drift.Missing, want) {
+		t.Errorf("verifyCollection() missing = %+v, want %+v", drift.Missing, want)
+	}
+	if want := []DriftDocument{{Index: "db1.coll1", ID: strconv.Itoa(n)}}; !reflect.DeepEqual(drift.Extra, want) {
+		t.Errorf("verifyCollection() extra = %+v, want %+v", drift.Extra, want)
+	}
+	if len(drift.Stale) != 0 {
+		t.Errorf("verifyCollection() stale = %+v, want none", drift.Stale)
+	}
+	// The index is read once for each batch of Mongo documents, and once to find extra documents
+	if want := 4; snk.scans != want {
+		t.Errorf("verifyCollection() scans = %d, want %d", snk.scans, want)
+	}
+}
+
+func TestRepairDocument(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb8370")
+	deletedID, _ := primitive.ObjectIDFromHex("5eb6bd2d0b6bdf6514bb8371")
+
+	// The documents were changed since the collection was read by Verify
+	source := mongo2.NewMemorySource()
+	if err := source.Insert(Namespace{Database: "db1", Collection: "coll1"},
+		bson.M{"_id": oid, "name": "current"},
+		bson.M{"_id": "s1", "name": "inserted"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter bson.M
+		id     string
+		want   sink.Op
+	}{
+		{
+			name:   "updated",
+			filter: bson.M{"_id": oid},
+			id:     oid.Hex(),
+			want:   sink.Op{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "name": "current"}},
+		},
+		{
+			name:   "deleted",
+			filter: bson.M{"_id": deletedID},
+			id:     deletedID.Hex(),
+			want:   sink.Op{Action: sink.ActionDelete, Index: "db1.coll1", ID: deletedID.Hex(), Routing: "r"},
+		},
+		{
+			name:   "extra object id",
+			filter: bson.M{"_id": bson.M{"$in": indexedIDs(oid.Hex())}},
+			id:     oid.Hex(),
+			want:   sink.Op{Action: sink.ActionIndex, Index: "db1.coll1", ID: oid.Hex(), Body: map[string]interface{}{"id": oid, "name": "current"}},
+		},
+		{
+			name:   "extra string id",
+			filter: bson.M{"_id": bson.M{"$in": indexedIDs("s1")}},
+			id:     "s1",
+			want:   sink.Op{Action: sink.ActionIndex, Index: "db1.coll1", ID: "s1", Body: map[string]interface{}{"id": "s1", "name": "inserted"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snk := &recordingSink{}
+			cmd := collectionSyncCommand{
+				collMapping: config.CollectionMapping{Name: "coll1", Fields: []fields.M{{Name: "name"}}},
+				dbMapping:   config.DatabaseMapping{Name: "db1"},
+			}
+			if err := New(source, snk).repairDocument(context.Background(), cmd, "db1.coll1", tt.filter, tt.id, "r"); err != nil {
+				t.Fatal(err)
+			}
+			if want := []sink.Op{tt.want}; !reflect.DeepEqual(snk.ops, want) {
+				t.Errorf("repairDocument() ops = %+v, want %+v", snk.ops, want)
+			}
+		})
+	}
+}
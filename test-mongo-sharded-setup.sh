@@ -0,0 +1,24 @@
+# Start a sharded cluster with two single-member shards, reachable through mongos at localhost:27030
+docker-compose -f docker-compose.sharded.test.yml up -d configsvr shard1 shard2
+sleep 2 # Wait for 2s for the mongo processes to start up
+
+docker-compose -f docker-compose.sharded.test.yml exec -T configsvr mongo --eval "rs.initiate(
+  { _id: 'cfg', configsvr: true, members: [ { _id: 0, host: 'configsvr:27017' } ] }
+)"
+docker-compose -f docker-compose.sharded.test.yml exec -T shard1 mongo --eval "rs.initiate(
+  { _id: 'sh1', members: [ { _id: 0, host: 'shard1:27017' } ] }
+)"
+docker-compose -f docker-compose.sharded.test.yml exec -T shard2 mongo --eval "rs.initiate(
+  { _id: 'sh2', members: [ { _id: 0, host: 'shard2:27017' } ] }
+)"
+sleep 10 # Wait for the replica sets to elect their primaries
+
+docker-compose -f docker-compose.sharded.test.yml up -d mongos
+sleep 2
+docker-compose -f docker-compose.sharded.test.yml exec -T mongos mongo --eval "
+  sh.addShard('sh1/shard1:27017');
+  sh.addShard('sh2/shard2:27017');
+"
+
+# Run the sharded cluster tests with:
+# MONGOS_URL=mongodb://localhost:27030 go test -run TestRunSharded .